@@ -16,13 +16,16 @@ func (t NodeType) Type() NodeType {
 
 //go:generate stringer -type=NodeType -output=nodetype_string.go
 const (
-	NodeComment  NodeType = iota // A spok comment, preceded by a '#'.
-	NodeIdent                    // An identifier e.g. global variable or name of a task.
-	NodeAssign                   // A global variable assignment.
-	NodeString                   // A quoted string literal e.g "hello".
-	NodeFunction                 // A spok builtin function e.g. exec
-	NodeTask                     // A spok task.
-	NodeCommand                  // A spok task command.
+	NodeComment     NodeType = iota // A spok comment, preceded by a '#'.
+	NodeIdent                       // An identifier e.g. global variable or name of a task.
+	NodeAssign                      // A global variable assignment.
+	NodeString                      // A quoted string literal e.g "hello".
+	NodeFunction                    // A spok builtin function e.g. exec
+	NodeTask                        // A spok task.
+	NodeCommand                     // A spok task command.
+	NodeCondition                   // A boolean expression e.g. os == "darwin".
+	NodeConditional                 // A block of task commands guarded by a condition.
+	NodeAttribute                   // A task attribute e.g. @timeout("5m").
 )
 
 const (
@@ -148,14 +151,24 @@ func (a Assign) Write(s *strings.Builder) {
 	s.WriteString(a.String())
 }
 
-// Command holds a task command.
+// Command holds a task command, along with any modifiers it starts with
+// e.g. @echo hello.
 type Command struct {
-	Command string // The shell command to run
+	Command string // The shell command to run, without it's modifiers
 	NodeType
+	Silent      bool // Whether the command is not echoed before it's run, the '@' modifier
+	IgnoreError bool // Whether the task carries on if the command fails, the '-' modifier
 }
 
 func (c Command) String() string {
-	return c.Command
+	var modifiers string
+	if c.Silent {
+		modifiers += "@"
+	}
+	if c.IgnoreError {
+		modifiers += "-"
+	}
+	return modifiers + c.Command
 }
 
 func (c Command) Literal() string {
@@ -166,13 +179,125 @@ func (c Command) Write(s *strings.Builder) {
 	s.WriteString(c.String())
 }
 
+// Condition holds a boolean expression guarding a task or a block of commands
+// e.g. os == "darwin" && arch != "arm64".
+//
+// Comparisons have an Ident or String on either side, && and || join two
+// Conditions together. A Condition with no Operator is a single operand that
+// is true if it's value is truthy.
+type Condition struct {
+	Left     Node   // Left hand side, an Ident, String or nested Condition
+	Right    Node   // Right hand side, nil if there is no Operator
+	Operator string // One of "==", "!=", "&&", "||" or empty for a single operand
+	NodeType
+}
+
+func (c Condition) String() string {
+	if c.Operator == "" {
+		return c.Left.String()
+	}
+	return c.Left.String() + " " + c.Operator + " " + c.Right.String()
+}
+
+func (c Condition) Literal() string {
+	return c.String()
+}
+
+func (c Condition) Write(s *strings.Builder) {
+	s.WriteString(c.String())
+}
+
+// Conditional holds a block of task commands that only apply when it's Condition
+// is true, with an optional else block.
+type Conditional struct {
+	Condition Condition // The condition guarding the block
+	Then      []Node    // Commands (or nested Conditionals) run when the condition is true
+	Else      []Node    // Commands run when the condition is false, a single Conditional for else if
+	NodeType
+}
+
+func (c Conditional) String() string {
+	s := &strings.Builder{}
+	c.write(s, "")
+	return s.String()
+}
+
+func (c Conditional) Literal() string {
+	return c.String()
+}
+
+func (c Conditional) Write(s *strings.Builder) {
+	s.WriteString(c.String())
+}
+
+// write writes the conditional out with each line of it's body indented
+// one level deeper than indent, the first line is not indented so that it
+// can follow an else.
+func (c Conditional) write(s *strings.Builder, indent string) {
+	s.WriteString("if " + c.Condition.String() + " {\n")
+	writeBody(s, c.Then, indent+"    ")
+	s.WriteString(indent + "}")
+	if len(c.Else) == 0 {
+		return
+	}
+	if nested, ok := c.Else[0].(Conditional); ok && len(c.Else) == 1 {
+		s.WriteString(" else ")
+		nested.write(s, indent)
+		return
+	}
+	s.WriteString(" else {\n")
+	writeBody(s, c.Else, indent+"    ")
+	s.WriteString(indent + "}")
+}
+
+// writeBody writes out the commands and conditionals in a task body, one per line.
+func writeBody(s *strings.Builder, body []Node, indent string) {
+	for _, node := range body {
+		s.WriteString(indent)
+		if conditional, ok := node.(Conditional); ok {
+			conditional.write(s, indent)
+		} else {
+			s.WriteString(node.String())
+		}
+		s.WriteString("\n")
+	}
+}
+
+// Attribute holds a task attribute e.g. @private or @timeout("5m").
+type Attribute struct {
+	Name      Ident  // The attribute name, without the '@'
+	Arguments []Node // Attribute arguments, empty if it has none
+	NodeType
+}
+
+func (a Attribute) String() string {
+	if len(a.Arguments) == 0 {
+		return "@" + a.Name.String()
+	}
+	args := make([]string, 0, len(a.Arguments))
+	for _, arg := range a.Arguments {
+		args = append(args, arg.String())
+	}
+	return "@" + a.Name.String() + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (a Attribute) Literal() string {
+	return a.String()
+}
+
+func (a Attribute) Write(s *strings.Builder) {
+	s.WriteString(a.String())
+}
+
 // Task holds a spok task.
 type Task struct {
-	Name         Ident     // The name of the task
-	Docstring    Comment   // Task docstring comment
-	Dependencies []Node    // Task dependencies
-	Outputs      []Node    // Task outputs
-	Commands     []Command // Shell commands to run
+	Condition    Node        // Optional condition under which the task applies, nil if it always does
+	Name         Ident       // The name of the task
+	Docstring    Comment     // Task docstring comment
+	Attributes   []Attribute // Task attributes e.g. @private
+	Dependencies []Node      // Task dependencies
+	Outputs      []Node      // Task outputs
+	Commands     []Node      // Shell commands to run, or Conditional blocks of them
 	NodeType
 }
 
@@ -180,7 +305,6 @@ func (t Task) String() string {
 	s := strings.Builder{}
 
 	deps := make([]string, 0, len(t.Dependencies))
-	commands := make([]string, 0, len(t.Commands))
 
 	if len(t.Dependencies) != 0 {
 		for _, dep := range t.Dependencies {
@@ -188,14 +312,17 @@ func (t Task) String() string {
 		}
 	}
 
-	if len(t.Commands) != 0 {
-		for _, c := range t.Commands {
-			commands = append(commands, c.String())
+	s.WriteString(t.Docstring.String())
+
+	if len(t.Attributes) != 0 {
+		attributes := make([]string, 0, len(t.Attributes))
+		for _, attribute := range t.Attributes {
+			attributes = append(attributes, attribute.String())
 		}
+		s.WriteString(strings.Join(attributes, " "))
+		s.WriteString("\n")
 	}
 
-	s.WriteString(t.Docstring.String())
-
 	s.WriteString("task ")
 	s.WriteString(t.Name.String())
 	s.WriteString("(")
@@ -216,10 +343,12 @@ func (t Task) String() string {
 			s.WriteString(")")
 		}
 	}
-	s.WriteString(" {\n")
-	for _, command := range commands {
-		s.WriteString("    " + command + "\n")
+	if t.Condition != nil {
+		s.WriteString(" if ")
+		s.WriteString(t.Condition.String())
 	}
+	s.WriteString(" {\n")
+	writeBody(&s, t.Commands, "    ")
 	s.WriteString("}\n\n")
 
 	return s.String()
@@ -120,8 +120,8 @@ func TestLiteral(t *testing.T) {
 				Docstring:    ast.Comment{Text: "I'm a test task"},
 				Dependencies: []ast.Node{ast.String{Text: "**/*.go"}},
 				Outputs:      []ast.Node{ast.String{Text: "./bin/main"}},
-				Commands: []ast.Command{
-					{Command: "go test ./..."},
+				Commands: []ast.Node{
+					ast.Command{Command: "go test ./..."},
 				},
 				NodeType: ast.NodeTask,
 			},
@@ -137,6 +137,11 @@ task test("**/*.go") -> "./bin/main" {
 			node: ast.Command{Command: "git commit", NodeType: ast.NodeCommand},
 			want: "git commit",
 		},
+		{
+			name: "command with modifiers",
+			node: ast.Command{Command: "git commit", NodeType: ast.NodeCommand, Silent: true},
+			want: "git commit",
+		},
 	}
 
 	for _, tt := range tests {
@@ -207,8 +212,8 @@ func TestWrite(t *testing.T) {
 				Docstring:    ast.Comment{Text: "I'm a test task"},
 				Dependencies: []ast.Node{ast.String{Text: "**/*.go"}},
 				Outputs:      []ast.Node{ast.String{Text: "./bin/main"}},
-				Commands: []ast.Command{
-					{Command: "go test ./..."},
+				Commands: []ast.Node{
+					ast.Command{Command: "go test ./..."},
 				},
 				NodeType: ast.NodeTask,
 			},
@@ -224,6 +229,98 @@ task test("**/*.go") -> "./bin/main" {
 			node: ast.Command{Command: "git commit", NodeType: ast.NodeCommand},
 			want: "git commit",
 		},
+		{
+			name: "command with modifiers",
+			node: ast.Command{Command: "rm build", NodeType: ast.NodeCommand, Silent: true, IgnoreError: true},
+			want: "@-rm build",
+		},
+		{
+			name: "conditional task",
+			node: ast.Task{
+				Condition: ast.Condition{
+					Left:     ast.Ident{Name: "os"},
+					Right:    ast.String{Text: "darwin"},
+					Operator: "==",
+				},
+				Name: ast.Ident{Name: "open"},
+				Commands: []ast.Node{
+					ast.Command{Command: "open index.html"},
+				},
+				NodeType: ast.NodeTask,
+			},
+			want: `task open() if os == "darwin" {
+    open index.html
+}
+
+`,
+		},
+		{
+			name: "task with attributes",
+			node: ast.Task{
+				Name:      ast.Ident{Name: "build"},
+				Docstring: ast.Comment{Text: "Build the web app"},
+				Attributes: []ast.Attribute{
+					{Name: ast.Ident{Name: "timeout"}, Arguments: []ast.Node{ast.String{Text: "5m"}}},
+					{Name: ast.Ident{Name: "env"}, Arguments: []ast.Node{ast.String{Text: "NODE_ENV"}, ast.String{Text: "production"}}},
+					{Name: ast.Ident{Name: "private"}},
+				},
+				Commands: []ast.Node{ast.Command{Command: "npm run build"}},
+				NodeType: ast.NodeTask,
+			},
+			want: `# Build the web app
+@timeout("5m") @env("NODE_ENV", "production") @private
+task build() {
+    npm run build
+}
+
+`,
+		},
+		{
+			name: "conditional commands",
+			node: ast.Task{
+				Name: ast.Ident{Name: "open"},
+				Commands: []ast.Node{
+					ast.Conditional{
+						Condition: ast.Condition{
+							Left:     ast.Condition{Left: ast.Ident{Name: "os"}, Right: ast.String{Text: "darwin"}, Operator: "=="},
+							Right:    ast.Condition{Left: ast.Ident{Name: "CI"}},
+							Operator: "&&",
+						},
+						Then: []ast.Node{
+							ast.Command{Command: "open index.html"},
+							ast.Conditional{
+								Condition: ast.Condition{Left: ast.Ident{Name: "VERBOSE"}},
+								Then:      []ast.Node{ast.Command{Command: "echo opened"}},
+							},
+						},
+						Else: []ast.Node{
+							ast.Conditional{
+								Condition: ast.Condition{Left: ast.Ident{Name: "os"}, Right: ast.String{Text: "windows"}, Operator: "=="},
+								Then:      []ast.Node{ast.Command{Command: "start index.html"}},
+								Else:      []ast.Node{ast.Command{Command: "xdg-open index.html"}},
+							},
+						},
+					},
+					ast.Command{Command: "echo done"},
+				},
+				NodeType: ast.NodeTask,
+			},
+			want: `task open() {
+    if os == "darwin" && CI {
+        open index.html
+        if VERBOSE {
+            echo opened
+        }
+    } else if os == "windows" {
+        start index.html
+    } else {
+        xdg-open index.html
+    }
+    echo done
+}
+
+`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -412,8 +509,8 @@ var fullSpokfileAST = ast.Tree{
 				},
 			},
 			Outputs: []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "go test -race ./...",
 					NodeType: ast.NodeCommand,
 				},
@@ -436,8 +533,8 @@ var fullSpokfileAST = ast.Tree{
 				},
 			},
 			Outputs: []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "go fmt ./...",
 					NodeType: ast.NodeCommand,
 				},
@@ -455,20 +552,20 @@ var fullSpokfileAST = ast.Tree{
 			},
 			Dependencies: []ast.Node{},
 			Outputs:      []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "line 1",
 					NodeType: ast.NodeCommand,
 				},
-				{
+				ast.Command{
 					Command:  "line 2",
 					NodeType: ast.NodeCommand,
 				},
-				{
+				ast.Command{
 					Command:  "line 3",
 					NodeType: ast.NodeCommand,
 				},
-				{
+				ast.Command{
 					Command:  "line 4",
 					NodeType: ast.NodeCommand,
 				},
@@ -496,8 +593,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeString,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  `go build -ldflags="-X main.version=test -X main.commit=7cb0ec5609efb5fe0"`,
 					NodeType: ast.NodeCommand,
 				},
@@ -515,8 +612,8 @@ var fullSpokfileAST = ast.Tree{
 			},
 			Dependencies: []ast.Node{},
 			Outputs:      []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "echo {{.GLOBAL}}",
 					NodeType: ast.NodeCommand,
 				},
@@ -543,8 +640,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeString,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "do some stuff here",
 					NodeType: ast.NodeCommand,
 				},
@@ -559,8 +656,8 @@ var fullSpokfileAST = ast.Tree{
 			Docstring:    ast.Comment{},
 			Dependencies: []ast.Node{},
 			Outputs:      []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  `echo "this task has no docstring"`,
 					NodeType: ast.NodeCommand,
 				},
@@ -583,8 +680,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeIdent,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  `echo "making docs"`,
 					NodeType: ast.NodeCommand,
 				},
@@ -611,8 +708,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeIdent,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  `echo "doing things"`,
 					NodeType: ast.NodeCommand,
 				},
@@ -15,11 +15,14 @@ func _() {
 	_ = x[NodeFunction-4]
 	_ = x[NodeTask-5]
 	_ = x[NodeCommand-6]
+	_ = x[NodeCondition-7]
+	_ = x[NodeConditional-8]
+	_ = x[NodeAttribute-9]
 }
 
-const _NodeType_name = "NodeCommentNodeIdentNodeAssignNodeStringNodeFunctionNodeTaskNodeCommand"
+const _NodeType_name = "NodeCommentNodeIdentNodeAssignNodeStringNodeFunctionNodeTaskNodeCommandNodeConditionNodeConditionalNodeAttribute"
 
-var _NodeType_index = [...]uint8{0, 11, 20, 30, 40, 52, 60, 71}
+var _NodeType_index = [...]uint8{0, 11, 20, 30, 40, 52, 60, 71, 84, 99, 112}
 
 func (i NodeType) String() string {
 	idx := int(i) - 0
@@ -4,30 +4,205 @@
 package builtins
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"text/template"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"go.followtheprocess.codes/spok/iostream"
 	"go.followtheprocess.codes/spok/shell"
 )
 
 // Builtin is a spok built in function.
-type Builtin func(...string) (string, error)
+type Builtin func(ctx Context, args ...string) (string, error)
 
-// read-only package scoped map mapping the names of the builtins to their underlying function
-// client packages access this through the Get function below.
-var builtins = map[string]Builtin{
-	"join": join,
-	"exec": execute,
+// Context is the spokfile a builtin is called from.
+type Context struct {
+	Dir string   // The spokfile's directory, relative paths are resolved against it, empty means the current directory
+	Env []string // Extra environment variables in KEY=VALUE form e.g. the spokfile's .env, these win over the process environment
+}
+
+// path resolves a path passed to a builtin, relative paths are
+// relative to the spokfile's directory.
+func (c Context) path(path string) string {
+	if c.Dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.Dir, path)
+}
+
+// Function describes a spok builtin, it's parameters and documentation.
+type Function struct {
+	Fn       Builtin  // The underlying implementation
+	Name     string   // The name the function is called by in a spokfile
+	Doc      string   // Short description of what the function does
+	Params   []string // Names of the parameters the function accepts
+	Optional int      // How many of the trailing Params may be omitted
+	Variadic bool     // Whether the final parameter accepts any number of arguments
+}
+
+// Signature returns the function's signature as it would be called in a
+// spokfile e.g. "env(name, [default])".
+func (f Function) Signature() string {
+	params := make([]string, 0, len(f.Params))
+	for i, param := range f.Params {
+		switch {
+		case f.Variadic && i == len(f.Params)-1:
+			param += "..."
+		case i >= len(f.Params)-f.Optional:
+			param = "[" + param + "]"
+		}
+		params = append(params, param)
+	}
+	return f.Name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// CheckArgs returns an error if n arguments is not a valid number of
+// arguments to pass to the function.
+func (f Function) CheckArgs(n int) error {
+	minimum := len(f.Params) - f.Optional
+	if f.Variadic {
+		// Variadic functions must be given at least one value for the variadic param
+		if n < len(f.Params) {
+			return fmt.Errorf("%s takes at least %d argument(s), got %d: %s", f.Name, len(f.Params), n, f.Signature())
+		}
+		return nil
+	}
+	if n < minimum || n > len(f.Params) {
+		if f.Optional == 0 {
+			return fmt.Errorf("%s takes %d argument(s), got %d: %s", f.Name, len(f.Params), n, f.Signature())
+		}
+		return fmt.Errorf("%s takes %d to %d arguments, got %d: %s", f.Name, minimum, len(f.Params), n, f.Signature())
+	}
+	return nil
+}
+
+// Call checks the arguments and calls the function with them from ctx.
+func (f Function) Call(ctx Context, args ...string) (string, error) {
+	if err := f.CheckArgs(len(args)); err != nil {
+		return "", err
+	}
+	return f.Fn(ctx, args...)
+}
+
+// read-only package scoped map mapping the names of the builtins to their definition
+// client packages access this through the Get and Lookup functions below.
+var builtins = map[string]Function{
+	"join": {
+		Name:     "join",
+		Params:   []string{"parts"},
+		Variadic: true,
+		Doc:      "Join path parts with the OS specific separator, returning the absolute path",
+		Fn:       join,
+	},
+	"exec": {
+		Name:   "exec",
+		Params: []string{"command"},
+		Doc:    "Run a shell command, returning its stdout with surrounding whitespace trimmed",
+		Fn:     execute,
+	},
+	"env": {
+		Name:     "env",
+		Params:   []string{"name", "default"},
+		Optional: 1,
+		Doc:      "The value of the environment variable name, or default if it's not set",
+		Fn:       env,
+	},
+	"os": {
+		Name: "os",
+		Doc:  `The current operating system e.g. "linux", "darwin" or "windows"`,
+		Fn:   goos,
+	},
+	"arch": {
+		Name: "arch",
+		Doc:  `The current CPU architecture e.g. "amd64" or "arm64"`,
+		Fn:   goarch,
+	},
+	"glob": {
+		Name:   "glob",
+		Params: []string{"pattern"},
+		Doc:    "The files matching a glob pattern e.g. \"**/*.go\", sorted and separated by spaces",
+		Fn:     glob,
+	},
+	"read": {
+		Name:   "read",
+		Params: []string{"file"},
+		Doc:    "The contents of a file with surrounding whitespace trimmed",
+		Fn:     read,
+	},
+	"sha256": {
+		Name:   "sha256",
+		Params: []string{"file"},
+		Doc:    "The hex encoded SHA256 digest of a file's contents",
+		Fn:     digest,
+	},
+	"trim": {
+		Name:   "trim",
+		Params: []string{"s"},
+		Doc:    "The string s with leading and trailing whitespace removed",
+		Fn:     trim,
+	},
+	"replace": {
+		Name:   "replace",
+		Params: []string{"s", "old", "new"},
+		Doc:    "The string s with every occurrence of old replaced by new",
+		Fn:     replace,
+	},
+	"upper": {
+		Name:   "upper",
+		Params: []string{"s"},
+		Doc:    "The string s in upper case",
+		Fn:     upper,
+	},
+	"lower": {
+		Name:   "lower",
+		Params: []string{"s"},
+		Doc:    "The string s in lower case",
+		Fn:     lower,
+	},
+	"dirname": {
+		Name:   "dirname",
+		Params: []string{"path"},
+		Doc:    "All but the last element of path i.e. the directory it's in",
+		Fn:     dirname,
+	},
+	"basename": {
+		Name:   "basename",
+		Params: []string{"path"},
+		Doc:    "The last element of path",
+		Fn:     basename,
+	},
+	"abs": {
+		Name:   "abs",
+		Params: []string{"path"},
+		Doc:    "The absolute representation of path",
+		Fn:     absolute,
+	},
+	"git_branch": {
+		Name: "git_branch",
+		Doc:  `The name of the currently checked out git branch, or "HEAD" if detached`,
+		Fn:   gitBranch,
+	},
+	"git_sha": {
+		Name: "git_sha",
+		Doc:  "The full SHA of the currently checked out git commit",
+		Fn:   gitSHA,
+	},
 }
 
 // join joins up filepath parts with an OS specific separator, returning
 // the absolute joined path.
-func join(parts ...string) (string, error) {
+func join(ctx Context, parts ...string) (string, error) {
 	joined := filepath.Join(parts...)
-	abs, err := filepath.Abs(joined)
+	abs, err := filepath.Abs(ctx.path(joined))
 	if err != nil {
 		return "", fmt.Errorf("could not resolve path '%s' to absolute: %w", joined, err)
 	}
@@ -38,13 +213,15 @@ func join(parts ...string) (string, error) {
 // leading and trailing whitespace will be trimmed prior to returning, if the command
 // returns a non-zero exit code, this will be reported as an error and the stderr of the
 // underlying command will be included in the error message.
-func execute(command ...string) (string, error) {
+//
+// The command is run in the spokfile's directory with the context's Env set.
+func execute(ctx Context, command ...string) (string, error) {
 	if len(command) != 1 {
 		return "", errors.New("exec takes the shell command as a single string argument")
 	}
 	cmd := command[0]
 	runner := shell.NewIntegratedRunner()
-	result, err := runner.Run(cmd, iostream.Null(), "", nil)
+	result, err := runner.Run(context.Background(), shell.Command{Cmd: cmd, Dir: ctx.Dir, Env: ctx.Env, Stream: iostream.Null()})
 	if err != nil {
 		return "", err
 	}
@@ -55,13 +232,150 @@ func execute(command ...string) (string, error) {
 	return strings.TrimSpace(result.Stdout), nil
 }
 
+// env looks up an environment variable, returning the default (if given)
+// when it's not set. The context's Env is checked before the process environment.
+func env(ctx Context, args ...string) (string, error) {
+	for i := len(ctx.Env) - 1; i >= 0; i-- {
+		if key, val, ok := strings.Cut(ctx.Env[i], "="); ok && key == args[0] {
+			return val, nil
+		}
+	}
+	if val, ok := os.LookupEnv(args[0]); ok {
+		return val, nil
+	}
+	if len(args) == 2 {
+		return args[1], nil
+	}
+	return "", nil
+}
+
+// goos returns the current operating system.
+func goos(_ Context, _ ...string) (string, error) {
+	return runtime.GOOS, nil
+}
+
+// goarch returns the current CPU architecture.
+func goarch(_ Context, _ ...string) (string, error) {
+	return runtime.GOARCH, nil
+}
+
+// glob expands a glob pattern relative to the spokfile's directory, returning
+// the sorted matches separated by a single space. The matches of a relative
+// pattern are relative to the spokfile's directory too.
+func glob(ctx Context, args ...string) (string, error) {
+	matches, err := doublestar.FilepathGlob(ctx.path(args[0]))
+	if err != nil {
+		return "", fmt.Errorf("bad glob pattern %q: %w", args[0], err)
+	}
+	if ctx.Dir != "" && !filepath.IsAbs(args[0]) {
+		for i, match := range matches {
+			rel, err := filepath.Rel(ctx.Dir, match)
+			if err != nil {
+				return "", err
+			}
+			matches[i] = rel
+		}
+	}
+	sort.Strings(matches)
+	return strings.Join(matches, " "), nil
+}
+
+// read returns the contents of a file, trimmed of surrounding whitespace
+// in the same way as exec.
+func read(ctx Context, args ...string) (string, error) {
+	contents, err := os.ReadFile(ctx.path(args[0]))
+	if err != nil {
+		return "", fmt.Errorf("could not read file: %w", err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// digest returns the hex encoded sha256 digest of a file.
+func digest(ctx Context, args ...string) (string, error) {
+	contents, err := os.ReadFile(ctx.path(args[0]))
+	if err != nil {
+		return "", fmt.Errorf("could not read file: %w", err)
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// trim removes leading and trailing whitespace.
+func trim(_ Context, args ...string) (string, error) {
+	return strings.TrimSpace(args[0]), nil
+}
+
+// replace replaces all occurrences of old with new.
+func replace(_ Context, args ...string) (string, error) {
+	return strings.ReplaceAll(args[0], args[1], args[2]), nil
+}
+
+// upper converts a string to upper case.
+func upper(_ Context, args ...string) (string, error) {
+	return strings.ToUpper(args[0]), nil
+}
+
+// lower converts a string to lower case.
+func lower(_ Context, args ...string) (string, error) {
+	return strings.ToLower(args[0]), nil
+}
+
+// dirname returns the directory part of a path.
+func dirname(_ Context, args ...string) (string, error) {
+	return filepath.Dir(args[0]), nil
+}
+
+// basename returns the last element of a path.
+func basename(_ Context, args ...string) (string, error) {
+	return filepath.Base(args[0]), nil
+}
+
+// absolute resolves a path to absolute.
+func absolute(ctx Context, args ...string) (string, error) {
+	abs, err := filepath.Abs(ctx.path(args[0]))
+	if err != nil {
+		return "", fmt.Errorf("could not resolve path '%s' to absolute: %w", args[0], err)
+	}
+	return abs, nil
+}
+
 // Get looks up a builtin function by name, it returns the Builtin and a bool
 // indicating whether or not it was found in the same way that item, ok is used
 // for maps.
+//
+// The returned Builtin checks it's arguments before calling the function.
 func Get(name string) (Builtin, bool) {
 	fn, ok := builtins[name]
 	if !ok {
 		return nil, false
 	}
-	return fn, true
+	return fn.Call, true
+}
+
+// Lookup returns the full definition of a builtin function by name.
+func Lookup(name string) (Function, bool) {
+	fn, ok := builtins[name]
+	return fn, ok
+}
+
+// All returns every builtin function, sorted by name.
+func All() []Function {
+	all := make([]Function, 0, len(builtins))
+	for _, fn := range builtins {
+		all = append(all, fn)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// FuncMap returns every builtin as a template.FuncMap called from ctx, so they may
+// be called from within templated strings e.g. {{ join .ROOT "bin" }}.
+func FuncMap(ctx Context) template.FuncMap {
+	funcs := make(template.FuncMap, len(builtins))
+	for name, fn := range builtins {
+		funcs[name] = func(args ...string) (string, error) {
+			return fn.Call(ctx, args...)
+		}
+	}
+	return funcs
 }
@@ -2,8 +2,12 @@ package builtins_test
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"text/template"
 
 	"go.followtheprocess.codes/spok/builtins"
 )
@@ -59,11 +63,109 @@ func TestBuiltins(t *testing.T) {
 			args:    []string{"(*^$$"},
 			wantErr: true,
 		},
+		{
+			fn:      mustGet("join"),
+			name:    "join no args",
+			want:    "",
+			args:    nil,
+			wantErr: true,
+		},
+		{
+			fn:      mustGet("os"),
+			name:    "os",
+			want:    runtime.GOOS,
+			args:    nil,
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("os"),
+			name:    "os with args",
+			want:    "",
+			args:    []string{"nope"},
+			wantErr: true,
+		},
+		{
+			fn:      mustGet("arch"),
+			name:    "arch",
+			want:    runtime.GOARCH,
+			args:    nil,
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("trim"),
+			name:    "trim",
+			want:    "hello",
+			args:    []string{"  hello\n\t"},
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("replace"),
+			name:    "replace",
+			want:    "v1_2_3",
+			args:    []string{"v1.2.3", ".", "_"},
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("replace"),
+			name:    "replace missing args",
+			want:    "",
+			args:    []string{"v1.2.3", "."},
+			wantErr: true,
+		},
+		{
+			fn:      mustGet("upper"),
+			name:    "upper",
+			want:    "HELLO",
+			args:    []string{"hello"},
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("lower"),
+			name:    "lower",
+			want:    "hello",
+			args:    []string{"HeLLo"},
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("dirname"),
+			name:    "dirname",
+			want:    filepath.Join("some", "dir"),
+			args:    []string{filepath.Join("some", "dir", "file.go")},
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("basename"),
+			name:    "basename",
+			want:    "file.go",
+			args:    []string{filepath.Join("some", "dir", "file.go")},
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("abs"),
+			name:    "abs",
+			want:    abs("file.go"),
+			args:    []string{"file.go"},
+			wantErr: false,
+		},
+		{
+			fn:      mustGet("read"),
+			name:    "read missing file",
+			want:    "",
+			args:    []string{"missing.txt"},
+			wantErr: true,
+		},
+		{
+			fn:      mustGet("sha256"),
+			name:    "sha256 missing file",
+			want:    "",
+			args:    []string{"missing.txt"},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.fn(tt.args...)
+			got, err := tt.fn(builtins.Context{}, tt.args...)
 
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("%s returned an error: %v", tt.name, err)
@@ -76,6 +178,232 @@ func TestBuiltins(t *testing.T) {
 	}
 }
 
+func TestEnv(t *testing.T) {
+	t.Setenv("SPOK_TEST_ENV", "set")
+	env := mustGet("env")
+
+	tests := []struct {
+		name    string
+		want    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "set", args: []string{"SPOK_TEST_ENV"}, want: "set"},
+		{name: "set with default", args: []string{"SPOK_TEST_ENV", "default"}, want: "set"},
+		{name: "unset", args: []string{"SPOK_TEST_ENV_MISSING"}, want: ""},
+		{name: "unset with default", args: []string{"SPOK_TEST_ENV_MISSING", "default"}, want: "default"},
+		{name: "no args", args: nil, wantErr: true},
+		{name: "too many args", args: []string{"a", "b", "c"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := env(builtins.Context{}, tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("env returned an error: %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %s, wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "b.txt"), "  hello\n")
+	writeFile(t, filepath.Join(dir, "a.txt"), "world")
+	writeFile(t, filepath.Join(dir, "sub", "c.txt"), "")
+	writeFile(t, filepath.Join(dir, "sub", "d.go"), "")
+
+	// Relative paths are relative to the spokfile, wherever spok is run from
+	t.Chdir(t.TempDir())
+	ctx := builtins.Context{Dir: dir}
+
+	got, err := mustGet("glob")(ctx, "**/*.txt")
+	if err != nil {
+		t.Fatalf("glob returned an error: %v", err)
+	}
+	if want := "a.txt b.txt " + filepath.Join("sub", "c.txt"); got != want {
+		t.Errorf("glob: got %q, wanted %q", got, want)
+	}
+
+	got, err = mustGet("read")(ctx, "b.txt")
+	if err != nil {
+		t.Fatalf("read returned an error: %v", err)
+	}
+	if got != "hello" {
+		t.Errorf("read: got %q, wanted %q", got, "hello")
+	}
+
+	got, err = mustGet("sha256")(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("sha256 returned an error: %v", err)
+	}
+	// echo -n world | shasum -a 256
+	if want := "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7"; got != want {
+		t.Errorf("sha256: got %q, wanted %q", got, want)
+	}
+
+	got, err = mustGet("join")(ctx, "sub", "c.txt")
+	if err != nil {
+		t.Fatalf("join returned an error: %v", err)
+	}
+	if want := filepath.Join(dir, "sub", "c.txt"); got != want {
+		t.Errorf("join: got %q, wanted %q", got, want)
+	}
+
+	got, err = mustGet("abs")(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("abs returned an error: %v", err)
+	}
+	if want := filepath.Join(dir, "a.txt"); got != want {
+		t.Errorf("abs: got %q, wanted %q", got, want)
+	}
+
+	got, err = mustGet("exec")(ctx, "cat b.txt")
+	if err != nil {
+		t.Fatalf("exec returned an error: %v", err)
+	}
+	if got != "hello" {
+		t.Errorf("exec: got %q, wanted %q", got, "hello")
+	}
+}
+
+func TestGit(t *testing.T) {
+	const sha = "3f2a1c2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f"
+
+	tests := []struct {
+		files      map[string]string // Files to write relative to the .git directory
+		name       string
+		wantBranch string
+		wantSHA    string
+	}{
+		{
+			name: "branch",
+			files: map[string]string{
+				"HEAD":             "ref: refs/heads/main\n",
+				"refs/heads/main":  sha + "\n",
+				"refs/heads/other": "not this one\n",
+			},
+			wantBranch: "main",
+			wantSHA:    sha,
+		},
+		{
+			name: "nested branch name",
+			files: map[string]string{
+				"HEAD":                     "ref: refs/heads/feature/thing\n",
+				"refs/heads/feature/thing": sha + "\n",
+			},
+			wantBranch: "feature/thing",
+			wantSHA:    sha,
+		},
+		{
+			name: "packed refs",
+			files: map[string]string{
+				"HEAD":        "ref: refs/heads/main\n",
+				"packed-refs": "# pack-refs with: peeled fully-peeled sorted\n" + sha + " refs/heads/main\n^deadbeef\n",
+			},
+			wantBranch: "main",
+			wantSHA:    sha,
+		},
+		{
+			name: "detached",
+			files: map[string]string{
+				"HEAD": sha + "\n",
+			},
+			wantBranch: "HEAD",
+			wantSHA:    sha,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, contents := range tt.files {
+				writeFile(t, filepath.Join(root, ".git", filepath.FromSlash(name)), contents)
+			}
+
+			// Should be found from anywhere inside the repo
+			nested := filepath.Join(root, "some", "sub", "dir")
+			if err := os.MkdirAll(nested, 0o755); err != nil {
+				t.Fatalf("could not create nested directory: %v", err)
+			}
+			// From the spokfile's directory, not the current one
+			t.Chdir(t.TempDir())
+			ctx := builtins.Context{Dir: nested}
+
+			branch, err := mustGet("git_branch")(ctx)
+			if err != nil {
+				t.Fatalf("git_branch returned an error: %v", err)
+			}
+			if branch != tt.wantBranch {
+				t.Errorf("git_branch: got %q, wanted %q", branch, tt.wantBranch)
+			}
+
+			sha, err := mustGet("git_sha")(ctx)
+			if err != nil {
+				t.Fatalf("git_sha returned an error: %v", err)
+			}
+			if sha != tt.wantSHA {
+				t.Errorf("git_sha: got %q, wanted %q", sha, tt.wantSHA)
+			}
+		})
+	}
+}
+
+func TestSignature(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"join":       "join(parts...)",
+		"exec":       "exec(command)",
+		"env":        "env(name, [default])",
+		"os":         "os()",
+		"replace":    "replace(s, old, new)",
+		"git_branch": "git_branch()",
+	}
+
+	for name, want := range tests {
+		fn, ok := builtins.Lookup(name)
+		if !ok {
+			t.Fatalf("Lookup failed to retrieve %q", name)
+		}
+		if got := fn.Signature(); got != want {
+			t.Errorf("%s signature: got %q, wanted %q", name, got, want)
+		}
+	}
+
+	for _, fn := range builtins.All() {
+		if fn.Doc == "" {
+			t.Errorf("builtin %s has no documentation", fn.Name)
+		}
+	}
+}
+
+func TestFuncMap(t *testing.T) {
+	t.Parallel()
+	tmp, err := template.New("test").Funcs(builtins.FuncMap(builtins.Context{})).Parse(`{{ upper .NAME }} {{ replace .NAME "o" "0" }} {{ lower (upper "x") }}`)
+	if err != nil {
+		t.Fatalf("could not parse template: %v", err)
+	}
+
+	out := &strings.Builder{}
+	if err := tmp.Execute(out, map[string]string{"NAME": "spok"}); err != nil {
+		t.Fatalf("could not execute template: %v", err)
+	}
+
+	if want := "SPOK sp0k x"; out.String() != want {
+		t.Errorf("got %q, wanted %q", out.String(), want)
+	}
+
+	// Argument checking still applies
+	tmp = template.Must(template.New("test").Funcs(builtins.FuncMap(builtins.Context{})).Parse(`{{ upper "a" "b" }}`))
+	if err := tmp.Execute(out, nil); err == nil {
+		t.Error("expected an error calling upper with 2 arguments, got nil")
+	}
+}
+
 func TestGet(t *testing.T) {
 	t.Parallel()
 	_, ok := builtins.Get("exec")
@@ -99,6 +427,17 @@ func abs(path string) string {
 	return abs
 }
 
+// writeFile writes contents to path, creating any parent directories.
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+}
+
 // Gets a builtin and panics if it's not there.
 func mustGet(fn string) builtins.Builtin {
 	f, ok := builtins.Get(fn)
@@ -0,0 +1,152 @@
+package builtins
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// refPrefix is the prefix to the contents of .git/HEAD when a branch is checked out.
+const refPrefix = "ref: "
+
+// gitBranch returns the name of the currently checked out branch by reading
+// .git/HEAD directly, when HEAD is detached it returns "HEAD" in the same
+// way as `git rev-parse --abbrev-ref HEAD`.
+func gitBranch(ctx Context, _ ...string) (string, error) {
+	gitDir, err := findGitDir(ctx.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := readHead(gitDir)
+	if err != nil {
+		return "", err
+	}
+
+	ref, ok := strings.CutPrefix(head, refPrefix)
+	if !ok {
+		return "HEAD", nil
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), nil
+}
+
+// gitSHA returns the full SHA of the currently checked out commit by reading
+// .git/HEAD and following the ref it points to, including packed refs.
+func gitSHA(ctx Context, _ ...string) (string, error) {
+	gitDir, err := findGitDir(ctx.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := readHead(gitDir)
+	if err != nil {
+		return "", err
+	}
+
+	ref, ok := strings.CutPrefix(head, refPrefix)
+	if !ok {
+		// Detached HEAD, it's the SHA itself
+		return head, nil
+	}
+
+	// In a linked worktree, refs live in the main repository's git dir
+	common := gitDir
+	if contents, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common = strings.TrimSpace(string(contents))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+	}
+
+	for _, dir := range []string{gitDir, common} {
+		contents, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref)))
+		if err == nil {
+			return strings.TrimSpace(string(contents)), nil
+		}
+	}
+
+	return packedRef(common, ref)
+}
+
+// findGitDir climbs the file tree from start (or the current directory if it's empty)
+// looking for the .git directory, following a .git file to the real directory as is
+// used for worktrees and submodules.
+func findGitDir(start string) (string, error) {
+	dir, err := filepath.Abs(start)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %w", start, err)
+	}
+
+	for {
+		path := filepath.Join(dir, ".git")
+		info, err := os.Stat(path)
+		if err == nil {
+			if info.IsDir() {
+				return path, nil
+			}
+			return readGitFile(path)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("not a git repository (or any of the parent directories)")
+		}
+		dir = parent
+	}
+}
+
+// readGitFile reads a .git file of the form "gitdir: <path>" and returns
+// the git directory it points to.
+func readGitFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", path, err)
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(contents)), "gitdir: ")
+	if !ok {
+		return "", fmt.Errorf("malformed .git file at %s", path)
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+	return gitDir, nil
+}
+
+// readHead returns the trimmed contents of HEAD in gitDir.
+func readHead(gitDir string) (string, error) {
+	contents, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", fmt.Errorf("could not read git HEAD: %w", err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// packedRef looks up ref in gitDir's packed-refs file.
+func packedRef(gitDir, ref string) (string, error) {
+	file, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return "", fmt.Errorf("could not resolve git ref %s", ref)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			// Comments and peeled tags
+			continue
+		}
+		sha, name, ok := strings.Cut(line, " ")
+		if ok && name == ref {
+			return sha, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("could not read packed-refs: %w", err)
+	}
+
+	return "", fmt.Errorf("could not resolve git ref %s", ref)
+}
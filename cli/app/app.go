@@ -6,22 +6,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
-	"github.com/joho/godotenv"
 	"go.followtheprocess.codes/hue"
 	"go.followtheprocess.codes/hue/tabwriter"
 	"go.followtheprocess.codes/msg"
+	"go.followtheprocess.codes/spok/ast"
 	"go.followtheprocess.codes/spok/cache"
+	"go.followtheprocess.codes/spok/event"
 	"go.followtheprocess.codes/spok/file"
 	"go.followtheprocess.codes/spok/iostream"
 	"go.followtheprocess.codes/spok/logger"
 	"go.followtheprocess.codes/spok/parser"
 	"go.followtheprocess.codes/spok/shell"
+	"go.followtheprocess.codes/spok/task"
+	"go.followtheprocess.codes/spok/token"
 )
 
 const demoSpokfile string = `# This is a spokfile example
@@ -44,6 +50,9 @@ const gitIgnoreText string = `
 .spok/
 `
 
+// eventsFormat is the only format accepted by --events, newline delimited JSON.
+const eventsFormat = "ndjson"
+
 const (
 	filePerms = 0o666 // The permissions to use when creating the spokfile
 	minWidth  = 1     // The minimum width of columns in the output
@@ -61,24 +70,34 @@ const (
 
 // App represents the spok program.
 type App struct {
-	stream  iostream.IOStream // Where spok writes output to
-	Options *Options          // All the CLI options
-	logger  logger.Logger     // Spok's logger, prints debug messages to stderr if --debug is used
+	stream    iostream.IOStream // Where spok writes output to
+	Options   *Options          // All the CLI options
+	logger    logger.Logger     // Spok's logger, prints debug messages to stderr if --debug is used
+	overrides map[string]string // Variables overridden on the command line
+	events    *event.Writer     // Where events are written with --events, nil otherwise
+	output    iostream.Output   // How each task's output is written, from --output
 }
 
 // Options holds all the flag options for spok, these will be at their zero values
 // if the flags were not set and the value of the flag otherwise.
 type Options struct {
-	Spokfile  string // The path to the spokfile (defaults to find, overridden by --spokfile)
-	Variables bool   // The --vars flag
-	Fmt       bool   // The --fmt flag
-	Init      bool   // The --init flag
-	Clean     bool   // The --clean flag
-	Force     bool   // The --force flag
-	Debug     bool   // The --debug flag
-	Quiet     bool   // The --quiet flag
-	JSON      bool   // The --json flag
-	Show      bool   // The --show flag
+	Spokfile  string   // The path to the spokfile (defaults to find, overridden by --spokfile)
+	Shell     string   // The shell to run commands with, overriding the spokfile's, the --shell flag
+	Output    string   // How each task's output is written: raw, prefixed or grouped, the --output flag
+	Events    string   // The format to stream events in as tasks run, only "ndjson", the --events flag
+	Variables bool     // The --vars flag
+	Fmt       bool     // The --fmt flag
+	Init      bool     // The --init flag
+	Clean     bool     // The --clean flag
+	Force     bool     // The --force flag
+	KeepGoing bool     // The --keep-going flag
+	Debug     bool     // The --debug flag
+	Quiet     bool     // The --quiet flag
+	JSON      bool     // The --json flag
+	Show      bool     // The --show flag
+	All       bool     // The --all flag
+	Set       []string // Variable overrides passed with --set in NAME=value form
+	Tags      []string // Run every task with these tags, passed with --tag
 }
 
 // New creates and returns a new App.
@@ -91,24 +110,44 @@ func New(stream iostream.IOStream) *App {
 	return spok
 }
 
-// Run is the entry point to the spok program, the only arguments spok accepts are names
-// of tasks, all other logic is handled via flags.
-func (a *App) Run(ctx context.Context, tasks []string) error {
+// Run is the entry point to the spok program, the arguments spok accepts are names
+// of tasks and variable overrides in NAME=value form, all other logic is handled via flags.
+//
+// The returned error is an ExitError if spok should exit with a particular status e.g. that
+// of a failed command, see ExitStatus.
+func (a *App) Run(ctx context.Context, args []string) error {
+	return exitError(ctx, a.run(ctx, args))
+}
+
+// run does the work of Run.
+func (a *App) run(ctx context.Context, args []string) error {
 	if a.Options.Init {
 		return a.initialise()
 	}
 
+	// Events take over stdout, so like --json nothing else is printed there
+	if a.Options.Events != "" {
+		if a.Options.Events != eventsFormat {
+			return fmt.Errorf("invalid --events format %q, expected %q", a.Options.Events, eventsFormat)
+		}
+		if a.Options.JSON {
+			return errors.New("--events cannot be used with --json")
+		}
+		a.events = event.NewWriter(a.stream.Stdout)
+		a.discardOutput()
+	}
+
 	if a.Options.Quiet {
 		if a.Options.Debug {
 			return errors.New("--debug cannot be used with --quiet")
 		}
-		a.setStream(iostream.Null())
+		a.discardOutput()
 	}
 
 	// If we want task output as json, we don't want it printing
 	// to stdout too
 	if a.Options.JSON {
-		a.setStream(iostream.Null())
+		a.discardOutput()
 	}
 
 	if err := a.setup(); err != nil {
@@ -117,44 +156,72 @@ func (a *App) Run(ctx context.Context, tasks []string) error {
 	// Flush the logger
 	defer a.logger.Sync() //nolint: errcheck
 
-	parseStart := time.Now()
-	contents, err := os.ReadFile(a.Options.Spokfile)
+	tasks, overrides, err := parseOverrides(args, a.Options.Set)
 	if err != nil {
 		return err
 	}
+	a.overrides = overrides
 
-	tree, err := parser.New(string(contents)).Parse()
-	if err != nil {
-		return err
+	if a.Options.Output != "" {
+		a.output, err = iostream.ParseOutput(a.Options.Output)
+		if err != nil {
+			return err
+		}
 	}
-	a.logger.Debug("Parsed spokfile at %s in %v", a.Options.Spokfile, time.Since(parseStart))
 
-	spokfile, err := file.New(tree, filepath.Dir(a.Options.Spokfile), a.logger)
+	// Monorepo mode, either running tasks across every spokfile or
+	// running a task addressed as "dir:task"
+	if a.Options.All || anyAddressed(tasks) {
+		if err := a.checkWorkspaceFlags(); err != nil {
+			return err
+		}
+		return a.runWorkspace(ctx, tasks)
+	}
+
+	tree, err := a.parse(a.Options.Spokfile)
 	if err != nil {
 		return err
 	}
 
-	runner := shell.NewIntegratedRunner()
-
-	switch {
-	case a.Options.Fmt:
+	// Formatting only needs the syntax tree
+	if a.Options.Fmt {
 		msg.Finfo(a.stream.Stdout, "Formatting spokfile at %q", a.Options.Spokfile)
 		return os.WriteFile(a.Options.Spokfile, []byte(tree.String()), filePerms)
+	}
+
+	// Global variables, conditions that need them and the spokfile's shell are evaluated
+	// lazily, so creating the file doesn't execute anything, only running tasks or --vars will
+	spokfile, err := file.New(tree, filepath.Dir(a.Options.Spokfile), a.logger, a.overrides)
+	if err != nil {
+		return ExitError{Err: err, Status: ExitInvalidSpokfile}
+	}
+
+	switch {
 	case a.Options.Variables:
 		return a.showVariables(spokfile)
 	case a.Options.Clean:
-		return a.handleClean(spokfile, runner)
+		return a.handleClean(ctx, spokfile)
 	case a.Options.Show:
 		return a.showTasks(spokfile)
 	default:
+		// Only now that tasks are to be run is anything executed
+		if err := spokfile.Evaluate(); err != nil {
+			return ExitError{Err: err, Status: ExitInvalidSpokfile}
+		}
+
+		tasks, err = a.addTagged(spokfile, tasks)
+		if err != nil {
+			return err
+		}
+
 		if len(tasks) == 0 {
 			// No tasks provided, handle default actions
-			return a.handleDefault(spokfile, runner)
+			return a.handleDefault(ctx, spokfile)
 		}
 
 		a.logger.Debug("Running requested tasks: %v", tasks)
 
-		return a.runTasks(spokfile, runner, tasks...)
+		return a.runTasks(ctx, spokfile, tasks...)
 	}
 }
 
@@ -182,7 +249,7 @@ func (a *App) setup() error {
 		// findErr to avoid shadowing Getwd err
 		spokfilePath, findErr := file.Find(a.logger, cwd, home)
 		if findErr != nil {
-			return findErr
+			return ExitError{Err: findErr, Status: ExitNoSpokfile}
 		}
 		a.Options.Spokfile = spokfilePath
 	}
@@ -200,21 +267,48 @@ func (a *App) setup() error {
 
 	a.logger.Debug("Found spokfile at %s", a.Options.Spokfile)
 
-	// Auto load .env file (if present) to be present in os.Environ
-	a.logger.Debug("Looking for .env file")
-	dotenvPath := filepath.Join(filepath.Dir(a.Options.Spokfile), ".env")
+	return nil
+}
 
-	if !exists(dotenvPath) {
-		a.logger.Debug("No .env file found")
-		return nil
+// parse reads and parses the spokfile at path, returning the AST.
+func (a *App) parse(path string) (ast.Tree, error) {
+	parseStart := time.Now()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return ast.Tree{}, err
 	}
 
-	if err := godotenv.Load(dotenvPath); err != nil {
-		return fmt.Errorf("could not load .env file: %w", err)
+	tree, err := parser.New(string(contents)).Parse()
+	if err != nil {
+		return ast.Tree{}, ExitError{Err: err, Status: ExitInvalidSpokfile}
 	}
-	a.logger.Debug("Loaded .env file at %s", dotenvPath)
+	a.logger.Debug("Parsed spokfile at %s in %v", path, time.Since(parseStart))
 
-	return nil
+	return tree, nil
+}
+
+// load parses the spokfile at path and converts it into a concrete SpokFile, also
+// returning the names of the variables it declares.
+//
+// In a monorepo not every spokfile declares every variable overridden on the command
+// line, so each only gets the overrides for the variables it does declare.
+func (a *App) load(path string) (*file.SpokFile, []string, error) {
+	tree, err := a.parse(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	declared := file.Declared(tree)
+	overrides := make(map[string]string, len(a.overrides))
+	for name, value := range a.overrides {
+		if slices.Contains(declared, name) {
+			overrides[name] = value
+		}
+	}
+	spokfile, err := file.New(tree, filepath.Dir(path), a.logger, overrides)
+	if err != nil {
+		return nil, nil, ExitError{Err: err, Status: ExitInvalidSpokfile}
+	}
+	return spokfile, declared, nil
 }
 
 // Initialise writes the demo spokfile to the cwd.
@@ -247,28 +341,291 @@ func (a *App) initialise() error {
 }
 
 // runTasks is a helper that runs the request spokfile tasks.
-func (a *App) runTasks(spokfile *file.SpokFile, runner shell.Runner, tasks ...string) error {
-	results, err := spokfile.Run(a.stream, runner, a.Options.Force, tasks...)
+func (a *App) runTasks(ctx context.Context, spokfile *file.SpokFile, tasks ...string) error {
+	runner, err := a.runner(spokfile)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	results, err := spokfile.Run(ctx, a.stream, runner, a.runOptions(), tasks...)
 	if err != nil {
+		a.reportFailed(results, time.Since(start))
 		return err
 	}
+	return a.report(results, time.Since(start))
+}
+
+// runner returns the shell runner to run the spokfile's commands with by default, the
+// --shell flag takes precedence over the spokfile's own choice of shell and if neither
+// is set it's spok's integrated shell.
+func (a *App) runner(spokfile *file.SpokFile) (shell.Runner, error) {
+	name := a.Options.Shell
+	if name == "" {
+		name = spokfile.Shell
+	}
+	if name == "" {
+		return shell.NewIntegratedRunner(), nil
+	}
+	a.logger.Debug("Running commands with shell %s", name)
+	return shell.NewRunner(name)
+}
+
+// runOptions returns the options for running tasks set by the flags.
+func (a *App) runOptions() file.RunOptions {
+	return file.RunOptions{
+		Events:    a.events,
+		Output:    a.output,
+		Force:     a.Options.Force,
+		KeepGoing: a.Options.KeepGoing,
+	}
+}
+
+// checkWorkspaceFlags returns an error if any flags that don't run tasks have been
+// combined with --all or tasks addressed as "dir:task", rather than silently ignoring them.
+func (a *App) checkWorkspaceFlags() error {
+	flags := []struct {
+		name string
+		set  bool
+	}{
+		{name: "--fmt", set: a.Options.Fmt},
+		{name: "--vars", set: a.Options.Variables},
+		{name: "--clean", set: a.Options.Clean},
+		{name: "--show", set: a.Options.Show},
+		{name: "--tag", set: len(a.Options.Tags) != 0},
+	}
+	for _, flag := range flags {
+		if flag.set {
+			return fmt.Errorf("%s cannot be used with --all or tasks addressed as 'dir:task'", flag.name)
+		}
+	}
+	return nil
+}
+
+// runWorkspace runs tasks across the spokfiles in a monorepo, the root of which is
+// the directory containing the spokfile in use, not necessarily the top level one.
+//
+// Targets may be plain task names, which with --all are run in every spokfile that defines
+// them (and otherwise just in the top level spokfile), or addressed as "dir:task" where dir is
+// relative to the root. Each spokfile is run with its own cache and .env and the results
+// are combined into a single report.
+func (a *App) runWorkspace(ctx context.Context, targets []string) error {
+	if len(targets) == 0 {
+		return errors.New("--all requires at least one task name e.g. 'spok --all test'")
+	}
+
+	root := filepath.Dir(a.Options.Spokfile)
+
+	// Cache of loaded spokfiles (by path) and the order in which
+	// to run them, so each spokfile is only loaded and run once
+	loaded := make(map[string]*file.SpokFile)
+	requested := make(map[string][]string)
+	var order []string
+
+	// Every variable declared by any of the loaded spokfiles
+	var declared []string
+
+	load := func(path string) (*file.SpokFile, error) {
+		if spokfile, ok := loaded[path]; ok {
+			return spokfile, nil
+		}
+		spokfile, names, err := a.load(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not load %s: %w", path, err)
+		}
+		if err := spokfile.Evaluate(); err != nil {
+			return nil, fmt.Errorf("could not load %s: %w", path, ExitError{Err: err, Status: ExitInvalidSpokfile})
+		}
+		loaded[path] = spokfile
+		declared = append(declared, names...)
+		return spokfile, nil
+	}
+
+	add := func(path, name string) {
+		if _, ok := requested[path]; !ok {
+			order = append(order, path)
+		}
+		requested[path] = append(requested[path], name)
+	}
+
+	var all []string
+	if a.Options.All {
+		var err error
+		all, err = file.FindAll(a.logger, root)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, target := range targets {
+		if dir, name, ok := splitTarget(target); ok {
+			// Check the address up front, before anything runs
+			path := filepath.Join(root, filepath.FromSlash(dir), file.NAME)
+			if _, err := os.Stat(path); err != nil {
+				return ExitError{Err: fmt.Errorf("no spokfile at %s for %q", path, target), Status: ExitNoSpokfile}
+			}
+			spokfile, err := load(path)
+			if err != nil {
+				return err
+			}
+			if err := spokfile.Check(name); err != nil {
+				return ExitError{Err: fmt.Errorf("%s: %w", dir, err), Status: ExitMissingTask}
+			}
+			add(path, name)
+			continue
+		}
+
+		if !a.Options.All {
+			add(a.Options.Spokfile, target)
+			continue
+		}
+
+		found := false
+		for _, path := range all {
+			spokfile, err := load(path)
+			if err != nil {
+				return err
+			}
+			if t, ok := spokfile.Lookup(target); ok && !t.Private {
+				add(path, target)
+				found = true
+			}
+		}
+		if !found {
+			return ExitError{Err: fmt.Errorf("no spokfile under %s has a task named %q", root, target), Status: ExitMissingTask}
+		}
+	}
+
+	// An override that none of the spokfiles declare would change nothing, so is likely a typo
+	overridden := make([]string, 0, len(a.overrides))
+	for name := range a.overrides {
+		overridden = append(overridden, name)
+	}
+	sort.Strings(overridden)
+	for _, name := range overridden {
+		if slices.Contains(declared, name) {
+			continue
+		}
+		if closest := task.ClosestMatch(name, declared); closest != "" {
+			return fmt.Errorf("cannot override variable %q, no spokfile declares it. Did you mean %q?", name, closest)
+		}
+		return fmt.Errorf("cannot override variable %q, no spokfile declares it", name)
+	}
+
+	var combined task.Results
+	start := time.Now()
+	for _, path := range order {
+		spokfile, err := load(path)
+		if err != nil {
+			return err
+		}
+
+		label, err := filepath.Rel(root, spokfile.Dir)
+		if err != nil {
+			return err
+		}
+		label = filepath.ToSlash(label)
+
+		runner, err := a.runner(spokfile)
+		if err != nil {
+			return fmt.Errorf("%s: %w", label, err)
+		}
+
+		options := a.runOptions()
+		if label != "." {
+			options.Label = label
+		}
+
+		a.logger.Debug("Running tasks %v in %s", requested[path], path)
+		results, err := spokfile.Run(ctx, a.stream, runner, options, requested[path]...)
+
+		// Tasks in nested spokfiles are reported by their address so
+		// it's clear which spokfile they came from
+		if label != "." {
+			for i := range results {
+				results[i].Task = label + ":" + results[i].Task
+			}
+		}
+		combined = append(combined, results...)
+
+		if err != nil {
+			a.reportFailed(combined, time.Since(start))
+			if label == "." {
+				return err
+			}
+			return fmt.Errorf("%s: %w", label, err)
+		}
+
+		// Same as a failed task within a spokfile, the rest don't run unless asked to
+		if !results.Ok() && !a.Options.KeepGoing {
+			break
+		}
+	}
+
+	return a.report(combined, time.Since(start))
+}
 
+// addTagged adds every task with one of the tags passed with --tag to the
+// requested tasks, skipping any that were already requested.
+func (a *App) addTagged(spokfile *file.SpokFile, tasks []string) ([]string, error) {
+	for _, tag := range a.Options.Tags {
+		tagged, err := spokfile.Tagged(tag)
+		if err != nil {
+			return nil, err
+		}
+		a.logger.Debug("Tasks tagged %s: %v", tag, tagged)
+		for _, name := range tagged {
+			if !slices.Contains(tasks, name) {
+				tasks = append(tasks, name)
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// report prints the outcome of every task in a spok run followed by a summary and
+// how long each took, total being the time taken by the whole run,
+// returning an ExitError with the status of the first failed command.
+func (a *App) report(results task.Results, total time.Duration) error {
+	var (
+		failure                             error // The first failed command, returned once everything is reported
+		succeeded, failed, blocked, skipped int
+	)
 	for _, result := range results {
-		if !result.Ok() {
+		switch {
+		case result.BlockedBy != "":
+			blocked++
+			msg.Fwarn(a.stream.Stdout, "Task %q blocked by failed task %q", result.Task, result.BlockedBy)
+		case !result.Ok():
+			failed++
+			msg.Ferror(a.stream.Stdout, "Task %q failed", result.Task)
 			for _, cmd := range result.CommandResults {
-				if !cmd.Ok() {
-					// We've found the one
-					return fmt.Errorf("command %q in task %q exited with status %d", cmd.Cmd, result.Task, cmd.Status)
+				if !cmd.Ok() && failure == nil {
+					failure = ExitError{
+						Err:    fmt.Errorf("command %q in task %q exited with status %d", cmd.Cmd, result.Task, cmd.Status),
+						Status: cmd.Status,
+					}
 				}
 			}
-		}
-		if result.Skipped {
+		case result.Finally:
+			succeeded++
+			msg.Fsuccess(a.stream.Stdout, "Finally task %q completed successfully", result.Task)
+		case result.Skipped:
+			skipped++
 			msg.Fwarn(a.stream.Stdout, "Task %q skipped as none of it's dependencies have changed", result.Task)
-		} else {
+		default:
+			succeeded++
 			msg.Fsuccess(a.stream.Stdout, "Task %q completed successfully", result.Task)
 		}
 	}
 
+	msg.Finfo(a.stream.Stdout, "%d succeeded, %d failed, %d blocked, %d skipped", succeeded, failed, blocked, skipped)
+
+	if len(results) != 0 {
+		if err := a.showTimings(results, total); err != nil {
+			return err
+		}
+	}
+
 	if a.Options.JSON {
 		text, err := results.JSON()
 		if err != nil {
@@ -277,11 +634,59 @@ func (a *App) runTasks(spokfile *file.SpokFile, runner shell.Runner, tasks ...st
 		fmt.Println(text)
 	}
 
-	return nil
+	if err := a.events.Err(); err != nil {
+		return fmt.Errorf("could not write events: %w", err)
+	}
+
+	return failure
 }
 
-// show Tasks shows a pretty representation of the defined tasks and their
-// docstrings in alphabetical order.
+// reportFailed reports the tasks that ran before a run stopped with an error, e.g. the
+// finally tasks that cleaned up after it, the run's error is what's returned so any
+// error from reporting them is dropped.
+func (a *App) reportFailed(results task.Results, total time.Duration) {
+	if len(results) == 0 {
+		return
+	}
+	a.report(results, total) //nolint: errcheck // The run's error takes precedence
+}
+
+// showTimings shows how long each task in a run took, along with the total
+// for the whole run, tasks that didn't run say why instead.
+func (a *App) showTimings(results task.Results, total time.Duration) error {
+	writer := tabwriter.NewWriter(a.stream.Stdout, minWidth, tabWidth, padding, padChar, flags)
+	titleStyle.Fprintln(writer, "Task\tDuration")
+
+	for _, result := range results {
+		took := formatDuration(result.Duration)
+		switch {
+		case result.BlockedBy != "":
+			took = "blocked"
+		case result.Skipped:
+			took = "skipped"
+		}
+		line := fmt.Sprintf("%s\t%s\n", taskStyle.Sprint(result.Task), took)
+		fmt.Fprint(writer, line)
+	}
+
+	titleStyle.Fprintf(writer, "Total\t%s\n", formatDuration(total))
+	return writer.Flush()
+}
+
+// formatDuration formats d for humans, to the millisecond if it's under a
+// second and to the tenth of a second otherwise e.g. "850ms" or "12.3s".
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// show Tasks shows a pretty representation of the defined tasks, their aliases and
+// their docstrings in alphabetical order.
+//
+// Tasks without tags are shown first, followed by the tasks with each tag under a
+// heading, a task with more than one tag is shown under each of them.
 func (a *App) showTasks(spokfile *file.SpokFile) error {
 	writer := tabwriter.NewWriter(a.stream.Stdout, 0, tabWidth, 1, '\t', tabwriter.AlignRight)
 
@@ -289,36 +694,75 @@ func (a *App) showTasks(spokfile *file.SpokFile) error {
 	fmt.Fprintf(a.stream.Stdout, "Tasks defined in %s:\n", spokfile.Path)
 	titleStyle.Fprintln(writer, "Name\tDescription")
 
-	names := make([]string, 0, len(spokfile.Tasks))
-	for n := range spokfile.Tasks {
-		names = append(names, n)
+	var untagged []string
+	for n, t := range spokfile.Tasks {
+		if t.Private {
+			// Private tasks are helpers, not something to run directly
+			continue
+		}
+		if len(t.Tags) == 0 {
+			untagged = append(untagged, n)
+		}
 	}
-	sort.Strings(names)
+	sort.Strings(untagged)
+	showTaskLines(writer, spokfile, untagged)
 
-	for _, name := range names {
-		line := fmt.Sprintf("%s\t%s\n", taskStyle.Sprint(name), descStyle.Sprint(spokfile.Tasks[name].Doc))
-		fmt.Fprint(writer, line)
+	for _, tag := range spokfile.Tags() {
+		tagged, err := spokfile.Tagged(tag)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(writer)
+		titleStyle.Fprintf(writer, "%s:\n", tag)
+		showTaskLines(writer, spokfile, tagged)
 	}
 
 	return writer.Flush()
 }
 
+// showTaskLines writes a line to writer for each of the named tasks, as part of
+// showTasks.
+func showTaskLines(writer io.Writer, spokfile *file.SpokFile, names []string) {
+	for _, name := range names {
+		t := spokfile.Tasks[name]
+		label := taskStyle.Sprint(name)
+		if len(t.Aliases) != 0 {
+			label += " (" + strings.Join(t.Aliases, ", ") + ")"
+		}
+		line := fmt.Sprintf("%s\t%s\n", label, descStyle.Sprint(t.Doc))
+		fmt.Fprint(writer, line)
+	}
+}
+
 // showVariables shows all the defined spokfile variables and their set values.
 func (a *App) showVariables(spokfile *file.SpokFile) error {
-	writer := tabwriter.NewWriter(a.stream.Stdout, minWidth, tabWidth, padding, padChar, tabwriter.AlignRight)
+	if err := spokfile.Resolve(); err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(a.stream.Stdout, minWidth, tabWidth, padding, padChar, flags)
 
 	fmt.Fprintf(a.stream.Stdout, "Variables defined in %s:\n", spokfile.Path)
-	titleStyle.Fprintln(writer, "Name\tValue")
+	titleStyle.Fprintln(writer, "Name\tValue\tOrigin")
 
-	names := make([]string, 0, len(spokfile.Vars))
-	for n := range spokfile.Vars {
+	seen := make(map[string]bool, len(spokfile.Vars)+len(spokfile.Dotenv))
+	for name := range spokfile.Dotenv {
+		seen[name] = true
+	}
+	for name := range spokfile.Vars {
+		seen[name] = true
+	}
+
+	names := make([]string, 0, len(seen))
+	for n := range seen {
 		names = append(names, n)
 	}
 	sort.Strings(names)
 
+	// Show the value commands actually see, not just the one in the spokfile
 	for _, name := range names {
-		line := fmt.Sprintf("%s\t%s\n", name, spokfile.Vars[name])
-		fmt.Fprint(writer, line)
+		value, origin := spokfile.Effective(name)
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", name, value, origin)
 	}
 	return writer.Flush()
 }
@@ -326,9 +770,12 @@ func (a *App) showVariables(spokfile *file.SpokFile) error {
 // handleClean removes all declared outputs in the spokfile, either by using spok's own
 // cleaning of all declared outputs and it's own cache, or by a custom task written
 // by the user.
-func (a *App) handleClean(spokfile *file.SpokFile, runner shell.Runner) error {
+func (a *App) handleClean(ctx context.Context, spokfile *file.SpokFile) error {
+	if err := spokfile.Evaluate(); err != nil {
+		return ExitError{Err: err, Status: ExitInvalidSpokfile}
+	}
 	if spokfile.HasTask("clean") {
-		return a.runTasks(spokfile, runner, "clean")
+		return a.runTasks(ctx, spokfile, "clean")
 	}
 	return a.clean(spokfile)
 }
@@ -336,9 +783,9 @@ func (a *App) handleClean(spokfile *file.SpokFile, runner shell.Runner) error {
 // handleDefault implements the default actions for spok, this defaults to
 // showing all the defined tasks but if the user has a task named "default"
 // this will be run instead.
-func (a *App) handleDefault(spokfile *file.SpokFile, runner shell.Runner) error {
+func (a *App) handleDefault(ctx context.Context, spokfile *file.SpokFile) error {
 	if spokfile.HasTask("default") {
-		return a.runTasks(spokfile, runner, "default")
+		return a.runTasks(ctx, spokfile, "default")
 	}
 	return a.showTasks(spokfile)
 }
@@ -367,13 +814,14 @@ func (a *App) clean(spokfile *file.SpokFile) error {
 		// Same with all named outputs
 		for _, namedOutput := range task.NamedOutputs {
 			// NamedOutputs are just idents that point to filepaths
-			actual, ok := spokfile.Vars[namedOutput]
-			if !ok {
-				return fmt.Errorf("named output %s is not defined", namedOutput)
-			}
-			resolved, err := filepath.Abs(actual)
+			actual, err := spokfile.Var(namedOutput)
 			if err != nil {
-				return err
+				return fmt.Errorf("named output %s could not be resolved: %w", namedOutput, err)
+			}
+			// Relative to the spokfile like the file outputs, not wherever spok was run from
+			resolved := actual
+			if !filepath.IsAbs(resolved) {
+				resolved = filepath.Join(spokfile.Dir, resolved)
 			}
 			_, err = os.Stat(resolved)
 			if err != nil {
@@ -411,7 +859,60 @@ func (a *App) setStream(stream iostream.IOStream) {
 	a.stream = stream
 }
 
+// discardOutput throws away anything written to the app's stdout and stderr, but
+// keeps it's stdin so commands can still read from it e.g. with --quiet.
+func (a *App) discardOutput() {
+	stream := iostream.Null()
+	stream.Stdin = a.stream.Stdin
+	a.setStream(stream)
+}
+
+// parseOverrides separates any NAME=value variable overrides from the requested task names,
+// overrides given with --set are applied after those passed as arguments so take precedence.
+func parseOverrides(args, set []string) (tasks []string, overrides map[string]string, err error) {
+	overrides = make(map[string]string)
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || !token.IsIdent(name) {
+			tasks = append(tasks, arg)
+			continue
+		}
+		overrides[name] = value
+	}
+
+	for _, arg := range set {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || !token.IsIdent(name) {
+			return nil, nil, fmt.Errorf("invalid variable override %q, expected NAME=value", arg)
+		}
+		overrides[name] = value
+	}
+
+	return tasks, overrides, nil
+}
+
 func exists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
+
+// splitTarget splits a task addressed in a nested spokfile e.g. "services/api:test" into
+// it's directory and task name, ok is false if the target is a plain task name.
+func splitTarget(target string) (dir, name string, ok bool) {
+	idx := strings.LastIndex(target, ":")
+	if idx == -1 {
+		return "", "", false
+	}
+	return target[:idx], target[idx+1:], true
+}
+
+// anyAddressed reports whether any of the requested targets address a task in
+// a nested spokfile.
+func anyAddressed(targets []string) bool {
+	for _, target := range targets {
+		if _, _, ok := splitTarget(target); ok {
+			return true
+		}
+	}
+	return false
+}
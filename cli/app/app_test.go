@@ -0,0 +1,387 @@
+package app_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.followtheprocess.codes/spok/cli/app"
+	"go.followtheprocess.codes/spok/iostream"
+)
+
+func TestRunStdin(t *testing.T) {
+	t.Parallel()
+	src := `task read() {
+	read x && echo "$x" > got
+}
+
+task other() {
+	echo "other"
+}
+`
+
+	tests := []struct {
+		options func(*app.Options)
+		name    string
+	}{
+		{name: "default", options: func(*app.Options) {}},
+		{name: "quiet", options: func(o *app.Options) { o.Quiet = true }},
+		{name: "json", options: func(o *app.Options) { o.JSON = true }},
+		{name: "events", options: func(o *app.Options) { o.Events = "ndjson" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			spokfile := filepath.Join(dir, "spokfile")
+			if err := os.WriteFile(spokfile, []byte(src), 0o644); err != nil {
+				t.Fatalf("could not write spokfile: %v", err)
+			}
+
+			// A pipe, like stdin is when something is piped into spok
+			stdin, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("could not create pipe: %v", err)
+			}
+			t.Cleanup(func() { stdin.Close() })
+			if _, err := w.WriteString("hello\n"); err != nil {
+				t.Fatalf("could not write to pipe: %v", err)
+			}
+			w.Close()
+
+			stream := iostream.Test()
+			stream.Stdin = stdin
+			spok := app.New(stream)
+			spok.Options.Spokfile = spokfile
+			tt.options(spok.Options)
+
+			if err := spok.Run(context.Background(), []string{"read", "other"}); err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "got"))
+			if err != nil {
+				t.Fatalf("task did not write what it read: %v", err)
+			}
+			if string(got) != "hello\n" {
+				t.Errorf("Wrong stdin: got %q, wanted %q", got, "hello\n")
+			}
+		})
+	}
+}
+
+func TestCleanNamedOutputs(t *testing.T) {
+	t.Parallel()
+	src := `OUT := "out.txt"
+
+task build() -> OUT {
+	echo "built" > out.txt
+}
+`
+	dir := t.TempDir()
+	spokfile := filepath.Join(dir, "spokfile")
+	if err := os.WriteFile(spokfile, []byte(src), 0o644); err != nil {
+		t.Fatalf("could not write spokfile: %v", err)
+	}
+	out := filepath.Join(dir, "out.txt")
+	if err := os.WriteFile(out, []byte("built\n"), 0o644); err != nil {
+		t.Fatalf("could not write output: %v", err)
+	}
+
+	// The test runs from this package's directory, not the spokfile's
+	spok := app.New(iostream.Test())
+	spok.Options.Spokfile = spokfile
+	spok.Options.Clean = true
+
+	if err := spok.Run(context.Background(), nil); err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	if _, err := os.Stat(out); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("named output %s was not removed: %v", out, err)
+	}
+}
+
+func TestRunReportsFinallyAfterError(t *testing.T) {
+	t.Parallel()
+	src := `@finally("_cleanup")
+task slow() {
+	sleep 10
+}
+
+task _cleanup() {
+	exit 2
+}
+`
+	dir := t.TempDir()
+	spokfile := filepath.Join(dir, "spokfile")
+	if err := os.WriteFile(spokfile, []byte(src), 0o644); err != nil {
+		t.Fatalf("could not write spokfile: %v", err)
+	}
+
+	stream := iostream.Test()
+	spok := app.New(stream)
+	spok.Options.Spokfile = spokfile
+
+	// Interrupt the main task so the run stops with an error
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := spok.Run(ctx, []string{"slow"})
+	if err == nil {
+		t.Fatal("Run did not return an error")
+	}
+	want := `task "slow" encountered an error: task "slow" interrupted running "sleep 10"`
+	if err.Error() != want {
+		t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), want)
+	}
+
+	stdout := stream.Stdout.(*bytes.Buffer).String()
+	if !strings.Contains(stdout, `Task "_cleanup" failed`) {
+		t.Errorf("failed finally task was not reported, got:\n%s", stdout)
+	}
+}
+
+func TestShowVariables(t *testing.T) {
+	t.Parallel()
+	src := `VERSION := "v1.2.3"
+SHA := "abc"
+
+task build() {
+	echo {{.VERSION}}
+}
+`
+	dir := t.TempDir()
+	spokfile := filepath.Join(dir, "spokfile")
+	if err := os.WriteFile(spokfile, []byte(src), 0o644); err != nil {
+		t.Fatalf("could not write spokfile: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("TOKEN=secret\n"), 0o644); err != nil {
+		t.Fatalf("could not write .env: %v", err)
+	}
+
+	stream := iostream.Test()
+	spok := app.New(stream)
+	spok.Options.Spokfile = spokfile
+	spok.Options.Variables = true
+	spok.Options.Set = []string{"SHA=def"}
+
+	if err := spok.Run(context.Background(), nil); err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	want := "Variables defined in " + spokfile + ":\n" +
+		"Name     Value   Origin\n" +
+		"SHA      def     CLI\n" +
+		"TOKEN    secret  env\n" +
+		"VERSION  v1.2.3  spokfile\n"
+	if diff := cmp.Diff(want, stream.Stdout.(*bytes.Buffer).String()); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWorkspaceFlags(t *testing.T) {
+	t.Parallel()
+	src := `task test() {
+	echo "test" > ran
+}
+`
+
+	tests := []struct {
+		options func(*app.Options)
+		name    string
+		args    []string
+		err     string
+	}{
+		{
+			name:    "fmt",
+			options: func(o *app.Options) { o.Fmt = true },
+			args:    []string{"svc:test"},
+			err:     "--fmt cannot be used with --all or tasks addressed as 'dir:task'",
+		},
+		{
+			name:    "vars",
+			options: func(o *app.Options) { o.All, o.Variables = true, true },
+			args:    []string{"test"},
+			err:     "--vars cannot be used with --all or tasks addressed as 'dir:task'",
+		},
+		{
+			name:    "clean",
+			options: func(o *app.Options) { o.All, o.Clean = true, true },
+			args:    []string{"test"},
+			err:     "--clean cannot be used with --all or tasks addressed as 'dir:task'",
+		},
+		{
+			name:    "show",
+			options: func(o *app.Options) { o.All, o.Show = true, true },
+			args:    []string{"test"},
+			err:     "--show cannot be used with --all or tasks addressed as 'dir:task'",
+		},
+		{
+			name:    "tag",
+			options: func(o *app.Options) { o.Tags = []string{"ci"} },
+			args:    []string{"svc:test"},
+			err:     "--tag cannot be used with --all or tasks addressed as 'dir:task'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			spokfile := filepath.Join(dir, "spokfile")
+			if err := os.WriteFile(spokfile, []byte(src), 0o644); err != nil {
+				t.Fatalf("could not write spokfile: %v", err)
+			}
+
+			spok := app.New(iostream.Test())
+			spok.Options.Spokfile = spokfile
+			tt.options(spok.Options)
+
+			err := spok.Run(context.Background(), tt.args)
+			if err == nil {
+				t.Fatal("Run did not return an error")
+			}
+			if err.Error() != tt.err {
+				t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "ran")); !errors.Is(err, fs.ErrNotExist) {
+				t.Error("task ran despite the invalid flags")
+			}
+		})
+	}
+}
+
+func TestWorkspaceOverrides(t *testing.T) {
+	t.Parallel()
+	root := `task test() {
+	echo "root" > ran
+}
+`
+	nested := `VERSION := "0.1.0"
+
+task test() {
+	echo {{.VERSION}} > ran
+}
+`
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "spokfile"), []byte(root), 0o644); err != nil {
+		t.Fatalf("could not write spokfile: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "svc"), 0o755); err != nil {
+		t.Fatalf("could not create nested dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "svc", "spokfile"), []byte(nested), 0o644); err != nil {
+		t.Fatalf("could not write nested spokfile: %v", err)
+	}
+
+	t.Run("typo", func(t *testing.T) {
+		spok := app.New(iostream.Test())
+		spok.Options.Spokfile = filepath.Join(dir, "spokfile")
+		spok.Options.All = true
+
+		err := spok.Run(context.Background(), []string{"test", "VERSOIN=1.2.3"})
+		want := `cannot override variable "VERSOIN", no spokfile declares it. Did you mean "VERSION"?`
+		if err == nil || err.Error() != want {
+			t.Fatalf("Wrong error\nGot: %v\nWant: %s", err, want)
+		}
+	})
+
+	t.Run("declared by some", func(t *testing.T) {
+		spok := app.New(iostream.Test())
+		spok.Options.Spokfile = filepath.Join(dir, "spokfile")
+		spok.Options.All = true
+		spok.Options.Force = true
+
+		if err := spok.Run(context.Background(), []string{"test", "VERSION=1.2.3"}); err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(dir, "svc", "ran"))
+		if err != nil {
+			t.Fatalf("nested task did not run: %v", err)
+		}
+		if string(got) != "1.2.3\n" {
+			t.Errorf("Wrong output: got %q, wanted %q", got, "1.2.3\n")
+		}
+	})
+}
+
+func TestNotifyContext(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("Can't send an interrupt to a process on windows")
+	}
+
+	// Run the helper below in a subprocess, so the interrupts don't go to the tests
+	cmd := exec.Command(os.Args[0], "-test.run=^TestNotifyContextHelper$")
+	cmd.Env = append(os.Environ(), "SPOK_NOTIFY_CONTEXT_HELPER=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("could not get helper stdout: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("could not start helper: %v", err)
+	}
+
+	// The helper has been interrupted once and is now stuck in it's "finally task"
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "interrupted\n" {
+		t.Fatalf("helper was not interrupted: got %q, err = %v", line, err)
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("could not interrupt helper: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("helper exited successfully, wanted it killed by the second interrupt")
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill() //nolint: errcheck
+		t.Fatal("second interrupt did not stop the helper")
+	}
+}
+
+// TestNotifyContextHelper isn't a real test, it's run by TestNotifyContext as a subprocess
+// to interrupt itself and then hang like a stuck finally task would.
+func TestNotifyContextHelper(t *testing.T) {
+	if os.Getenv("SPOK_NOTIFY_CONTEXT_HELPER") != "1" {
+		t.Skip("Only run as a subprocess of TestNotifyContext")
+	}
+
+	ctx, stop := app.NotifyContext(context.Background())
+	defer stop()
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("could not find own process: %v", err)
+	}
+	if err := self.Signal(os.Interrupt); err != nil {
+		t.Fatalf("could not interrupt self: %v", err)
+	}
+	<-ctx.Done()
+
+	// Wait for the signals to be let go of after the first, then hang
+	time.Sleep(100 * time.Millisecond)
+	fmt.Println("interrupted")
+	time.Sleep(time.Minute)
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"go.followtheprocess.codes/spok/file"
+)
+
+// Exit statuses for spok's own errors, the codes are those from BSD's sysexits.h
+// so they're unlikely to be confused with the status of a failed command, which
+// spok exits with as is.
+const (
+	ExitFailure         = 1   // Anything not covered below
+	ExitMissingTask     = 64  // A requested task or tag doesn't exist or can't be run directly
+	ExitInvalidSpokfile = 65  // The spokfile couldn't be parsed or isn't valid
+	ExitNoSpokfile      = 66  // No spokfile could be found
+	ExitCache           = 74  // The spok cache couldn't be read or written
+	ExitInterrupted     = 130 // Spok was interrupted e.g. by Ctrl+C
+)
+
+// ExitError is an error that spok should exit with a particular Status for, either
+// that of the command that failed or one of the Exit codes above.
+type ExitError struct {
+	Err    error // The underlying error
+	Status int   // The exit status
+}
+
+// Error implements error for an ExitError.
+func (e ExitError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitStatus returns the status spok should exit with after returning err,
+// 0 if err is nil and ExitFailure if it doesn't say otherwise.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Status
+	}
+	return ExitFailure
+}
+
+// exitError gives err the status spok should exit with if it's a kind of error with
+// one of the Exit codes and doesn't already have a status.
+func exitError(ctx context.Context, err error) error {
+	var exitErr ExitError
+	switch {
+	case err == nil, errors.As(err, &exitErr):
+		return err
+	case ctx.Err() != nil:
+		return ExitError{Err: err, Status: ExitInterrupted}
+	case errors.Is(err, file.ErrNoTask):
+		return ExitError{Err: err, Status: ExitMissingTask}
+	case errors.Is(err, file.ErrCache):
+		return ExitError{Err: err, Status: ExitCache}
+	default:
+		return err
+	}
+}
@@ -0,0 +1,23 @@
+package app
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyContext returns a copy of parent that's cancelled on Ctrl+C (or SIGTERM) so the
+// running command is stopped and any finally tasks get the chance to clean up.
+//
+// Only the first signal is caught, once the context is done the signals go back to their
+// default behaviour so a second Ctrl+C exits spok straight away, even if a finally task
+// has hung. As with signal.NotifyContext, stop should be called once spok is done.
+func NotifyContext(parent context.Context) (ctx context.Context, stop context.CancelFunc) {
+	ctx, stop = signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
@@ -23,6 +23,7 @@ However, spok offers a number of additional features such as:
 - Full cross compatibility
 - No dependency on any form of shell
 - Load .env files by default
+- Monorepo support, run tasks across nested spokfiles
 - Incremental runs based on file hashing and sum checks
 `
 )
@@ -45,6 +46,11 @@ func BuildRootCmd() (*cli.Command, error) {
 		cli.Example("Run tasks named 'test' and 'lint'", "spok test lint"),
 		cli.Example("Show all defined variables in the spokfile", "spok --vars"),
 		cli.Example("Format the spokfile", "spok --fmt"),
+		cli.Example("Run the 'test' task in every spokfile in a monorepo", "spok --all test"),
+		cli.Example("Run the 'test' task in the spokfile under services/api", "spok services/api:test"),
+		cli.Example("Override the VERSION variable for this run", "spok build VERSION=1.2.3"),
+		cli.Example("Run every task tagged 'ci'", "spok --tag ci"),
+		cli.Example("Label each line of output with the task it came from", "spok --output prefixed lint test"),
 		cli.Version(version),
 		cli.Commit(commit),
 		cli.BuildDate(buildDate),
@@ -54,10 +60,17 @@ func BuildRootCmd() (*cli.Command, error) {
 		cli.Flag(&spok.Options.Init, "init", flag.NoShortHand, "Initialise a new spokfile in $CWD"),
 		cli.Flag(&spok.Options.Clean, "clean", 'c', "Remove all build artifacts"),
 		cli.Flag(&spok.Options.Force, "force", 'f', "Bypass file hash checks and force requested tasks to run"),
+		cli.Flag(&spok.Options.KeepGoing, "keep-going", 'k', "Keep running every task whose dependencies succeeded after a failure"),
 		cli.Flag(&spok.Options.Debug, "debug", flag.NoShortHand, "Show debug info"),
 		cli.Flag(&spok.Options.Quiet, "quiet", 'q', "Silence all CLI output."),
 		cli.Flag(&spok.Options.JSON, "json", 'j', "Output task results as JSON"),
 		cli.Flag(&spok.Options.Show, "show", 's', "Show all tasks defined in the spokfile"),
+		cli.Flag(&spok.Options.All, "all", 'a', "Run the requested tasks in every spokfile under the spokfile's directory"),
+		cli.Flag(&spok.Options.Set, "set", flag.NoShortHand, "Override a spokfile variable in NAME=value form"),
+		cli.Flag(&spok.Options.Tags, "tag", 't', "Run every task with the given tag"),
+		cli.Flag(&spok.Options.Shell, "shell", flag.NoShortHand, "The shell to run commands with e.g. 'bash' (defaults to spok's integrated shell)"),
+		cli.Flag(&spok.Options.Events, "events", flag.NoShortHand, "Stream events to stdout as tasks run, in the given format: 'ndjson'"),
+		cli.Flag(&spok.Options.Output, "output", 'o', "How task output is shown: 'raw', 'prefixed' or 'grouped' (defaults to 'raw')"),
 		cli.Run(func(ctx context.Context, cmd *cli.Command) error {
 			return spok.Run(ctx, cmd.Args())
 		}),
@@ -5,18 +5,23 @@ import (
 	"os"
 
 	"go.followtheprocess.codes/msg"
+	"go.followtheprocess.codes/spok/cli/app"
 	"go.followtheprocess.codes/spok/cli/cmd"
 )
 
 func main() {
 	if err := run(); err != nil {
 		msg.Error("%s", err)
-		os.Exit(1)
+		// The failed command's exit status, or one of spok's own
+		os.Exit(app.ExitStatus(err))
 	}
 }
 
 func run() error {
-	ctx := context.Background()
+	// Cancelled on Ctrl+C so the running command is stopped and any
+	// finally tasks get the chance to clean up, a second Ctrl+C exits
+	ctx, stop := app.NotifyContext(context.Background())
+	defer stop()
 
 	rootCmd, err := cmd.BuildRootCmd()
 	if err != nil {
@@ -0,0 +1,245 @@
+// Package event implements spok's streaming events, a record of everything that happens
+// during a run written as it happens, for things like editor integrations and dashboards.
+//
+// Events are written as newline delimited JSON (NDJSON), one object per line of the form:
+//
+//	{"version":1,"event":"task_started","time":"2026-01-02T15:04:05.999Z","data":{"task":"build"}}
+//
+// Where the contents of data depend on the event, see the types in this package. In a run
+// across several spokfiles, the events from nested ones also say which spokfile in data, see
+// Writer.For. The schema
+// is versioned by Version, which only changes if an existing event changes in a way that
+// could break a consumer, new events and new fields may be added without changing it.
+package event
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.followtheprocess.codes/spok/iostream"
+)
+
+// Version is the version of the event schema.
+const Version = 1
+
+// Event is something that happens during a spok run, one of the types in this package.
+type Event interface {
+	// Name returns the name of the event, as it appears in the "event" field.
+	Name() string
+}
+
+// GraphBuilt is emitted once the tasks to run have been worked out, before any of them run.
+type GraphBuilt struct {
+	Spokfile string   `json:"spokfile,omitempty"` // The directory of the nested spokfile the tasks are in, see Writer.For
+	Tasks    []string `json:"tasks"`              // The tasks that will run, in the order they will run
+	Finally  []string `json:"finally"`            // The finally tasks that run at the end, if the tasks declaring them run
+}
+
+// Name implements Event for GraphBuilt.
+func (GraphBuilt) Name() string { return "graph_built" }
+
+// TaskStarted is emitted when a task starts running.
+type TaskStarted struct {
+	Spokfile string `json:"spokfile,omitempty"` // The directory of the nested spokfile the task is in, see Writer.For
+	Task     string `json:"task"`               // The name of the task
+}
+
+// Name implements Event for TaskStarted.
+func (TaskStarted) Name() string { return "task_started" }
+
+// TaskSkipped is emitted instead of TaskStarted when a task doesn't need to run because none
+// of it's dependencies have changed, or can't run because a task it depends on failed.
+type TaskSkipped struct {
+	Spokfile  string `json:"spokfile,omitempty"`   // The directory of the nested spokfile the task is in, see Writer.For
+	Task      string `json:"task"`                 // The name of the task
+	BlockedBy string `json:"blocked_by,omitempty"` // The failed task that stopped it running, empty if it's up to date
+}
+
+// Name implements Event for TaskSkipped.
+func (TaskSkipped) Name() string { return "task_skipped" }
+
+// TaskFinished is emitted when a task that started has finished, whether it succeeded or not.
+type TaskFinished struct {
+	Spokfile string        `json:"spokfile,omitempty"` // The directory of the nested spokfile the task is in, see Writer.For
+	Task     string        `json:"task"`               // The name of the task
+	Duration time.Duration `json:"duration_ns"`        // How long the task took, in nanoseconds
+	Ok       bool          `json:"ok"`                 // Whether every command in the task succeeded
+}
+
+// Name implements Event for TaskFinished.
+func (TaskFinished) Name() string { return "task_finished" }
+
+// CommandStarted is emitted when a command in a task starts running.
+type CommandStarted struct {
+	Spokfile string `json:"spokfile,omitempty"` // The directory of the nested spokfile the task is in, see Writer.For
+	Task     string `json:"task"`               // The task the command belongs to
+	Cmd      string `json:"cmd"`                // The command
+}
+
+// Name implements Event for CommandStarted.
+func (CommandStarted) Name() string { return "command_started" }
+
+// CommandFinished is emitted when a command has finished running.
+type CommandFinished struct {
+	Spokfile string        `json:"spokfile,omitempty"` // The directory of the nested spokfile the task is in, see Writer.For
+	Task     string        `json:"task"`               // The task the command belongs to
+	Cmd      string        `json:"cmd"`                // The command
+	Status   int           `json:"status"`             // The exit status of the command
+	Duration time.Duration `json:"duration_ns"`        // How long the command took, in nanoseconds
+}
+
+// Name implements Event for CommandFinished.
+func (CommandFinished) Name() string { return "command_finished" }
+
+// Output is emitted for each line a command writes to stdout or stderr.
+type Output struct {
+	Spokfile string `json:"spokfile,omitempty"` // The directory of the nested spokfile the task is in, see Writer.For
+	Task     string `json:"task"`               // The task the command belongs to
+	Stream   string `json:"stream"`             // Where the command wrote the line, "stdout" or "stderr"
+	Line     string `json:"line"`               // The line, without it's trailing newline
+}
+
+// Name implements Event for Output.
+func (Output) Name() string { return "output" }
+
+// envelope is how every event is written.
+type envelope struct { //nolint: govet // Field order is the JSON field order
+	Version int       `json:"version"`
+	Name    string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Data    Event     `json:"data"`
+}
+
+// Writer writes events to an io.Writer as NDJSON, it's safe for concurrent use.
+//
+// A nil *Writer is valid and discards every event, so callers that don't
+// want events don't need to check.
+type Writer struct {
+	sink     *sink  // Where the events are written, shared with any Writers made by For
+	spokfile string // Set as the Spokfile of every event, see For
+}
+
+// sink is the underlying writer of events.
+type sink struct {
+	encoder *json.Encoder // Encodes events to the underlying writer
+	err     error         // The first error writing an event
+	mu      sync.Mutex    // Protects encoder and err
+}
+
+// NewWriter returns a Writer that writes events to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{sink: &sink{encoder: json.NewEncoder(w)}}
+}
+
+// For returns a Writer to the same place for the events of a nested spokfile in a
+// run across several, dir being the spokfile's directory as it appears in it's task's
+// addresses e.g. "services/api". Every event it writes has it's Spokfile set to dir.
+func (w *Writer) For(dir string) *Writer {
+	if w == nil {
+		return nil
+	}
+	return &Writer{sink: w.sink, spokfile: dir}
+}
+
+// Emit writes the event.
+func (w *Writer) Emit(event Event) {
+	if w == nil {
+		return
+	}
+
+	if w.spokfile != "" {
+		event = withSpokfile(event, w.spokfile)
+	}
+
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+
+	err := w.sink.encoder.Encode(envelope{
+		Version: Version,
+		Name:    event.Name(),
+		Time:    time.Now().UTC(),
+		Data:    event,
+	})
+	if err != nil && w.sink.err == nil {
+		w.sink.err = err
+	}
+}
+
+// Err returns the first error there was writing an event, if any.
+func (w *Writer) Err() error {
+	if w == nil {
+		return nil
+	}
+
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	return w.sink.err
+}
+
+// withSpokfile returns a copy of event with it's Spokfile set to dir.
+func withSpokfile(event Event, dir string) Event {
+	switch event := event.(type) {
+	case GraphBuilt:
+		event.Spokfile = dir
+		return event
+	case TaskStarted:
+		event.Spokfile = dir
+		return event
+	case TaskSkipped:
+		event.Spokfile = dir
+		return event
+	case TaskFinished:
+		event.Spokfile = dir
+		return event
+	case CommandStarted:
+		event.Spokfile = dir
+		return event
+	case CommandFinished:
+		event.Spokfile = dir
+		return event
+	case Output:
+		event.Spokfile = dir
+		return event
+	default:
+		return event
+	}
+}
+
+// Tee returns a stream that writes to stream and also emits an Output event for every
+// line written to it for the task, along with a function to call once the command writing
+// to it has finished to emit any unfinished line.
+func (w *Writer) Tee(task string, stream iostream.IOStream) (iostream.IOStream, func()) {
+	if w == nil {
+		return stream, func() {}
+	}
+
+	stdout := iostream.NewLineWriter(lines{events: w, task: task, stream: "stdout"}, "")
+	stderr := iostream.NewLineWriter(lines{events: w, task: task, stream: "stderr"}, "")
+	tee := iostream.IOStream{
+		Stdin:  stream.Stdin,
+		Stdout: io.MultiWriter(stream.Stdout, stdout),
+		Stderr: io.MultiWriter(stream.Stderr, stderr),
+	}
+	return tee, func() {
+		// Emitting never fails, any error is kept for Err
+		stdout.Flush() //nolint: errcheck
+		stderr.Flush() //nolint: errcheck
+	}
+}
+
+// lines is an io.Writer that's given one line per write by a LineWriter,
+// and emits an Output event for each.
+type lines struct {
+	events *Writer // Where the events go
+	task   string  // The task the output is from
+	stream string  // The stream the output is from
+}
+
+// Write implements io.Writer for lines.
+func (l lines) Write(p []byte) (int, error) {
+	l.events.Emit(Output{Task: l.task, Stream: l.stream, Line: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
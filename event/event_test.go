@@ -0,0 +1,158 @@
+package event_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.followtheprocess.codes/spok/event"
+	"go.followtheprocess.codes/spok/iostream"
+)
+
+// decode decodes the NDJSON events in text, replacing the time of each with the
+// zero value so they can be compared.
+func decode(t *testing.T, text string) []map[string]any {
+	t.Helper()
+	var events []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		var got map[string]any
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("event %q is not valid JSON: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(got["time"])); err != nil {
+			t.Errorf("event %q has an invalid time: %v", line, err)
+		}
+		delete(got, "time")
+		events = append(events, got)
+	}
+	return events
+}
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		event    event.Event
+		want     map[string]any
+		name     string
+		spokfile string // Write the event For this spokfile, if set
+	}{
+		{
+			name:  "graph built",
+			event: event.GraphBuilt{Tasks: []string{"lint", "test"}, Finally: []string{}},
+			want: map[string]any{
+				"version": 1.0,
+				"event":   "graph_built",
+				"data":    map[string]any{"tasks": []any{"lint", "test"}, "finally": []any{}},
+			},
+		},
+		{
+			name:  "task skipped",
+			event: event.TaskSkipped{Task: "test"},
+			want: map[string]any{
+				"version": 1.0,
+				"event":   "task_skipped",
+				"data":    map[string]any{"task": "test"},
+			},
+		},
+		{
+			name:  "task blocked",
+			event: event.TaskSkipped{Task: "test", BlockedBy: "lint"},
+			want: map[string]any{
+				"version": 1.0,
+				"event":   "task_skipped",
+				"data":    map[string]any{"task": "test", "blocked_by": "lint"},
+			},
+		},
+		{
+			name:  "command finished",
+			event: event.CommandFinished{Task: "test", Cmd: "go test ./...", Status: 0, Duration: time.Second},
+			want: map[string]any{
+				"version": 1.0,
+				"event":   "command_finished",
+				"data":    map[string]any{"task": "test", "cmd": "go test ./...", "status": 0.0, "duration_ns": 1e9},
+			},
+		},
+		{
+			name:     "nested spokfile",
+			event:    event.TaskStarted{Task: "test"},
+			spokfile: "services/api",
+			want: map[string]any{
+				"version": 1.0,
+				"event":   "task_started",
+				"data":    map[string]any{"task": "test", "spokfile": "services/api"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			buf := &bytes.Buffer{}
+			events := event.NewWriter(buf)
+			if tt.spokfile != "" {
+				events = events.For(tt.spokfile)
+			}
+			events.Emit(tt.event)
+			if err := events.Err(); err != nil {
+				t.Fatalf("Err returned an error: %v", err)
+			}
+
+			got := decode(t, buf.String())
+			if diff := cmp.Diff([]map[string]any{tt.want}, got); diff != "" {
+				t.Errorf("Event mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriterNil(t *testing.T) {
+	t.Parallel()
+	var events *event.Writer
+
+	// None of these should panic
+	events.Emit(event.TaskStarted{Task: "test"})
+	events.For("services/api").Emit(event.TaskStarted{Task: "test"})
+	if err := events.Err(); err != nil {
+		t.Errorf("Err returned an error: %v", err)
+	}
+
+	stream := iostream.Null()
+	tee, flush := events.Tee("test", stream)
+	flush()
+	if tee != stream {
+		t.Errorf("Tee should return the stream as is, got %+v", tee)
+	}
+}
+
+func TestTee(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	events := event.NewWriter(buf)
+
+	stream := iostream.Test()
+	tee, flush := events.Tee("test", stream)
+	fmt.Fprint(tee.Stdout, "hello\nthere")
+	fmt.Fprint(tee.Stderr, "oops\n")
+	flush()
+
+	stdout, ok := stream.Stdout.(*bytes.Buffer)
+	if !ok {
+		t.Fatalf("Test stream stdout was not a *bytes.Buffer")
+	}
+	if stdout.String() != "hello\nthere" {
+		t.Errorf("Tee should still write to the stream, got %q", stdout.String())
+	}
+
+	want := []map[string]any{
+		{"version": 1.0, "event": "output", "data": map[string]any{"task": "test", "stream": "stdout", "line": "hello"}},
+		{"version": 1.0, "event": "output", "data": map[string]any{"task": "test", "stream": "stderr", "line": "oops"}},
+		{"version": 1.0, "event": "output", "data": map[string]any{"task": "test", "stream": "stdout", "line": "there"}},
+	}
+	if diff := cmp.Diff(want, decode(t, buf.String())); diff != "" {
+		t.Errorf("Events mismatch (-want +got):\n%s", diff)
+	}
+}
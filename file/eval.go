@@ -0,0 +1,299 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"go.followtheprocess.codes/spok/ast"
+	"go.followtheprocess.codes/spok/builtins"
+	"go.followtheprocess.codes/spok/task"
+)
+
+// evaluator resolves the global variables in a spokfile, evaluating each one only
+// after everything it references so that the order of declaration doesn't matter.
+//
+// Variables are evaluated lazily the first time they're needed and the result
+// memoised in the file's Vars, so a builtin like exec is only ever run if something
+// actually uses it's result, and only ever run once.
+type evaluator struct {
+	file    *SpokFile             // The file being built, resolved values are stored in it's Vars
+	assigns map[string]ast.Assign // All the global variable declarations by name
+	order   []string              // Variable names in declaration order, so errors are deterministic
+	stack   []string              // The variables currently being evaluated, used to detect cycles
+}
+
+// newEvaluator returns an evaluator that stores resolved values in file.
+func newEvaluator(file *SpokFile) *evaluator {
+	return &evaluator{
+		file:    file,
+		assigns: make(map[string]ast.Assign),
+	}
+}
+
+// declare registers a global variable declaration, it is not evaluated until
+// resolve is called.
+func (e *evaluator) declare(assign ast.Assign) error {
+	if _, ok := e.assigns[assign.Name.Name]; ok {
+		return fmt.Errorf("duplicate variable: spokfile already declares %q", assign.Name.Name)
+	}
+	e.assigns[assign.Name.Name] = assign
+	e.order = append(e.order, assign.Name.Name)
+	return nil
+}
+
+// resolveAll evaluates every declared variable.
+func (e *evaluator) resolveAll() error {
+	for _, name := range e.order {
+		if _, err := e.resolve(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check statically validates every declaration without evaluating anything, reporting
+// references to undefined variables or builtins and cycles between variables.
+func (e *evaluator) check() error {
+	done := make(map[string]bool, len(e.assigns))
+	for _, name := range e.order {
+		if err := e.checkVar(name, done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVar is the recursive implementation of check.
+func (e *evaluator) checkVar(name string, done map[string]bool) error {
+	if done[name] {
+		return nil
+	}
+	if _, ok := e.file.Vars[name]; ok {
+		// Already has a value e.g. overridden on the command line
+		return nil
+	}
+	if err := e.push(name); err != nil {
+		return err
+	}
+	defer e.pop()
+
+	refs, err := e.refs(e.assigns[name].Value)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := e.checkVar(ref, done); err != nil {
+			return err
+		}
+	}
+	done[name] = true
+	return nil
+}
+
+// refs returns the names of the variables directly referenced by a node on
+// the RHS of a declaration.
+func (e *evaluator) refs(node ast.Node) ([]string, error) {
+	switch node.Type() {
+	case ast.NodeString:
+		if !strings.Contains(node.Literal(), "{{") {
+			return nil, nil
+		}
+		return task.Refs(node.Literal())
+
+	case ast.NodeIdent:
+		return []string{node.Literal()}, nil
+
+	case ast.NodeFunction:
+		function, ok := node.(ast.Function)
+		if !ok {
+			return nil, fmt.Errorf("AST node has ast.NodeFunction type but could not be converted to an ast.Function: %s", node)
+		}
+		builtin, ok := builtins.Lookup(function.Name.Name)
+		if !ok {
+			return nil, fmt.Errorf("builtin function undefined: %s", function.Name.Name)
+		}
+		if err := builtin.CheckArgs(len(function.Arguments)); err != nil {
+			return nil, err
+		}
+		var refs []string
+		for _, arg := range function.Arguments {
+			switch arg.Type() {
+			case ast.NodeString, ast.NodeIdent, ast.NodeFunction:
+			default:
+				return nil, fmt.Errorf("invalid argument to builtin %s, expected a string, variable or builtin call, got %s", function.Name.Name, arg.Type())
+			}
+			argRefs, err := e.refs(arg)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, argRefs...)
+		}
+		return refs, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected node in assignment %s: %s", node.Type(), node)
+	}
+}
+
+// isStatic reports whether the variable 'name' can be evaluated without calling
+// any builtin functions, i.e. it's made up only of plain strings and other static variables.
+func (e *evaluator) isStatic(name string) bool {
+	if _, ok := e.file.Vars[name]; ok {
+		return true
+	}
+	assign, ok := e.assigns[name]
+	if !ok {
+		return false
+	}
+	return e.isStaticNode(assign.Value)
+}
+
+// isStaticNode is the per node implementation of isStatic, check must have
+// already succeeded so that there are no cycles.
+//
+// A string with a template in it isn't static as the template may call a builtin
+// e.g. "{{ exec "git describe" }}".
+func (e *evaluator) isStaticNode(node ast.Node) bool {
+	if node.Type() == ast.NodeFunction {
+		return false
+	}
+	if node.Type() == ast.NodeString && strings.Contains(node.Literal(), "{{") {
+		return false
+	}
+	refs, err := e.refs(node)
+	if err != nil {
+		return false
+	}
+	for _, ref := range refs {
+		if !e.isStatic(ref) {
+			return false
+		}
+	}
+	return true
+}
+
+// push marks the variable 'name' as being evaluated, returning an error if doing so
+// would create a cycle or if it's not declared.
+func (e *evaluator) push(name string) error {
+	for i, seen := range e.stack {
+		if seen == name {
+			cycle := make([]string, 0, len(e.stack)-i+1)
+			cycle = append(cycle, e.stack[i:]...)
+			cycle = append(cycle, name)
+			return fmt.Errorf("cycle detected in variable declarations: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	if _, ok := e.assigns[name]; !ok {
+		if len(e.stack) == 0 {
+			return fmt.Errorf("undefined variable %q", name)
+		}
+		return fmt.Errorf("variable %q references undefined variable %q", e.stack[len(e.stack)-1], name)
+	}
+
+	e.stack = append(e.stack, name)
+	return nil
+}
+
+// pop marks the most recently pushed variable as no longer being evaluated.
+func (e *evaluator) pop() {
+	e.stack = e.stack[:len(e.stack)-1]
+}
+
+// resolve returns the value of the variable 'name', evaluating it (and anything
+// it references) if this has not already been done.
+func (e *evaluator) resolve(name string) (string, error) {
+	if val, ok := e.file.Vars[name]; ok {
+		return val, nil
+	}
+
+	if err := e.push(name); err != nil {
+		return "", err
+	}
+	assign := e.assigns[name]
+	val, err := e.eval(assign.Value)
+	e.pop()
+	if err != nil {
+		return "", err
+	}
+
+	e.file.logger.Debug("Evaluated variable %s", name)
+
+	origin := OriginSpokfile
+	if assign.Value.Type() == ast.NodeFunction {
+		origin = OriginBuiltin
+	}
+
+	e.file.Vars[name] = val
+	e.file.origins[name] = origin
+	return val, nil
+}
+
+// eval evaluates a single node on the RHS of a declaration.
+func (e *evaluator) eval(node ast.Node) (string, error) {
+	switch node.Type() {
+	case ast.NodeString:
+		return e.interpolate(node.Literal())
+
+	case ast.NodeIdent:
+		return e.resolve(node.Literal())
+
+	case ast.NodeFunction:
+		function, ok := node.(ast.Function)
+		if !ok {
+			return "", fmt.Errorf("AST node has ast.NodeFunction type but could not be converted to an ast.Function: %s", node)
+		}
+		fn, ok := builtins.Get(function.Name.Name)
+		if !ok {
+			return "", fmt.Errorf("builtin function undefined: %s", function.Name.Name)
+		}
+		args := make([]string, 0, len(function.Arguments))
+		for _, arg := range function.Arguments {
+			val, err := e.eval(arg)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, val)
+		}
+		val, err := fn(e.file.builtins(), args...)
+		if err != nil {
+			return "", fmt.Errorf("builtin function %s returned an error: %s", function.Name.Name, err)
+		}
+		return val, nil
+
+	default:
+		return "", fmt.Errorf("unexpected node in assignment %s: %s", node.Type(), node)
+	}
+}
+
+// interpolate expands any template references to other variables in a
+// string e.g. "{{.ROOT}}/bin".
+func (e *evaluator) interpolate(text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	refs, err := task.Refs(text)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ref := range refs {
+		if _, err := e.resolve(ref); err != nil {
+			return "", err
+		}
+	}
+
+	tmp, err := template.New("var").Funcs(builtins.FuncMap(e.file.builtins())).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	out := &bytes.Buffer{}
+	if err := tmp.Execute(out, e.file.Vars); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
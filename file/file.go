@@ -2,21 +2,26 @@
 package file
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
-	"github.com/lithammer/fuzzysearch/fuzzy"
+	"github.com/joho/godotenv"
 	"go.followtheprocess.codes/collections/dag"
 	"go.followtheprocess.codes/spok/ast"
 	"go.followtheprocess.codes/spok/builtins"
 	"go.followtheprocess.codes/spok/cache"
+	"go.followtheprocess.codes/spok/event"
 	"go.followtheprocess.codes/spok/hash"
 	"go.followtheprocess.codes/spok/iostream"
 	"go.followtheprocess.codes/spok/logger"
@@ -25,17 +30,125 @@ import (
 	"golang.org/x/exp/maps"
 )
 
+// errDeferred is returned by the lookup tasks are first built with when a condition
+// needs a variable that can't be evaluated without calling a builtin, the task is then
+// built again once a run is being prepared, see Evaluate.
+var errDeferred = errors.New("deferred until the spokfile is run")
+
 // NAME is the canonical spok file name.
 const NAME = "spokfile"
 
+// ShellVar is the name of the variable a spokfile sets to choose the shell
+// it's commands are run with by default e.g. SPOK_SHELL := "bash".
+const ShellVar = "SPOK_SHELL"
+
+// Kinds of error returned from a SpokFile that callers can tell apart with errors.Is, these
+// are joined to the error that actually happened so it's message is unchanged.
+var (
+	ErrNoTask = errors.New("no such task")     // A requested task or tag doesn't exist or can't be run directly
+	ErrCache  = errors.New("spok cache error") // The spok cache couldn't be read or written
+)
+
+// kindError is an error that is also one of the error kinds above, but
+// with the message of just the underlying error.
+type kindError struct {
+	err  error // The error that happened
+	kind error // The kind of error it is e.g. ErrNoTask
+}
+
+// Error implements error for a kindError.
+func (k kindError) Error() string {
+	return k.err.Error()
+}
+
+// Unwrap allows errors.Is and errors.As to match both the error and it's kind.
+func (k kindError) Unwrap() []error {
+	return []error{k.err, k.kind}
+}
+
+// skipDirs are directories that are never searched for nested spokfiles, hidden
+// directories (e.g. .git, .spok) are also skipped.
+var skipDirs = map[string]bool{
+	"node_modules": true,
+	"testdata":     true,
+	"vendor":       true,
+}
+
+// Origin describes where the value of a spokfile variable came from.
+type Origin int
+
+const (
+	OriginSpokfile Origin = iota // Declared as a string literal in the spokfile
+	OriginBuiltin                // The result of calling a builtin function
+	OriginCLI                    // Overridden on the command line
+	OriginEnv                    // Loaded from a .env file
+	OriginProcess                // Set in the environment spok was run in, which beats the spokfile
+)
+
+// String returns the human readable name of the origin, as shown in --vars.
+func (o Origin) String() string {
+	switch o {
+	case OriginSpokfile:
+		return "spokfile"
+	case OriginBuiltin:
+		return "builtin"
+	case OriginCLI:
+		return "CLI"
+	case OriginEnv:
+		return "env"
+	case OriginProcess:
+		return "environment"
+	default:
+		return fmt.Sprintf("Origin(%d)", int(o))
+	}
+}
+
 // SpokFile represents a concrete spokfile.
 type SpokFile struct {
-	logger logger.Logger        // Shared logger
-	Vars   map[string]string    // Global variables in IDENT: value form (functions already evaluated)
-	Tasks  map[string]task.Task // Map of task name to the task itself
-	Globs  map[string][]string  // Map of glob pattern to their concrete filepaths (avoids recalculating)
-	Path   string               // The absolute path to the spokfile
-	Dir    string               // The directory under which the spokfile sits
+	logger    logger.Logger        // Shared logger
+	origins   map[string]Origin    // Where each of the Vars came from
+	overrides map[string]string    // Variables overridden on the command line, folded into task digests
+	eval      *evaluator           // Lazily evaluates the global variables as they're needed
+	disabled  map[string]task.Task // Tasks whose condition is false here, kept only for error messages
+	deferred  []ast.Task           // Tasks with conditions that may only be evaluated when run, see Evaluate
+	listed    map[string]bool      // Names of the deferred tasks listed in Tasks until Evaluate decides
+	names     []string             // Names of all the global variables, including overrides
+	shellLazy bool                 // Whether ShellVar is yet to be evaluated, see Evaluate
+	Vars      map[string]string    // Global variables in IDENT: value form, only those evaluated so far (see Var)
+	Tasks     map[string]task.Task // Map of task name to the task itself
+	Aliases   map[string]string    // Map of task alias to the name of the task it stands for (if any)
+	Globs     map[string][]string  // Map of glob pattern to their concrete filepaths (avoids recalculating)
+	Dotenv    map[string]string    // Variables loaded from a .env file alongside the spokfile (if any)
+	Path      string               // The absolute path to the spokfile
+	Shell     string               // The shell commands run with unless a task says otherwise, from ShellVar, empty if not set (see Evaluate)
+	Dir       string               // The directory under which the spokfile sits
+}
+
+// Origin returns where the value of the variable 'name' came from.
+func (s *SpokFile) Origin(name string) Origin {
+	_, origin := s.Effective(name)
+	return origin
+}
+
+// Effective returns the value task commands see for the variable 'name', declared in the
+// spokfile or it's .env, and where that value came from. See Env for the precedence.
+func (s *SpokFile) Effective(name string) (string, Origin) {
+	if origin, ok := s.origins[name]; ok && origin == OriginCLI {
+		return s.Vars[name], OriginCLI
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return value, OriginProcess
+	}
+	if value, ok := s.Vars[name]; ok {
+		if origin, ok := s.origins[name]; ok {
+			return value, origin
+		}
+		return value, OriginSpokfile
+	}
+	if value, ok := s.Dotenv[name]; ok {
+		return value, OriginEnv
+	}
+	return "", OriginSpokfile
 }
 
 // HasTask returns whether or not the SpokFile has a task with the given name.
@@ -44,6 +157,61 @@ func (s *SpokFile) HasTask(name string) bool {
 	return ok
 }
 
+// Lookup returns the task with the given name or alias.
+func (s *SpokFile) Lookup(name string) (task.Task, bool) {
+	t, ok := s.Tasks[s.resolve(name)]
+	return t, ok
+}
+
+// Tags returns the names of all the tags used by the spokfile's tasks, sorted. As
+// with Tagged, private tasks are not included.
+func (s *SpokFile) Tags() []string {
+	var tags []string
+	for _, t := range s.Tasks {
+		if t.Private {
+			continue
+		}
+		for _, tag := range t.Tags {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Tagged returns the names of the tasks with the given tag, sorted. Private tasks
+// are never included as they may only be run as a dependency.
+//
+// It is an error if no task has the tag.
+func (s *SpokFile) Tagged(tag string) ([]string, error) {
+	var names []string
+	for _, t := range s.Tasks {
+		if !t.Private && slices.Contains(t.Tags, tag) {
+			names = append(names, t.Name)
+		}
+	}
+	if len(names) == 0 {
+		if closest := task.ClosestMatch(tag, s.Tags()); closest != "" {
+			return nil, kindError{err: fmt.Errorf("spokfile has no tasks tagged %q. Did you mean %q?", tag, closest), kind: ErrNoTask}
+		}
+		return nil, kindError{err: fmt.Errorf("spokfile has no tasks tagged %q", tag), kind: ErrNoTask}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// resolve returns the name of the task that 'name' refers to, which is
+// name itself unless it's an alias.
+func (s *SpokFile) resolve(name string) string {
+	if target, ok := s.Aliases[name]; ok {
+		s.logger.Debug("Resolved alias %s to task %s", name, target)
+		return target
+	}
+	return name
+}
+
 // hasGlob returns whether or not the SpokFile has already expanded a glob pattern.
 func (s *SpokFile) hasGlob(pattern string) bool {
 	expanded, ok := s.Globs[pattern]
@@ -56,16 +224,125 @@ func (s *SpokFile) hasGlob(pattern string) bool {
 	return true
 }
 
-// Env returns the spokfile Vars as a string slice of KEY=VALUE format
-// so it may be passed to running task commands.
+// Var returns the value of the global variable 'name', evaluating it
+// (and anything it depends on) if it hasn't been already.
+func (s *SpokFile) Var(name string) (string, error) {
+	if s.eval == nil {
+		val, ok := s.Vars[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %q", name)
+		}
+		return val, nil
+	}
+	return s.eval.resolve(name)
+}
+
+// Resolve evaluates every global variable in the spokfile, after which
+// Vars is fully populated.
+func (s *SpokFile) Resolve() error {
+	if s.eval == nil {
+		return nil
+	}
+	return s.eval.resolveAll()
+}
+
+// prepare evaluates the global variables a task needs in order to run and returns a
+// copy of the task with it's command templates executed and it's Dir resolved against
+// the spokfile's directory.
+//
+// Every global variable is exported to the command environment, so a task needs all of
+// them, whether or not it's commands mention them, scripts they call may rely on them.
+// Each is still only evaluated once and only when a task is about to run, so e.g. --show
+// never evaluates anything.
+func (s *SpokFile) prepare(t task.Task) (task.Task, error) {
+	if err := s.Resolve(); err != nil {
+		return task.Task{}, err
+	}
+
+	files := make([]string, 0, len(t.FileDependencies))
+	for _, pattern := range t.GlobDependencies {
+		files = append(files, s.Globs[pattern]...)
+	}
+	files = append(files, t.FileDependencies...)
+
+	// Commands run from the spokfile's directory so a task behaves the same
+	// no matter where spok is invoked from
+	if !filepath.IsAbs(t.Dir) {
+		t.Dir = filepath.Join(s.Dir, t.Dir)
+	}
+
+	ctx := task.Context{
+		Vars:  s.Vars,
+		Dir:   s.Dir,
+		Path:  s.Path,
+		Files: files,
+		Env:   s.dotenv(),
+	}
+
+	return t.Expand(ctx)
+}
+
+// Env returns the evaluated spokfile Vars and any variables loaded from the spokfile's
+// .env as a string slice of KEY=VALUE format, to be set on top of the process environment
+// of running task commands.
+//
+// Variables overridden on the command line beat everything, then the process environment,
+// then the spokfile's own Vars and lastly it's .env, which only fills in what isn't already
+// set, the same as godotenv.Load.
 func (s *SpokFile) Env() []string {
-	results := make([]string, 0, len(s.Vars))
+	results := make([]string, 0, len(s.Vars)+len(s.Dotenv))
 	for key, val := range s.Vars {
+		if _, origin := s.Effective(key); origin == OriginProcess {
+			continue
+		}
+		results = append(results, key+"="+val)
+	}
+	for key, val := range s.Dotenv {
+		if s.declared(key) {
+			// The spokfile's own variable wins, even if it's not been evaluated
+			continue
+		}
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
 		results = append(results, key+"="+val)
 	}
 	return results
 }
 
+// declared reports whether name is a variable of the spokfile's own, whether it's been
+// evaluated or not.
+func (s *SpokFile) declared(name string) bool {
+	if _, ok := s.Vars[name]; ok {
+		return true
+	}
+	if s.eval == nil {
+		return false
+	}
+	_, ok := s.eval.assigns[name]
+	return ok
+}
+
+// dotenv returns the variables loaded from the spokfile's .env in KEY=VALUE form,
+// sorted by key, leaving out any already set in the process environment.
+func (s *SpokFile) dotenv() []string {
+	dotenv := make([]string, 0, len(s.Dotenv))
+	for key, val := range s.Dotenv {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		dotenv = append(dotenv, key+"="+val)
+	}
+	sort.Strings(dotenv)
+	return dotenv
+}
+
+// builtins returns the context builtins are called from in this spokfile, so relative
+// paths are relative to it and it's .env is part of the environment.
+func (s *SpokFile) builtins() builtins.Context {
+	return builtins.Context{Dir: s.Dir, Env: s.dotenv()}
+}
+
 // expandGlobs gathers up all the glob patterns in every task in the spokfile and expands them
 // saving the results to the Globs map as e.g. {"**/*.go": ["file1.go", "file2.go"]}.
 func (s *SpokFile) expandGlobs() error {
@@ -101,15 +378,13 @@ func (s *SpokFile) buildGraph(graph *dag.Graph[string, task.Task], requested ...
 	var next []string // Next tasks to run through this loop
 
 	for _, name := range requested {
+		name = s.resolve(name)
+		if err := s.expand(name); err != nil {
+			return nil, err
+		}
 		requestedTask, ok := s.Tasks[name]
 		if !ok {
-			closest := s.findClosestMatch(name)
-			err := fmt.Errorf("spokfile has no task %q", name)
-			if closest != "" {
-				// We have a close enough match to do a "did you mean X?"
-				err = fmt.Errorf("spokfile has no task %q. Did you mean %q?", name, closest)
-			}
-			return nil, err
+			return nil, s.noTask(name)
 		}
 		// Add the task as a vertex to the graph if it doesn't already exist
 		if !graph.ContainsVertex(name) {
@@ -119,11 +394,28 @@ func (s *SpokFile) buildGraph(graph *dag.Graph[string, task.Task], requested ...
 			}
 		}
 
-		// For all of this tasks dependencies, do the same
+		// Dependencies on tasks that don't apply here are dropped, so a task can
+		// depend on e.g. the install task for every platform
+		deps := make([]string, 0, len(requestedTask.TaskDependencies))
 		for _, dep := range requestedTask.TaskDependencies {
+			dep = s.resolve(dep)
+			if err := s.expand(dep); err != nil {
+				return nil, err
+			}
+			if _, ok := s.Tasks[dep]; !ok {
+				if _, ok := s.disabled[dep]; ok {
+					s.logger.Debug("Task %s depends on task %s which does not apply, skipping", requestedTask.Name, dep)
+					continue
+				}
+			}
+			deps = append(deps, dep)
+		}
+
+		// For all of this tasks dependencies, do the same
+		for _, dep := range deps {
 			depTask, ok := s.Tasks[dep]
 			if !ok {
-				closest := s.findClosestMatch(dep)
+				closest := s.findClosestMatch(dep, true)
 				err := fmt.Errorf("task %q declares a dependency on task %q, which does not exist", requestedTask.Name, dep)
 				if closest != "" {
 					// We have a close enough match to do a "did you mean X?"
@@ -146,18 +438,54 @@ func (s *SpokFile) buildGraph(graph *dag.Graph[string, task.Task], requested ...
 			if err != nil {
 				return nil, fmt.Errorf("could not add edge %s -> %s: %w", dep, name, err)
 			}
-
-			next = requestedTask.TaskDependencies // Repeat for dependencies
 		}
+
+		next = append(next, deps...) // Repeat for dependencies
 	}
 
 	return s.buildGraph(graph, next...)
 }
 
-// Run runs the specified tasks, it takes force which is a boolean flag set by the CLI which
-// always reruns tasks and an io.Writer which is used only to echo the commands being run, the command's stdout and stderr
+// RunOptions control how Run goes about running tasks, the zero value is the default behaviour.
+type RunOptions struct {
+	Events    *event.Writer   // Where events are emitted as the tasks run, nil for none, the --events flag
+	Output    iostream.Output // How each task's output is written to the stream, the --output flag
+	Force     bool            // Always run tasks, even if none of their dependencies have changed, the --force flag
+	Label     string          // The spokfile's directory in a run across several e.g. "services/api", shown in the output and events, empty for none
+	KeepGoing bool            // Keep running every task whose dependencies succeeded after a failure, the --keep-going flag
+}
+
+// address returns what a task called name is shown as in the output, it's address
+// if the options have a Label or just it's name if not.
+func (o RunOptions) address(name string) string {
+	if o.Label == "" {
+		return name
+	}
+	return o.Label + ":" + name
+}
+
+// Run runs the specified tasks, it takes options which are set by the CLI e.g. to always rerun tasks,
+// and an io.Writer which is used only to echo the commands being run, the command's stdout and stderr
 // is stored in the result.
-func (s *SpokFile) Run(stream iostream.IOStream, runner shell.Runner, force bool, tasks ...string) (task.Results, error) {
+//
+// By default the run stops after the first task that fails, with KeepGoing set any tasks
+// downstream of a failure are instead reported as blocked by it and everything else runs.
+//
+// If the run stops with an error part way through, the results of the tasks that did run
+// (including any finally tasks) are returned along with it.
+func (s *SpokFile) Run(ctx context.Context, stream iostream.IOStream, runner shell.Runner, options RunOptions, tasks ...string) (task.Results, error) {
+	if options.Label != "" {
+		options.Events = options.Events.For(options.Label)
+	}
+	if err := s.Evaluate(); err != nil {
+		return nil, err
+	}
+	for _, name := range tasks {
+		if err := s.Check(name); err != nil {
+			return nil, err
+		}
+	}
+
 	// Perform glob expansion for every glob pattern in the whole file and save
 	// the list of filepaths to the Globs map
 	if err := s.expandGlobs(); err != nil {
@@ -183,18 +511,89 @@ func (s *SpokFile) Run(stream iostream.IOStream, runner shell.Runner, force bool
 	}
 	s.logger.Debug("Calculated topological sort of dependency graph %v in %v", names, time.Since(sortStart))
 
-	// Submit the run order to be executed and gather up the results
-	results, err := s.run(stream, runner, force, runOrder)
+	// Only now do we know which tasks will run, so evaluate the variables they need
+	for i, taskToRun := range runOrder {
+		prepared, err := s.prepare(taskToRun)
+		if err != nil {
+			return nil, err
+		}
+		runOrder[i] = prepared
+	}
+
+	// Finally tasks are prepared up front too, so a mistake in one is
+	// found before anything runs rather than when it's needed
+	finalisers, err := s.prepareFinally(runOrder)
 	if err != nil {
 		return nil, err
 	}
 
-	return results, nil
+	finally := maps.Keys(finalisers)
+	sort.Strings(finally)
+	options.Events.Emit(event.GraphBuilt{Tasks: names, Finally: finally})
+
+	// Submit the run order to be executed and gather up the results
+	return s.run(ctx, stream, runner, options, plan{order: runOrder, finalisers: finalisers})
+}
+
+// plan is a prepared set of tasks ready to be run.
+type plan struct {
+	finalisers map[string]task.Task // The finally tasks of any task in order, by name
+	order      []task.Task          // The tasks to run, in order
+}
+
+// prepareFinally looks up and prepares the finally tasks declared by the tasks in
+// runOrder, returning them by name.
+//
+// A finally task only ever runs it's own commands, so it may not depend on other tasks.
+func (s *SpokFile) prepareFinally(runOrder []task.Task) (map[string]task.Task, error) {
+	finalisers := make(map[string]task.Task)
+	for _, t := range runOrder {
+		for _, name := range t.Finally {
+			name = s.resolve(name)
+			if _, ok := finalisers[name]; ok {
+				continue
+			}
+			finaliser, ok := s.Tasks[name]
+			if !ok {
+				if _, ok := s.disabled[name]; ok {
+					s.logger.Debug("Task %s has finally task %s which does not apply, skipping", t.Name, name)
+					continue
+				}
+				closest := s.findClosestMatch(name, true)
+				if closest != "" {
+					return nil, fmt.Errorf("task %q declares a finally task %q, which does not exist. Did you mean %q?", t.Name, name, closest)
+				}
+				return nil, fmt.Errorf("task %q declares a finally task %q, which does not exist", t.Name, name)
+			}
+			if len(finaliser.TaskDependencies) != 0 {
+				return nil, fmt.Errorf("task %q is used as a finally task so can't depend on other tasks", name)
+			}
+			prepared, err := s.prepare(finaliser)
+			if err != nil {
+				return nil, err
+			}
+			finalisers[name] = prepared
+		}
+	}
+	return finalisers, nil
 }
 
 // run is the implementation of the public Run method.
-func (s *SpokFile) run(stream iostream.IOStream, runner shell.Runner, force bool, runOrder []task.Task) (task.Results, error) {
+//
+// Once a task with finally tasks starts running, they're added to the pending finalisers
+// which are run, most recent first, after everything else. They run even if a task failed
+// or the run was interrupted through ctx, so they can always clean up.
+func (s *SpokFile) run(ctx context.Context, stream iostream.IOStream, runner shell.Runner, options RunOptions, p plan) (task.Results, error) {
+	runOrder := p.order
+	force := options.Force
 	results := make(task.Results, 0, len(runOrder))
+	var (
+		pending []string // Names of the finally tasks to run once everything else is done
+		runErr  error    // The error that stopped the run early, if any
+	)
+
+	// Tasks that failed or were blocked, by name, to the name of the task that failed
+	failed := make(map[string]string)
 
 	cachePath := filepath.Join(s.Dir, cache.Path)
 	if !cache.Exists(cachePath) {
@@ -202,13 +601,13 @@ func (s *SpokFile) run(stream iostream.IOStream, runner shell.Runner, force bool
 		// so just dump a placeholder cache in with all the task names and empty digest entries
 		s.logger.Debug("Spok cache at %s not found, initialising new cache", cachePath)
 		if err := cache.Init(cachePath, maps.Keys(s.Tasks)...); err != nil {
-			return nil, err
+			return nil, kindError{err: err, kind: ErrCache}
 		}
 	}
 
 	cachedState, err := cache.Load(cachePath)
 	if err != nil {
-		return nil, fmt.Errorf("could not load spok cache file at %q: %s", cachePath, err)
+		return nil, kindError{err: fmt.Errorf("could not load spok cache file at %q: %s", cachePath, err), kind: ErrCache}
 	}
 
 	// Whether or not we want to update the cache after running e.g.
@@ -217,6 +616,18 @@ func (s *SpokFile) run(stream iostream.IOStream, runner shell.Runner, force bool
 	updateCache := true
 
 	for _, taskToRun := range runOrder {
+		if runErr != nil {
+			break
+		}
+
+		if blocker := s.blocker(taskToRun, failed); blocker != "" {
+			s.logger.Debug("Task %s blocked by failed task %s", taskToRun.Name, blocker)
+			failed[taskToRun.Name] = blocker
+			results = append(results, task.Result{Task: taskToRun.Name, BlockedBy: blocker})
+			options.Events.Emit(event.TaskSkipped{Task: taskToRun.Name, BlockedBy: blocker})
+			continue
+		}
+
 		// Gather up all the files to be hashed into a single slice
 		var toHash []string
 
@@ -249,10 +660,15 @@ func (s *SpokFile) run(stream iostream.IOStream, runner shell.Runner, force bool
 		hashStart := time.Now()
 		currentDigest, err := hasher.Hash(toHash)
 		if err != nil {
-			return nil, err
+			runErr = err
+			break
 		}
 		s.logger.Debug("Calculated digest of %d files in %v", len(toHash), time.Since(hashStart))
 
+		if !force {
+			currentDigest = s.digestOverrides(currentDigest)
+		}
+
 		// By the time we get here, we know the cache file will exist (even if it has no digests)
 		// so we can go ahead and load as normal. If a task is not in the cache, it means it was
 		// added to the spokfile since we last ran a cache, so add it to the current cachedState
@@ -263,8 +679,7 @@ func (s *SpokFile) run(stream iostream.IOStream, runner shell.Runner, force bool
 
 		s.logger.Debug("Task %s current checksum: %.15s cached checksum: %.15s", taskToRun.Name, currentDigest, cachedDigest)
 
-		var result shell.Results
-		skipped := false
+		result := task.Result{Task: taskToRun.Name}
 
 		switch {
 		case cachedDigest == "" || currentDigest != cachedDigest:
@@ -273,48 +688,223 @@ func (s *SpokFile) run(stream iostream.IOStream, runner shell.Runner, force bool
 			if updateCache {
 				cachedState.Set(taskToRun.Name, currentDigest)
 			}
-			result, err = taskToRun.Run(runner, stream, s.Env())
+			for _, name := range taskToRun.Finally {
+				name = s.resolve(name)
+				if _, ok := p.finalisers[name]; ok && !slices.Contains(pending, name) {
+					pending = append(pending, name)
+				}
+			}
+			result, err = s.runTask(ctx, taskToRun, runner, stream, options)
 			if err != nil {
-				return nil, fmt.Errorf("task %q encountered an error: %w", taskToRun.Name, err)
+				runErr = fmt.Errorf("task %q encountered an error: %w", taskToRun.Name, err)
 			}
 
 		case currentDigest == cachedDigest:
 			// This task has been run before and its digest has not changed, therefore
 			// we don't need to run it again
-			skipped = true
+			result.Skipped = true
 			updateCache = false
+			options.Events.Emit(event.TaskSkipped{Task: taskToRun.Name})
+		}
+
+		// A task that stopped with an error has no result to gather
+		if runErr != nil {
+			break
 		}
 
 		// Gather up all the task results
-		results = append(results, task.Result{CommandResults: result, Task: taskToRun.Name, Skipped: skipped})
+		results = append(results, result)
+
+		if !result.Ok() {
+			failed[taskToRun.Name] = taskToRun.Name
+			if !options.KeepGoing {
+				s.logger.Debug("Task %s failed, stopping", taskToRun.Name)
+				break
+			}
+		}
 	}
 
 	// Only update the cache if force was not set, the task declares file dependencies
 	// and the task run was successful
-	if !force && updateCache && results.Ok() {
+	if runErr == nil && !force && updateCache && results.Ok() {
 		s.logger.Debug("Updating cached state")
 		if err := cachedState.Dump(cachePath); err != nil {
-			return nil, err
+			runErr = kindError{err: err, kind: ErrCache}
 		}
 	}
 
-	return results, nil
+	// Finally tasks run whatever happened above, most recent first
+	for i := len(pending) - 1; i >= 0; i-- {
+		finaliser := p.finalisers[pending[i]]
+		s.logger.Debug("Running finally task %s", finaliser.Name)
+
+		// Without cancel so that they still run if spok was interrupted
+		result, err := s.runTask(context.WithoutCancel(ctx), finaliser, runner, stream, options)
+		if err != nil {
+			runErr = errors.Join(runErr, fmt.Errorf("finally task %q encountered an error: %w", finaliser.Name, err))
+			continue
+		}
+		result.Finally = true
+		results = append(results, result)
+	}
+
+	// Whatever did run, e.g. the finally tasks, is returned even if the run failed
+	return results, runErr
+}
+
+// runTask runs t with runner, unless it chose it's own shell, writing it's output to stream
+// in the output mode and emitting events from the options.
+func (s *SpokFile) runTask(ctx context.Context, t task.Task, runner shell.Runner, stream iostream.IOStream, options RunOptions) (task.Result, error) {
+	runner, err := runnerFor(t, runner)
+	if err != nil {
+		return task.Result{}, err
+	}
+
+	// Interactive tasks need the real terminal
+	output := options.Output
+	if t.Interactive {
+		output = iostream.Raw
+	}
+
+	options.Events.Emit(event.TaskStarted{Task: t.Name})
+	start := time.Now()
+
+	taskStream, flush := stream.ForTask(options.address(t.Name), output)
+	result, err := t.Run(ctx, runner, taskStream, s.Env(), options.Events)
+	err = errors.Join(err, flush())
+
+	options.Events.Emit(event.TaskFinished{Task: t.Name, Duration: time.Since(start), Ok: err == nil && result.Ok()})
+	return result, err
+}
+
+// runnerFor returns the runner to run t's commands with, which is runner unless
+// the task chose it's own shell.
+func runnerFor(t task.Task, runner shell.Runner) (shell.Runner, error) {
+	if t.Shell == "" {
+		return runner, nil
+	}
+	return shell.NewRunner(t.Shell)
+}
+
+// blocker returns the name of the failed task that means t can't run, or an
+// empty string if all of t's dependencies succeeded. failed maps each task
+// that failed or was blocked to the task that failed.
+func (s *SpokFile) blocker(t task.Task, failed map[string]string) string {
+	for _, dep := range t.TaskDependencies {
+		if cause, ok := failed[s.resolve(dep)]; ok {
+			return cause
+		}
+	}
+	return ""
+}
+
+// digestOverrides folds any command line variable overrides into a task's digest
+// so that changing them causes the task to re-run.
+func (s *SpokFile) digestOverrides(digest string) string {
+	if len(s.overrides) == 0 {
+		return digest
+	}
+
+	names := maps.Keys(s.overrides)
+	sort.Strings(names)
+
+	hash := sha256.New()
+	hash.Write([]byte(digest))
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s=%s\n", name, s.overrides[name])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Check returns an error (an ErrNoTask) if the task called name can't be run directly,
+// either because the spokfile has no such task, it doesn't apply here or it's private.
+func (s *SpokFile) Check(name string) error {
+	if err := s.Evaluate(); err != nil {
+		return err
+	}
+	if err := s.expand(s.resolve(name)); err != nil {
+		return err
+	}
+	requested, ok := s.Lookup(name)
+	if !ok {
+		return s.noTask(s.resolve(name))
+	}
+	// Private tasks are helpers that only make sense as a dependency of something else
+	if requested.Private {
+		return kindError{err: fmt.Errorf("task %q is private, it can only be run as a dependency of another task", name), kind: ErrNoTask}
+	}
+	return nil
+}
+
+// expand expands the matrix task called name, or the one it's an instance of e.g. build
+// for build[linux], into one task per combination of it's variables the first time it's
+// needed. Until then the matrix variables aren't evaluated, so e.g. --show doesn't run
+// an exec in one.
+//
+// The matrix task itself is kept so it can still be run (or depended on) by name,
+// doing nothing but depending on all of it's instances.
+func (s *SpokFile) expand(name string) error {
+	if parent, _, ok := strings.Cut(name, "["); ok {
+		name = parent
+	}
+	matrix, ok := s.Tasks[name]
+	if !ok || len(matrix.Matrix) == 0 {
+		return nil
+	}
+
+	instances, err := matrix.Instances(s.Var)
+	if err != nil {
+		return err
+	}
+
+	matrix.TaskDependencies = nil
+	matrix.FileDependencies = nil
+	matrix.GlobDependencies = nil
+	matrix.Commands = nil
+	matrix.Matrix = nil
+	for _, instance := range instances {
+		if err := s.addTask(instance); err != nil {
+			return err
+		}
+		matrix.TaskDependencies = append(matrix.TaskDependencies, instance.Name)
+	}
+	s.Tasks[name] = matrix
+	s.logger.Debug("Expanded matrix task %s into %d instances", name, len(instances))
+	return nil
+}
+
+// noTask returns the error for the task called name that isn't in the spokfile,
+// saying why if it doesn't apply here and suggesting the closest match otherwise.
+func (s *SpokFile) noTask(name string) error {
+	if disabled, ok := s.disabled[name]; ok {
+		return kindError{err: fmt.Errorf("task %q does not apply here, it only runs if %s", name, disabled.Condition), kind: ErrNoTask}
+	}
+	// Private tasks can't be run directly so there's no point suggesting one
+	closest := s.findClosestMatch(name, false)
+	err := fmt.Errorf("spokfile has no task %q", name)
+	if closest != "" {
+		// We have a close enough match to do a "did you mean X?"
+		err = fmt.Errorf("spokfile has no task %q. Did you mean %q?", name, closest)
+	}
+	return kindError{err: err, kind: ErrNoTask}
 }
 
 // findClosestMatch takes the name of a task contained in the spokfile
 // and finds the closest matching task. If no matches are found, an empty string is returned.
-func (s *SpokFile) findClosestMatch(task string) string {
-	names := make([]string, 0, len(s.Tasks))
+//
+// Aliases are matched as well as task names, private tasks are only considered
+// if private is true.
+func (s *SpokFile) findClosestMatch(name string, private bool) string {
+	names := make([]string, 0, len(s.Tasks)+len(s.Aliases))
 	for _, t := range s.Tasks {
+		if t.Private && !private {
+			continue
+		}
 		names = append(names, t.Name)
+		names = append(names, t.Aliases...)
 	}
-	matches := fuzzy.RankFindNormalizedFold(task, names)
-	sort.Sort(matches)
-	if len(matches) != 0 {
-		return matches[0].Target
-	}
-
-	return ""
+	return task.ClosestMatch(name, names)
 }
 
 // Find climbs the file tree from 'start' to 'stop' looking for a spokfile,
@@ -345,92 +935,330 @@ func Find(logger logger.Logger, start, stop string) (string, error) {
 	}
 }
 
+// FindAll walks the file tree beneath 'root' and returns the absolute paths
+// of every spokfile it finds, in lexical order. This is how spok discovers
+// the spokfiles in a monorepo.
+//
+// Hidden directories and those in skipDirs are not searched.
+func FindAll(logger logger.Logger, root string) ([]string, error) {
+	var found []string
+	walkFn := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && (strings.HasPrefix(d.Name(), ".") || skipDirs[d.Name()]) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == NAME {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("could not resolve '%s': %w", path, err)
+			}
+			logger.Debug("Found spokfile at %s", abs)
+			found = append(found, abs)
+		}
+		return nil
+	}
+
+	if err := filepath.WalkDir(root, walkFn); err != nil {
+		return nil, fmt.Errorf("could not search '%s' for spokfiles: %w", root, err)
+	}
+
+	if len(found) == 0 {
+		return nil, errors.New("no spokfile found")
+	}
+
+	return found, nil
+}
+
+// Declared returns the names of the global variables declared in a parsed spok AST,
+// in the order they're declared.
+func Declared(tree ast.Tree) []string {
+	var names []string
+	for _, node := range tree.Nodes {
+		if assign, ok := node.(ast.Assign); ok {
+			names = append(names, assign.Name.Name)
+		}
+	}
+	return names
+}
+
 // New converts a parsed spok AST into a concrete File object,
 // root is the absolute path to the directory to use as root for glob
 // expansion, typically the path to the directory the spokfile sits in.
-func New(tree ast.Tree, root string, logger logger.Logger) (*SpokFile, error) {
+//
+// overrides are variables set on the command line, these take precedence over
+// any value assigned in the spokfile and may be nil. Overriding a variable the
+// spokfile doesn't declare is an error, as it would otherwise change nothing.
+func New(tree ast.Tree, root string, logger logger.Logger, overrides map[string]string) (*SpokFile, error) {
+	declared := Declared(tree)
+	overridden := make([]string, 0, len(overrides))
+	for name := range overrides {
+		overridden = append(overridden, name)
+	}
+	sort.Strings(overridden)
+	for _, name := range overridden {
+		if slices.Contains(declared, name) {
+			continue
+		}
+		if closest := task.ClosestMatch(name, declared); closest != "" {
+			return nil, fmt.Errorf("cannot override variable %q, the spokfile does not declare it. Did you mean %q?", name, closest)
+		}
+		return nil, fmt.Errorf("cannot override variable %q, the spokfile does not declare it", name)
+	}
+
 	file := SpokFile{
-		logger: logger,
-		Path:   filepath.Join(root, NAME),
-		Dir:    root,
-		Vars:   make(map[string]string),
-		Tasks:  make(map[string]task.Task),
-		Globs:  make(map[string][]string),
+		logger:    logger,
+		origins:   make(map[string]Origin),
+		overrides: overrides,
+		Path:      filepath.Join(root, NAME),
+		Dir:       root,
+		Vars:      make(map[string]string),
+		Tasks:     make(map[string]task.Task),
+		Globs:     make(map[string][]string),
+		disabled:  make(map[string]task.Task),
+		listed:    make(map[string]bool),
 	}
 
+	// Overrides are set up front so every task sees them regardless
+	// of where the variable is declared
+	for name, value := range overrides {
+		file.Vars[name] = value
+		file.origins[name] = OriginCLI
+		logger.Debug("Variable %s overridden on the command line", name)
+	}
+
+	// Each spokfile gets its own .env (if present) so that in a monorepo,
+	// nested spokfiles don't leak variables into one another
+	dotenvPath := filepath.Join(root, ".env")
+	if _, err := os.Stat(dotenvPath); err == nil {
+		dotenv, err := godotenv.Read(dotenvPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load .env file: %w", err)
+		}
+		file.Dotenv = dotenv
+		logger.Debug("Loaded .env file at %s", dotenvPath)
+	}
+
+	// Globals may reference one another in any order so they're all declared
+	// up front, nothing is evaluated until something needs it
+	eval := newEvaluator(&file)
+	file.eval = eval
 	for _, node := range tree.Nodes {
-		switch {
-		case node.Type() == ast.NodeAssign:
-			assign, ok := node.(ast.Assign)
-			if !ok {
-				return nil, fmt.Errorf("AST node has ast.NodeAssign type but could not be converted to an ast.Assign: %s", node)
-			}
-			switch {
-			case assign.Value.Type() == ast.NodeString:
-				file.Vars[assign.Name.Name] = assign.Value.Literal()
-
-			case assign.Value.Type() == ast.NodeFunction:
-				function, ok := assign.Value.(ast.Function)
-				if !ok {
-					return nil, fmt.Errorf("AST node has ast.NodeFunction type but could not be converted to an ast.Function: %s", assign.Value)
-				}
-				args := make([]string, 0, len(function.Arguments))
-				for _, arg := range function.Arguments {
-					if arg.Type() != ast.NodeString {
-						return nil, fmt.Errorf("spok builtin functions take only string arguments, got %s", arg.Type())
-					}
-					args = append(args, arg.Literal())
-				}
-				fn, ok := builtins.Get(function.Name.Name)
-				if !ok {
-					return nil, fmt.Errorf("builtin function undefined: %s", function.Name.Name)
-				}
-				val, err := fn(args...)
-				if err != nil {
-					return nil, fmt.Errorf("builtin function %s returned an error: %s", function.Name.Name, err)
-				}
-				// Assign the value to the variable
-				file.Vars[assign.Name.Name] = val
+		if node.Type() != ast.NodeAssign {
+			continue
+		}
+		assign, ok := node.(ast.Assign)
+		if !ok {
+			return nil, fmt.Errorf("AST node has ast.NodeAssign type but could not be converted to an ast.Assign: %s", node)
+		}
+		if _, ok := overrides[assign.Name.Name]; ok {
+			// Overridden on the command line, nothing to evaluate
+			continue
+		}
+		if err := eval.declare(assign); err != nil {
+			return nil, err
+		}
+	}
 
-			default:
-				return nil, fmt.Errorf("unexpected node in assignment %s: %s", assign.Value.Type(), assign.Value)
-			}
+	if err := eval.check(); err != nil {
+		return nil, err
+	}
 
+	// Tasks may only reference variables that exist, it doesn't matter
+	// whether they've been evaluated yet
+	names := make([]string, 0, len(eval.order)+len(overrides))
+	names = append(names, eval.order...)
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	file.names = names
+
+	// Anything that would mean calling a builtin is left until a run is being
+	// prepared, so that e.g. --show never executes anything
+	if slices.Contains(names, ShellVar) {
+		if !eval.isStatic(ShellVar) {
+			file.shellLazy = true
+		} else if err := file.setShell(); err != nil {
+			return nil, err
+		}
+	}
+
+	var placeholders []task.Task
+	for _, node := range tree.Nodes {
+		switch {
 		case node.Type() == ast.NodeTask:
 			taskNode, ok := node.(ast.Task)
 			if !ok {
 				return nil, fmt.Errorf("AST node has ast.NodeTask type but could not be converted to an ast.Task: %s", node)
 			}
 
-			task, err := task.New(taskNode, root, file.Vars)
+			task, err := task.New(taskNode, root, names, file.staticVar)
+			if errors.Is(err, errDeferred) {
+				listed, err := file.deferTask(taskNode)
+				if err != nil {
+					return nil, err
+				}
+				placeholders = append(placeholders, listed)
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
 
-			if file.HasTask(task.Name) {
-				return nil, fmt.Errorf("duplicate task: spokfile already contains task named %q, duplicate tasks not allowed", task.Name)
+			if task.Disabled {
+				// Tasks that don't apply here are left out entirely, so it's fine
+				// to declare the same task once per platform
+				logger.Debug("Task %s does not apply, condition %s is false", task.Name, task.Condition)
+				file.disabled[task.Name] = task
+				continue
 			}
 
-			// Add the glob patterns from the tasks to the files' map of globs
-			// this enables us to only calculate the glob expansion once if multiple
-			// tasks share the same pattern, since glob expansion does a lot of ReadDir
-			// it is relatively expensive
-			for _, pattern := range task.GlobDependencies {
-				var emptySlice []string
-				file.Globs[pattern] = emptySlice
-			}
-			for _, pattern := range task.GlobOutputs {
-				var emptySlice []string
-				file.Globs[pattern] = emptySlice
+			// Matrix tasks are only expanded when they're run, see expand
+			if err := file.addTask(task); err != nil {
+				return nil, err
 			}
+		}
+	}
 
-			// Add the task to the file
-			file.Tasks[task.Name] = task
+	// Deferred tasks are listed under their name unless something else already has it,
+	// the first of each name is as good as any other until Evaluate decides
+	for _, placeholder := range placeholders {
+		if _, ok := file.Tasks[placeholder.Name]; ok {
+			continue
 		}
+		file.Tasks[placeholder.Name] = placeholder
+		file.listed[placeholder.Name] = true
 	}
 	return &file, nil
 }
 
+// staticVar is the Lookup tasks are first built with, it returns the value of the variable
+// 'name' only if that doesn't mean calling a builtin and errDeferred otherwise.
+func (s *SpokFile) staticVar(name string) (string, error) {
+	if !s.eval.isStatic(name) {
+		return "", fmt.Errorf("variable %q: %w", name, errDeferred)
+	}
+	return s.Var(name)
+}
+
+// setShell evaluates and checks ShellVar, setting the spokfile's Shell.
+func (s *SpokFile) setShell() error {
+	name, err := s.Var(ShellVar)
+	if err != nil {
+		return err
+	}
+	if _, err := shell.NewRunner(name); err != nil {
+		return fmt.Errorf("invalid %s: %w", ShellVar, err)
+	}
+	s.Shell = name
+	return nil
+}
+
+// deferTask records a task whose conditions can't be evaluated yet, it's still checked
+// for errors now and returned as it's listed (e.g. by --show) without knowing whether it
+// applies, until Evaluate decides.
+func (s *SpokFile) deferTask(node ast.Task) (task.Task, error) {
+	unknown := func(string) (string, error) { return "", nil }
+	listed, err := task.New(node, s.Dir, s.names, unknown)
+	if err != nil {
+		return task.Task{}, err
+	}
+	s.deferred = append(s.deferred, node)
+	s.logger.Debug("Task %s has a condition that can only be evaluated when run", listed.Name)
+	return listed, nil
+}
+
+// Evaluate evaluates everything that was left until a run is being prepared as it may
+// mean calling a builtin, the conditions on tasks and their commands along with ShellVar.
+//
+// Run calls it, but anything that looks up tasks to run them, or needs Shell, must call it
+// first, until then a task with such a condition is listed whether or not it applies.
+// It's safe to call more than once.
+func (s *SpokFile) Evaluate() error {
+	if s.shellLazy {
+		if err := s.setShell(); err != nil {
+			return err
+		}
+		s.shellLazy = false
+	}
+
+	if len(s.deferred) == 0 {
+		return nil
+	}
+	deferred := s.deferred
+	s.deferred = nil
+
+	// Clear out the placeholders listed until now
+	for name := range s.listed {
+		delete(s.Tasks, name)
+	}
+	s.listed = nil
+
+	for _, node := range deferred {
+		t, err := task.New(node, s.Dir, s.names, s.Var)
+		if err != nil {
+			return err
+		}
+		if t.Disabled {
+			s.logger.Debug("Task %s does not apply, condition %s is false", t.Name, t.Condition)
+			s.disabled[t.Name] = t
+			continue
+		}
+		if err := s.addTask(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTask adds a task to the file, returning an error if it's name or any of it's
+// aliases are already taken.
+func (s *SpokFile) addTask(t task.Task) error {
+	if s.HasTask(t.Name) {
+		return fmt.Errorf("duplicate task: spokfile already contains task named %q, duplicate tasks not allowed", t.Name)
+	}
+
+	// Aliases share a namespace with task names, so neither may clash with
+	// anything declared before it
+	if other, ok := s.Aliases[t.Name]; ok {
+		return fmt.Errorf("task %q clashes with an alias of task %q", t.Name, other)
+	}
+	for _, alias := range t.Aliases {
+		if s.HasTask(alias) {
+			return fmt.Errorf("task %q: alias %q clashes with task %q", t.Name, alias, alias)
+		}
+		if other, ok := s.Aliases[alias]; ok {
+			return fmt.Errorf("task %q: alias %q is already an alias of task %q", t.Name, alias, other)
+		}
+		if s.Aliases == nil {
+			s.Aliases = make(map[string]string)
+		}
+		s.Aliases[alias] = t.Name
+	}
+
+	// Add the glob patterns from the tasks to the files' map of globs
+	// this enables us to only calculate the glob expansion once if multiple
+	// tasks share the same pattern, since glob expansion does a lot of ReadDir
+	// it is relatively expensive
+	for _, pattern := range t.GlobDependencies {
+		var emptySlice []string
+		s.Globs[pattern] = emptySlice
+	}
+	for _, pattern := range t.GlobOutputs {
+		var emptySlice []string
+		s.Globs[pattern] = emptySlice
+	}
+
+	// Add the task to the file
+	s.Tasks[t.Name] = t
+	return nil
+}
+
 // expandGlob expands out the glob pattern from root and returns all the matches,
 // the matches are made absolute before returning, root should be absolute.
 func expandGlob(root, pattern string) ([]string, error) {
@@ -1,15 +1,26 @@
 package file //nolint: testpackage // Need access to private stuff
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"go.followtheprocess.codes/spok/ast"
+	"go.followtheprocess.codes/spok/cache"
+	"go.followtheprocess.codes/spok/event"
 	"go.followtheprocess.codes/spok/iostream"
+	"go.followtheprocess.codes/spok/parser"
 	"go.followtheprocess.codes/spok/shell"
 	"go.followtheprocess.codes/spok/task"
 )
@@ -26,43 +37,1589 @@ func (t testLogger) Debug(_ string, _ ...any) {}
 
 var noOpLogger = testLogger{}
 
+// newTestSpokfile parses src and returns the SpokFile for it in dir with
+// overrides, failing the test if either can't be done.
+func newTestSpokfile(t *testing.T, src, dir string, overrides map[string]string) *SpokFile {
+	t.Helper()
+	tree, err := parser.New(src).Parse()
+	if err != nil {
+		t.Fatalf("could not parse test spokfile: %v", err)
+	}
+
+	spokfile, err := New(tree, dir, noOpLogger, overrides)
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+	return spokfile
+}
+
+// ignoreTimings ignores the timings in task and command results, which are
+// different every run.
+var ignoreTimings = cmp.Options{
+	cmpopts.IgnoreFields(task.Result{}, "Start", "End", "Duration"),
+	cmpopts.IgnoreFields(shell.Result{}, "Start", "End", "Duration"),
+}
+
 func TestFind(t *testing.T) {
 	testdata := getTestdata()
 
-	t.Run("found spokfile", func(t *testing.T) {
-		t.Parallel()
-		start := filepath.Join(testdata, "nested", "deep", "down", "here") // Start deep inside testdata
-		stop := testdata                                                   // Stop at testdata
+	t.Run("found spokfile", func(t *testing.T) {
+		t.Parallel()
+		start := filepath.Join(testdata, "nested", "deep", "down", "here") // Start deep inside testdata
+		stop := testdata                                                   // Stop at testdata
+
+		want, err := filepath.Abs(filepath.Join(testdata, "nested", "spokfile"))
+		if err != nil {
+			t.Fatal("could not resolve want")
+		}
+
+		path, err := Find(noOpLogger, start, stop)
+		if err != nil {
+			t.Fatalf("find returned an error: %v", err)
+		}
+
+		if path != want {
+			t.Errorf("got %s, wanted %s", path, want)
+		}
+	})
+
+	t.Run("missing spokfile", func(t *testing.T) {
+		t.Parallel()
+		start := filepath.Join(testdata, "missing", "deep", "down", "here")
+		stop := testdata
+
+		_, err := Find(noOpLogger, start, stop)
+		if err == nil {
+			t.Fatal("expected no spokfile found, got nil")
+		}
+
+		if err.Error() != "no spokfile found" {
+			t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), "no spokfile found")
+		}
+	})
+}
+
+func TestFindAll(t *testing.T) {
+	t.Parallel()
+	root := filepath.Join(getTestdata(), "monorepo")
+
+	got, err := FindAll(noOpLogger, root)
+	if err != nil {
+		t.Fatalf("FindAll returned an error: %v", err)
+	}
+
+	// Hidden and vendored directories should not be searched
+	want := []string{
+		mustAbs(root, "services/api/spokfile"),
+		mustAbs(root, "services/web/spokfile"),
+		mustAbs(root, "spokfile"),
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("FindAll mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = FindAll(noOpLogger, filepath.Join(root, "lib"))
+	if err == nil {
+		t.Fatal("expected no spokfile found, got nil")
+	}
+}
+
+func TestNewLoadsDotenv(t *testing.T) {
+	t.Parallel()
+	root := filepath.Join(getTestdata(), "monorepo", "services", "api")
+
+	got, err := New(ast.Tree{}, root, noOpLogger, nil)
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+
+	want := map[string]string{"SERVICE": "api"}
+	if diff := cmp.Diff(want, got.Dotenv); diff != "" {
+		t.Errorf("Dotenv mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"SERVICE=api"}, got.Env()); diff != "" {
+		t.Errorf("Env mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	// Uses t.Setenv so can't be parallel
+	root := t.TempDir()
+	dotenv := "SPOK_TEST_DOTENV=fromdotenv\nSPOK_TEST_VAR=fromdotenv\nSPOK_TEST_PROCESS=fromdotenv\nSPOK_TEST_CLI=fromdotenv\n"
+	if err := os.WriteFile(filepath.Join(root, ".env"), []byte(dotenv), 0o644); err != nil {
+		t.Fatalf("could not write .env: %v", err)
+	}
+	t.Setenv("SPOK_TEST_PROCESS", "fromprocess")
+	t.Setenv("SPOK_TEST_CLI", "fromprocess")
+
+	src := `SPOK_TEST_VAR := "fromspokfile"
+SPOK_TEST_PROCESS := "fromspokfile"
+SPOK_TEST_CLI := "fromspokfile"
+
+task env() {
+	echo $SPOK_TEST_DOTENV $SPOK_TEST_VAR $SPOK_TEST_PROCESS $SPOK_TEST_CLI
+}
+`
+	spokfile := newTestSpokfile(t, src, root, map[string]string{"SPOK_TEST_CLI": "fromcli"})
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "env")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	if len(results) != 1 || len(results[0].CommandResults) != 1 {
+		t.Fatalf("Wrong results: %#v", results)
+	}
+
+	want := "fromdotenv fromspokfile fromprocess fromcli\n"
+	if got := results[0].CommandResults[0].Stdout; got != want {
+		t.Errorf("Wrong environment\nGot: %q\nWant: %q", got, want)
+	}
+
+	// --vars shows what the commands see
+	tests := []struct {
+		name   string
+		value  string
+		origin Origin
+	}{
+		{name: "SPOK_TEST_DOTENV", value: "fromdotenv", origin: OriginEnv},
+		{name: "SPOK_TEST_VAR", value: "fromspokfile", origin: OriginSpokfile},
+		{name: "SPOK_TEST_PROCESS", value: "fromprocess", origin: OriginProcess},
+		{name: "SPOK_TEST_CLI", value: "fromcli", origin: OriginCLI},
+	}
+
+	for _, tt := range tests {
+		value, origin := spokfile.Effective(tt.name)
+		if value != tt.value {
+			t.Errorf("Effective(%q) value: got %q, wanted %q", tt.name, value, tt.value)
+		}
+		if origin != tt.origin {
+			t.Errorf("Effective(%q) origin: got %s, wanted %s", tt.name, origin, tt.origin)
+		}
+	}
+}
+
+func TestNestedBuiltins(t *testing.T) {
+	monorepo := filepath.Join(getTestdata(), "monorepo")
+	root := filepath.Join(monorepo, "services", "api")
+
+	// Like --all, run from the root of the monorepo
+	t.Chdir(monorepo)
+
+	src := `NAME := read("NAME")
+SERVICE := env("SERVICE")
+ECHOED := exec("echo $SERVICE")
+`
+	spokfile := newTestSpokfile(t, src, root, nil)
+	if err := spokfile.Resolve(); err != nil {
+		t.Fatalf("Resolve returned an error: %v", err)
+	}
+
+	want := map[string]string{
+		"NAME":    "api-service",
+		"SERVICE": "api", // From services/api/.env
+		"ECHOED":  "api",
+	}
+	if diff := cmp.Diff(want, spokfile.Vars); diff != "" {
+		t.Errorf("Vars mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewOverrides(t *testing.T) {
+	t.Parallel()
+	tree := ast.Tree{
+		Nodes: []ast.Node{
+			ast.Assign{
+				Name:     ast.Ident{Name: "VERSION", NodeType: ast.NodeIdent},
+				Value:    ast.String{Text: "0.1.0", NodeType: ast.NodeString},
+				NodeType: ast.NodeAssign,
+			},
+			ast.Assign{
+				Name: ast.Ident{Name: "COMMIT", NodeType: ast.NodeIdent},
+				Value: ast.Function{
+					Name:      ast.Ident{Name: "exec", NodeType: ast.NodeIdent},
+					Arguments: []ast.Node{ast.String{Text: "exit 1", NodeType: ast.NodeString}},
+					NodeType:  ast.NodeFunction,
+				},
+				NodeType: ast.NodeAssign,
+			},
+			ast.Assign{
+				Name:     ast.Ident{Name: "NAME", NodeType: ast.NodeIdent},
+				Value:    ast.String{Text: "spok", NodeType: ast.NodeString},
+				NodeType: ast.NodeAssign,
+			},
+			ast.Task{
+				Name:      ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Docstring: ast.Comment{NodeType: ast.NodeComment},
+				Commands:  []ast.Node{ast.Command{Command: "echo {{.NAME}} {{.VERSION}} {{.COMMIT}}", NodeType: ast.NodeCommand}},
+				NodeType:  ast.NodeTask,
+			},
+		},
+	}
+
+	// COMMIT's exec would fail if it were evaluated, overriding it means it never is
+	overrides := map[string]string{"VERSION": "1.2.3", "COMMIT": "abc123"}
+
+	got, err := New(tree, getTestdata(), noOpLogger, overrides)
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+
+	if err := got.Resolve(); err != nil {
+		t.Fatalf("Resolve returned an error: %v", err)
+	}
+
+	wantVars := map[string]string{"VERSION": "1.2.3", "COMMIT": "abc123", "NAME": "spok"}
+	if diff := cmp.Diff(wantVars, got.Vars); diff != "" {
+		t.Errorf("Vars mismatch (-want +got):\n%s", diff)
+	}
+
+	build, err := got.prepare(got.Tasks["build"])
+	if err != nil {
+		t.Fatalf("prepare returned an error: %v", err)
+	}
+
+	wantCommands := []string{"echo spok 1.2.3 abc123"}
+	if diff := cmp.Diff(wantCommands, build.Commands); diff != "" {
+		t.Errorf("Commands mismatch (-want +got):\n%s", diff)
+	}
+
+	origins := map[string]Origin{"VERSION": OriginCLI, "COMMIT": OriginCLI, "NAME": OriginSpokfile}
+	for name, want := range origins {
+		if origin := got.Origin(name); origin != want {
+			t.Errorf("Origin(%q): got %s, wanted %s", name, origin, want)
+		}
+	}
+}
+
+func TestNewUnknownOverride(t *testing.T) {
+	t.Parallel()
+	src := `VERSION := "0.1.0"
+
+task build() {
+	echo {{.VERSION}}
+}
+`
+	tree, err := parser.New(src).Parse()
+	if err != nil {
+		t.Fatalf("could not parse test spokfile: %v", err)
+	}
+
+	tests := []struct {
+		overrides map[string]string
+		name      string
+		err       string
+	}{
+		{
+			name:      "typo",
+			overrides: map[string]string{"VERSOIN": "1.2.3"},
+			err:       `cannot override variable "VERSOIN", the spokfile does not declare it. Did you mean "VERSION"?`,
+		},
+		{
+			name:      "no match",
+			overrides: map[string]string{"SOMETHING": "else"},
+			err:       `cannot override variable "SOMETHING", the spokfile does not declare it`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := New(tree, t.TempDir(), noOpLogger, tt.overrides)
+			if err == nil {
+				t.Fatal("New did not return an error")
+			}
+			if err.Error() != tt.err {
+				t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestNewVariableReferences(t *testing.T) {
+	t.Parallel()
+	testdata := getTestdata()
+	tests := []struct {
+		want    map[string]string
+		name    string
+		src     string
+		err     string
+		wantErr bool
+	}{
+		{
+			name: "ident",
+			src:  "A := \"a\"\nB := A\n",
+			want: map[string]string{"A": "a", "B": "a"},
+		},
+		{
+			name: "ident as builtin argument",
+			src:  "ROOT := \"/usr\"\nBIN := join(ROOT, \"bin\")\n",
+			want: map[string]string{"ROOT": "/usr", "BIN": "/usr/bin"},
+		},
+		{
+			name: "nested builtin call",
+			src:  "BIN := join(exec(\"echo /usr\"), \"bin\")\n",
+			want: map[string]string{"BIN": "/usr/bin"},
+		},
+		{
+			name: "interpolation",
+			src:  "ROOT := \"/usr\"\nBIN := \"{{.ROOT}}/bin\"\n",
+			want: map[string]string{"ROOT": "/usr", "BIN": "/usr/bin"},
+		},
+		{
+			name: "declared out of order",
+			src:  "BIN := \"{{.ROOT}}/bin\"\nLOCAL := join(BIN, \"local\")\nROOT := \"/usr\"\n",
+			want: map[string]string{"ROOT": "/usr", "BIN": "/usr/bin", "LOCAL": "/usr/bin/local"},
+		},
+		{
+			name:    "undefined ident",
+			src:     "B := A\n",
+			wantErr: true,
+			err:     `variable "B" references undefined variable "A"`,
+		},
+		{
+			name:    "undefined interpolation",
+			src:     "B := \"{{.A}}/bin\"\n",
+			wantErr: true,
+			err:     `variable "B" references undefined variable "A"`,
+		},
+		{
+			name:    "cycle",
+			src:     "A := B\nB := join(C, \"bin\")\nC := \"{{.A}}\"\n",
+			wantErr: true,
+			err:     "cycle detected in variable declarations: A -> B -> C -> A",
+		},
+		{
+			name:    "self reference",
+			src:     "A := \"{{.A}}\"\n",
+			wantErr: true,
+			err:     "cycle detected in variable declarations: A -> A",
+		},
+		{
+			name:    "undefined variable in command",
+			src:     "PROJECT_BIN := \"bin\"\n\ntask clean() {\n\trm -rf {{.PROJCT_BIN}}/stuff\n}\n",
+			wantErr: true,
+			err:     `task "clean" command "rm -rf {{.PROJCT_BIN}}/stuff": undefined variable "PROJCT_BIN". Did you mean "PROJECT_BIN"?`,
+		},
+		{
+			name:    "wrong number of builtin arguments",
+			src:     "A := upper(\"a\", \"b\")\n",
+			wantErr: true,
+			err:     "upper takes 1 argument(s), got 2: upper(s)",
+		},
+		{
+			name:    "nested wrong number of builtin arguments",
+			src:     "A := join(\"a\", replace(\"b\"))\n",
+			wantErr: true,
+			err:     "replace takes 3 argument(s), got 1: replace(s, old, new)",
+		},
+		{
+			name: "zero argument builtin",
+			src:  "A := lower(upper(\"a\"))\nB := replace(os(), os(), \"ok\")\n",
+			want: map[string]string{"A": "a", "B": "ok"},
+		},
+		{
+			name:    "duplicate",
+			src:     "A := \"a\"\nA := \"b\"\n",
+			wantErr: true,
+			err:     `duplicate variable: spokfile already declares "A"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, err := parser.New(tt.src).Parse()
+			if err != nil {
+				t.Fatalf("could not parse test spokfile: %v", err)
+			}
+
+			got, err := New(tree, testdata, noOpLogger, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() err = %v, wantErr = %v", err, tt.wantErr)
+			}
+
+			if err == nil {
+				if err := got.Resolve(); err != nil {
+					t.Fatalf("Resolve() returned an error: %v", err)
+				}
+			}
+
+			if err != nil {
+				if err.Error() != tt.err {
+					t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+				}
+				return
+			}
+
+			if diff := cmp.Diff(tt.want, got.Vars); diff != "" {
+				t.Errorf("Vars mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLazyEvaluation(t *testing.T) {
+	t.Parallel()
+	matrix := `GOOS := exec("exit 1")
+
+@matrix("GOOS")
+task build() {
+	echo {{.GOOS}}
+}
+
+task lint() {
+	echo "linting"
+}
+
+@alias("b")
+task release(build) {}
+`
+	failed := "builtin function exec returned an error: command \"exit 1\" exited with a non-zero exit code.\nStdout: \nStderr: "
+
+	tests := []struct {
+		want      map[string][]string // The stdout of every command run, by task
+		name      string
+		src       string   // The spokfile, where %[1]s is a file the variables append to when evaluated
+		shell     string   // The spokfile's shell after the run
+		err       string   // The error expected from Run, if any
+		tasks     []string // The tasks to run
+		evaluated []string // Everything appended to the file, in any order
+	}{
+		{
+			// Every global is exported, so a script a task calls can rely on one even
+			// though no command mentions it, but each is still only evaluated once
+			name: "variables",
+			src: `USED := exec("echo used >> %[1]s && echo used")
+SHA := exec("echo abc")
+LOUD := "{{ upper .SHA }}"
+
+task one() {
+	echo {{.USED}}
+}
+
+task two(one) {
+	echo {{.USED}} again
+}
+
+task script() {
+	echo $USED $SHA $LOUD
+}
+`,
+			tasks: []string{"two", "script"},
+			want: map[string][]string{
+				"one":    {"used\n"},
+				"two":    {"used again\n"},
+				"script": {"used abc ABC\n"},
+			},
+			evaluated: []string{"used"},
+		},
+		{
+			// Tasks with conditions that need a builtin are still listed (once), as for --show
+			name: "conditions",
+			src: `CI := exec("echo ci >> %[1]s && echo true")
+SPOK_SHELL := exec("echo shell >> %[1]s && echo sh")
+
+# Publish the thing
+task publish() if CI {
+	echo "publish"
+}
+
+# Publish the thing
+task publish() if CI == "false" {
+	echo "not in CI"
+}
+
+task build() {
+	if CI {
+		echo "ci build"
+	} else {
+		echo "local build"
+	}
+}
+`,
+			tasks: []string{"publish", "build"},
+			want: map[string][]string{
+				"publish": {"publish\n"},
+				"build":   {"ci build\n"},
+			},
+			shell:     "sh",
+			evaluated: []string{"ci", "shell"},
+		},
+		{
+			name:  "matrix variable for another task",
+			src:   matrix,
+			tasks: []string{"lint"},
+			err:   failed,
+		},
+		{
+			name:  "matrix variable for an instance",
+			src:   matrix,
+			tasks: []string{"build[linux]"},
+			err:   `task "build": @matrix: ` + failed,
+		},
+		{
+			name:  "matrix variable through an alias",
+			src:   matrix,
+			tasks: []string{"b"},
+			err:   `task "build": @matrix: ` + failed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			root := t.TempDir()
+			counter := filepath.Join(root, "counter")
+			spokfile := newTestSpokfile(t, strings.ReplaceAll(tt.src, "%[1]s", counter), root, nil)
+
+			// Loading the spokfile (e.g. for --show) evaluates nothing
+			if len(spokfile.Vars) != 0 || spokfile.Shell != "" {
+				t.Errorf("New evaluated variables before they were needed: %v, shell %q", spokfile.Vars, spokfile.Shell)
+			}
+			if _, err := os.Stat(counter); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("New executed something: %v", err)
+			}
+			for name := range tt.want {
+				if !spokfile.HasTask(name) {
+					t.Errorf("Task %s not listed before the run", name)
+				}
+			}
+
+			results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, tt.tasks...)
+			if tt.err != "" {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				if err.Error() != tt.err {
+					t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			got := make(map[string][]string)
+			for _, result := range results {
+				for _, cmd := range result.CommandResults {
+					got[result.Task] = append(got[result.Task], cmd.Stdout)
+				}
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Output mismatch (-want +got):\n%s", diff)
+			}
+
+			if spokfile.Shell != tt.shell {
+				t.Errorf("Wrong spokfile shell: got %q, wanted %q", spokfile.Shell, tt.shell)
+			}
+
+			contents, err := os.ReadFile(counter)
+			if err != nil {
+				t.Fatalf("could not read counter file: %v", err)
+			}
+			evaluated := strings.Fields(string(contents))
+			sort.Strings(evaluated)
+			if diff := cmp.Diff(tt.evaluated, evaluated); diff != "" {
+				t.Errorf("Evaluations mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunTemplates(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("could not write dependency: %v", err)
+	}
+
+	src := `NAME := "spok"
+LOUD := "{{ upper .NAME }}"
+
+task build("a.txt") {
+	echo {{ .task.name }} {{ .LOUD }} {{ lower .LOUD }}
+	echo {{ .task.deps }}
+	echo {{ .spokfile.dir }}
+}
+`
+	spokfile := newTestSpokfile(t, src, root, nil)
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "build")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("Wrong number of results. Got %d, wanted %d", len(results), 1)
+	}
+
+	var got []string
+	for _, result := range results[0].CommandResults {
+		got = append(got, result.Stdout)
+	}
+
+	want := []string{
+		"build SPOK spok\n",
+		filepath.Join(root, "a.txt") + "\n",
+		root + "\n",
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunFromSpokfileDir(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "web"), 0o755); err != nil {
+		t.Fatalf("could not create web dir: %v", err)
+	}
+
+	spokfile := &SpokFile{
+		logger: noOpLogger,
+		Path:   filepath.Join(root, "spokfile"),
+		Dir:    root,
+		Vars:   make(map[string]string),
+		Globs:  make(map[string][]string),
+		Tasks: map[string]task.Task{
+			"root": {Name: "root", Commands: []string{"pwd"}},
+			"web":  {Name: "web", Commands: []string{"pwd"}, Dir: "web"},
+		},
+	}
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "root", "web")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, result := range results {
+		got[result.Task] = result.CommandResults[0].Stdout
+	}
+
+	want := map[string]string{
+		"root": root + "\n",
+		"web":  filepath.Join(root, "web") + "\n",
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunAttributes(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "web"), 0o755); err != nil {
+		t.Fatalf("could not create web dir: %v", err)
+	}
+
+	src := `# Build the web app
+@dir("web") @env("NODE_ENV", "production")
+@timeout("1m")
+task build() {
+	pwd
+	echo $NODE_ENV
+}
+`
+	tree, err := parser.New(src).Parse()
+	if err != nil {
+		t.Fatalf("could not parse test spokfile: %v", err)
+	}
+
+	spokfile, err := New(tree, root, noOpLogger, nil)
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "build")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	var got []string
+	for _, result := range results[0].CommandResults {
+		got = append(got, result.Stdout)
+	}
+
+	want := []string{filepath.Join(root, "web") + "\n", "production\n"}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+
+	// Attributes must survive formatting
+	formatted := tree.String()
+	reparsed, err := parser.New(formatted).Parse()
+	if err != nil {
+		t.Fatalf("could not parse formatted spokfile: %v\n%s", err, formatted)
+	}
+	if diff := cmp.Diff(tree, reparsed); diff != "" {
+		t.Errorf("AST changed after formatting (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunCommandModifiers(t *testing.T) {
+	t.Parallel()
+	src := `# Clean up
+task clean() {
+	@echo "cleaning"
+	-false
+	@- false
+	echo "done"
+}
+`
+	tree, err := parser.New(src).Parse()
+	if err != nil {
+		t.Fatalf("could not parse test spokfile: %v", err)
+	}
+
+	spokfile, err := New(tree, t.TempDir(), noOpLogger, nil)
+	if err != nil {
+		t.Fatalf("New returned an error: %v", err)
+	}
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "clean")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	if !results.Ok() {
+		t.Errorf("Ignored failures should not fail the task: %+v", results)
+	}
+
+	want := shell.Results{
+		{Cmd: `echo "cleaning"`, Stdout: "cleaning\n"},
+		{Cmd: "false", Status: 1, Ignored: true},
+		{Cmd: "false", Status: 1, Ignored: true},
+		{Cmd: `echo "done"`, Stdout: "done\n"},
+	}
+	if diff := cmp.Diff(want, results[0].CommandResults, ignoreTimings); diff != "" {
+		t.Errorf("Results mismatch (-want +got):\n%s", diff)
+	}
+
+	// Modifiers must survive formatting
+	formatted := tree.String()
+	if !strings.Contains(formatted, "@-false") {
+		t.Errorf("Formatted spokfile lost it's command modifiers:\n%s", formatted)
+	}
+	reparsed, err := parser.New(formatted).Parse()
+	if err != nil {
+		t.Fatalf("could not parse formatted spokfile: %v\n%s", err, formatted)
+	}
+	if diff := cmp.Diff(tree, reparsed); diff != "" {
+		t.Errorf("AST changed after formatting (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	t.Parallel()
+	src := `task lint() {
+	@echo "linting"
+}
+
+task test(lint) {
+	@echo "testing"
+}
+
+@interactive
+task repl(test) {
+	@echo "interactive"
+}
+`
+	tests := []struct {
+		name  string
+		label string
+		want  string
+	}{
+		{
+			// Interactive tasks are always raw
+			name: "prefixed",
+			want: "[lint] linting\n[test] testing\ninteractive\n",
+		},
+		{
+			name:  "prefixed with label",
+			label: "services/api",
+			want:  "[services/api:lint] linting\n[services/api:test] testing\ninteractive\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+			stream := iostream.Test()
+			options := RunOptions{Force: true, Output: iostream.Prefixed, Label: tt.label}
+			_, err := spokfile.Run(context.Background(), stream, shell.NewIntegratedRunner(), options, "repl")
+			if err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			stdout, ok := stream.Stdout.(*bytes.Buffer)
+			if !ok {
+				t.Fatalf("Test stream stdout was not a *bytes.Buffer")
+			}
+
+			if diff := cmp.Diff(tt.want, stdout.String()); diff != "" {
+				t.Errorf("Output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunEvents(t *testing.T) {
+	t.Parallel()
+	src := `task lint() {
+	echo "linting"
+}
+
+task test(lint) {
+	false
+}
+
+task docs(test) {}
+`
+	want := []string{
+		"graph_built map[finally:[] tasks:[lint test docs]]",
+		"task_started map[task:lint]",
+		"command_started map[cmd:echo \"linting\" task:lint]",
+		"output map[line:linting stream:stdout task:lint]",
+		"command_finished map[cmd:echo \"linting\" status:0 task:lint]",
+		"task_finished map[ok:true task:lint]",
+		"task_started map[task:test]",
+		"command_started map[cmd:false task:test]",
+		"command_finished map[cmd:false status:1 task:test]",
+		"task_finished map[ok:false task:test]",
+		"task_skipped map[blocked_by:test task:docs]",
+	}
+
+	tests := []struct {
+		name  string
+		label string // Also the spokfile every event should have, if any
+	}{
+		{name: "root"},
+		{name: "nested", label: "services/api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+			buf := &bytes.Buffer{}
+			options := RunOptions{Force: true, KeepGoing: true, Events: event.NewWriter(buf), Label: tt.label}
+			if _, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), options, "docs"); err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			// Just the event and the data, times and durations vary
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var e struct {
+					Data map[string]any `json:"data"`
+					Name string         `json:"event"`
+				}
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatalf("event %q is not valid JSON: %v", line, err)
+				}
+				spokfile, _ := e.Data["spokfile"].(string) //nolint: errcheck // Missing is ""
+				if spokfile != tt.label {
+					t.Errorf("event %q has spokfile %q, wanted %q", line, spokfile, tt.label)
+				}
+				delete(e.Data, "spokfile")
+				delete(e.Data, "duration_ns")
+				got = append(got, fmt.Sprintf("%s %v", e.Name, e.Data))
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Events mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBuiltinsFromSpokfileDir(t *testing.T) {
+	root := t.TempDir()
+	for name, contents := range map[string]string{"VERSION": "1.2.3\n", "a.txt": ""} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(contents), 0o644); err != nil {
+			t.Fatalf("could not write %s: %v", name, err)
+		}
+	}
+
+	// Run from somewhere else entirely, builtins should still look in the spokfile's dir
+	t.Chdir(t.TempDir())
+
+	src := `VERSION := read("VERSION")
+FILES := glob("*.txt")
+
+task ver() {
+	echo {{ .VERSION }} {{ .FILES }} {{ read "VERSION" }}
+}
+`
+	spokfile := newTestSpokfile(t, src, root, nil)
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "ver")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	if got, want := results[0].CommandResults[0].Stdout, "1.2.3 a.txt 1.2.3\n"; got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestRunShell(t *testing.T) {
+	t.Parallel()
+	src := `SPOK_SHELL := "sh"
+
+@shell("bash")
+task bash() {
+	basename $0
+}
+
+task default() {
+	echo default
+}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	if spokfile.Shell != "sh" {
+		t.Errorf("Wrong spokfile shell: got %q, wanted %q", spokfile.Shell, "sh")
+	}
+
+	// A task's own shell beats whatever runner the caller passes in
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "bash", "default")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	// The tasks are independent so may run in either order
+	got := make(map[string]string)
+	for _, result := range results {
+		got[result.Task] = result.CommandResults[0].Stdout
+	}
+
+	want := map[string]string{"bash": "bash\n", "default": "default\n"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+
+	// An unsupported shell is caught when the spokfile is loaded
+	tree, err := parser.New(`SPOK_SHELL := "fish"` + "\n").Parse()
+	if err != nil {
+		t.Fatalf("could not parse test spokfile: %v", err)
+	}
+
+	_, err = New(tree, t.TempDir(), noOpLogger, nil)
+	if err == nil {
+		t.Fatal("Expected an error for an unsupported SPOK_SHELL, got nil")
+	}
+	wantErr := `invalid SPOK_SHELL: unsupported shell "fish", expected one of bash, cmd, dash, integrated, powershell, pwsh, sh, zsh`
+	if err.Error() != wantErr {
+		t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), wantErr)
+	}
+}
+
+func TestRunMatrix(t *testing.T) {
+	t.Parallel()
+	src := `GOOS := "linux darwin windows"
+
+# Build for every platform
+@matrix("GOOS")
+task build() {
+	echo {{.GOOS}} $GOOS {{.task.name}}
+}
+
+task release(build) {}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	// Nothing is expanded until it's run
+	if spokfile.HasTask("build[linux]") {
+		t.Error("build was expanded when the spokfile was loaded")
+	}
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "release")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	want := []string{"build[linux]", "build[darwin]", "build[windows]"}
+	if diff := cmp.Diff(want, spokfile.Tasks["build"].TaskDependencies); diff != "" {
+		t.Errorf("build should depend on every instance (-want +got):\n%s", diff)
+	}
+
+	var got []string
+	for _, result := range results {
+		for _, cmd := range result.CommandResults {
+			got = append(got, cmd.Stdout)
+		}
+	}
+	sort.Strings(got)
+
+	wantOutput := []string{
+		"darwin darwin build[darwin]\n",
+		"linux linux build[linux]\n",
+		"windows windows build[windows]\n",
+	}
+	if diff := cmp.Diff(wantOutput, got); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+
+	// A single instance can be run on it's own
+	results, err = spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "build[linux]")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	if len(results) != 1 || results[0].CommandResults[0].Stdout != "linux linux build[linux]\n" {
+		t.Errorf("Wrong results running a single instance: %+v", results)
+	}
+}
+
+func TestRunFinally(t *testing.T) {
+	t.Parallel()
+	src := `@finally("_teardown")
+task integration() {
+	echo "integration"
+}
+
+@finally("_teardown") @timeout("50ms")
+task slow() {
+	sleep 10
+}
+
+@finally("_teardown")
+task interrupted() {
+	sleep 10
+}
+
+task _teardown() {
+	echo "teardown"
+	touch torndown
+}
+
+@finally("_broken")
+task doomed() {
+	sleep 10
+}
+
+task _broken() {
+	exit 2
+}
+
+@finally("teardwn")
+task typo() {}
+`
+	load := func(t *testing.T) (*SpokFile, string) {
+		t.Helper()
+		tree, err := parser.New(src).Parse()
+		if err != nil {
+			t.Fatalf("could not parse test spokfile: %v", err)
+		}
+		root := t.TempDir()
+		spokfile, err := New(tree, root, noOpLogger, nil)
+		if err != nil {
+			t.Fatalf("New returned an error: %v", err)
+		}
+		return spokfile, filepath.Join(root, "torndown")
+	}
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+		spokfile, _ := load(t)
+		results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "integration")
+		if err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+
+		want := task.Results{
+			{
+				Task:           "integration",
+				CommandResults: shell.Results{{Cmd: `echo "integration"`, Stdout: "integration\n"}},
+			},
+			{
+				Task: "_teardown",
+				CommandResults: shell.Results{
+					{Cmd: `echo "teardown"`, Stdout: "teardown\n"},
+					{Cmd: "touch torndown"},
+				},
+				Finally: true,
+			},
+		}
+		if diff := cmp.Diff(want, results, ignoreTimings); diff != "" {
+			t.Errorf("Results mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		t.Parallel()
+		spokfile, marker := load(t)
+		results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "slow")
+		if err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+		if results.Ok() {
+			t.Error("Expected the timed out task to fail")
+		}
+		if _, err := os.Stat(marker); err != nil {
+			t.Errorf("Finally task did not run after the task failed: %v", err)
+		}
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		t.Parallel()
+		spokfile, marker := load(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := spokfile.Run(ctx, iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "interrupted")
+		if err == nil {
+			t.Fatal("Expected an error, got nil")
+		}
+		want := `task "interrupted" encountered an error: task "interrupted" interrupted running "sleep 10"`
+		if err.Error() != want {
+			t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), want)
+		}
+		if _, err := os.Stat(marker); err != nil {
+			t.Errorf("Finally task did not run after the run was interrupted: %v", err)
+		}
+	})
+
+	t.Run("interrupted and finally fails", func(t *testing.T) {
+		t.Parallel()
+		spokfile, _ := load(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		results, err := spokfile.Run(ctx, iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "doomed")
+		if err == nil {
+			t.Fatal("Expected an error, got nil")
+		}
+
+		// The finally task's result comes back with the error so it can still be reported
+		want := task.Results{
+			{
+				Task:           "_broken",
+				CommandResults: shell.Results{{Cmd: "exit 2", Status: 2}},
+				Finally:        true,
+			},
+		}
+		if diff := cmp.Diff(want, results, ignoreTimings); diff != "" {
+			t.Errorf("Results mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		t.Parallel()
+		spokfile, _ := load(t)
+		_, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "typo")
+		if err == nil {
+			t.Fatal("Expected an error, got nil")
+		}
+		want := `task "typo" declares a finally task "teardwn", which does not exist. Did you mean "_teardown"?`
+		if err.Error() != want {
+			t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), want)
+		}
+	})
+}
+
+func TestRunKeepGoing(t *testing.T) {
+	t.Parallel()
+	src := `task fail() {
+	false
+	echo "never"
+}
+
+task fine() {
+	echo "fine"
+}
+
+task after(fail) {
+	echo "after"
+}
+
+task downstream(after) {
+	echo "downstream"
+}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	byName := func(results task.Results) map[string]task.Result {
+		got := make(map[string]task.Result, len(results))
+		for _, result := range results {
+			got[result.Task] = result
+		}
+		return got
+	}
+
+	t.Run("keep going", func(t *testing.T) {
+		t.Parallel()
+		options := RunOptions{Force: true, KeepGoing: true}
+		results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), options, "downstream", "fine")
+		if err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+
+		want := map[string]task.Result{
+			"fail":       {Task: "fail", CommandResults: shell.Results{{Cmd: "false", Status: 1}}},
+			"fine":       {Task: "fine", CommandResults: shell.Results{{Cmd: `echo "fine"`, Stdout: "fine\n"}}},
+			"after":      {Task: "after", BlockedBy: "fail"},
+			"downstream": {Task: "downstream", BlockedBy: "fail"},
+		}
+		if diff := cmp.Diff(want, byName(results), ignoreTimings); diff != "" {
+			t.Errorf("Results mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		t.Parallel()
+		results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "downstream")
+		if err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+
+		want := map[string]task.Result{
+			"fail": {Task: "fail", CommandResults: shell.Results{{Cmd: "false", Status: 1}}},
+		}
+		if diff := cmp.Diff(want, byName(results), ignoreTimings); diff != "" {
+			t.Errorf("Results mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestRunPrivate(t *testing.T) {
+	t.Parallel()
+	src := `task _setup() {
+	echo "setup"
+}
+
+@private
+task generate() {
+	echo "generate"
+}
+
+task build(_setup, generate) {
+	echo "build"
+}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	for _, name := range []string{"_setup", "generate"} {
+		if !spokfile.Tasks[name].Private {
+			t.Errorf("Task %s should be private", name)
+		}
+	}
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "build")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Errorf("Wrong number of results, private dependencies should still run. Got %d, wanted %d", len(results), 3)
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{
+			name:    "underscore",
+			request: "_setup",
+			want:    `task "_setup" is private, it can only be run as a dependency of another task`,
+		},
+		{
+			name:    "attribute",
+			request: "generate",
+			want:    `task "generate" is private, it can only be run as a dependency of another task`,
+		},
+		{
+			name:    "not suggested",
+			request: "generat",
+			want:    `spokfile has no task "generat"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, tt.request)
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.want)
+			}
+		})
+	}
+}
 
-		want, err := filepath.Abs(filepath.Join(testdata, "nested", "spokfile"))
-		if err != nil {
-			t.Fatal("could not resolve want")
-		}
+func TestRunAliases(t *testing.T) {
+	t.Parallel()
+	src := `@alias("t")
+task test() {
+	echo "test"
+}
 
-		path, err := Find(noOpLogger, start, stop)
-		if err != nil {
-			t.Fatalf("find returned an error: %v", err)
-		}
+@alias("b") @alias("compile")
+task build(t) {
+	echo "build"
+}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
 
-		if path != want {
-			t.Errorf("got %s, wanted %s", path, want)
-		}
-	})
+	wantAliases := map[string]string{"t": "test", "b": "build", "compile": "build"}
+	if diff := cmp.Diff(wantAliases, spokfile.Aliases); diff != "" {
+		t.Errorf("Aliases mismatch (-want +got):\n%s", diff)
+	}
 
-	t.Run("missing spokfile", func(t *testing.T) {
-		t.Parallel()
-		start := filepath.Join(testdata, "missing", "deep", "down", "here")
-		stop := testdata
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "b")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
 
-		_, err := Find(noOpLogger, start, stop)
-		if err == nil {
-			t.Fatal("expected no spokfile found, got nil")
-		}
+	// Aliases are resolved to the real task, including in dependencies
+	got := make([]string, 0, len(results))
+	for _, result := range results {
+		got = append(got, result.Task)
+	}
+	if diff := cmp.Diff([]string{"test", "build"}, got); diff != "" {
+		t.Errorf("Ran the wrong tasks (-want +got):\n%s", diff)
+	}
 
-		if err.Error() != "no spokfile found" {
-			t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), "no spokfile found")
+	_, err = spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "compil")
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	want := `spokfile has no task "compil". Did you mean "compile"?`
+	if err.Error() != want {
+		t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), want)
+	}
+}
+
+func TestTagged(t *testing.T) {
+	t.Parallel()
+	src := `@tag("ci")
+task test() {}
+
+@tag("ci") @tag("lint")
+task lint() {}
+
+@tag("codegen")
+task _generate() {}
+
+task build() {}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	if diff := cmp.Diff([]string{"ci", "lint"}, spokfile.Tags()); diff != "" {
+		t.Errorf("Tags mismatch (-want +got):\n%s", diff)
+	}
+
+	tests := []struct {
+		name    string
+		tag     string
+		err     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "ci",
+			tag:  "ci",
+			want: []string{"lint", "test"},
+		},
+		{
+			name: "lint",
+			tag:  "lint",
+			want: []string{"lint"},
+		},
+		{
+			name:    "only private",
+			tag:     "codegen",
+			wantErr: true,
+			err:     `spokfile has no tasks tagged "codegen"`,
+		},
+		{
+			name:    "missing",
+			tag:     "lin",
+			wantErr: true,
+			err:     `spokfile has no tasks tagged "lin". Did you mean "lint"?`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := spokfile.Tagged(tt.tag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Tagged() err = %v, wantErr = %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if err.Error() != tt.err {
+					t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+				}
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Tagged mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunTaggedTransitiveDependencies(t *testing.T) {
+	t.Parallel()
+	src := `task y() {
+	echo "y"
+}
+
+task x(y) {
+	echo "x"
+}
+
+task z() {
+	echo "z"
+}
+
+@tag("ci")
+task a(x) {
+	echo "a"
+}
+
+@tag("ci")
+task b(z) {
+	echo "b"
+}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	tasks, err := spokfile.Tagged("ci")
+	if err != nil {
+		t.Fatalf("Tagged returned an error: %v", err)
+	}
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, tasks...)
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	got := make([]string, 0, len(results))
+	for _, result := range results {
+		got = append(got, result.Task)
+	}
+	sort.Strings(got)
+
+	// Every task's dependencies must be walked, not just the last requested one's
+	want := []string{"a", "b", "x", "y", "z"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Ran tasks mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewAliasClash(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{
+			name: "alias clashes with earlier task",
+			src:  "task test() {}\n\n@alias(\"test\")\ntask build() {}\n",
+			err:  `task "build": alias "test" clashes with task "test"`,
+		},
+		{
+			name: "alias clashes with later task",
+			src:  "@alias(\"test\")\ntask build() {}\n\ntask test() {}\n",
+			err:  `task "test" clashes with an alias of task "build"`,
+		},
+		{
+			name: "same alias on two tasks",
+			src:  "@alias(\"b\")\ntask build() {}\n\n@alias(\"b\")\ntask bench() {}\n",
+			err:  `task "bench": alias "b" is already an alias of task "build"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, err := parser.New(tt.src).Parse()
+			if err != nil {
+				t.Fatalf("could not parse test spokfile: %v", err)
+			}
+
+			_, err = New(tree, t.TempDir(), noOpLogger, nil)
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+			if err.Error() != tt.err {
+				t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestRunConditional(t *testing.T) {
+	t.Parallel()
+	src := fmt.Sprintf(`OS := "%[1]s"
+
+task open() if os == "%[1]s" {
+	echo "here"
+}
+
+task open() if os != "%[1]s" {
+	echo "elsewhere"
+}
+
+task nowhere() if OS != os {
+	echo "nowhere"
+}
+
+task build(nowhere, open) {
+	if OS == "%[1]s" && arch == "%[2]s" {
+		echo "native"
+	} else {
+		echo "cross"
+	}
+}
+`, runtime.GOOS, runtime.GOARCH)
+
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	if spokfile.HasTask("nowhere") {
+		t.Error("Task nowhere does not apply but is in the spokfile's tasks")
+	}
+
+	results, err := spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "build")
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	got := make(map[string][]string)
+	for _, result := range results {
+		for _, cmd := range result.CommandResults {
+			got[result.Task] = append(got[result.Task], cmd.Stdout)
 		}
-	})
+	}
+
+	want := map[string][]string{
+		"open":  {"here\n"},
+		"build": {"native\n"},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{Force: true}, "nowhere")
+	if err == nil {
+		t.Fatal("Expected an error running a task that does not apply, got nil")
+	}
+	wantErr := `task "nowhere" does not apply here, it only runs if OS != os`
+	if err.Error() != wantErr {
+		t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), wantErr)
+	}
 }
 
 func TestExpandGlobs(t *testing.T) {
@@ -143,7 +1700,7 @@ func TestFromAST(t *testing.T) {
 					ast.Task{
 						Name:      ast.Ident{Name: "test", NodeType: ast.NodeIdent},
 						Docstring: ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
-						Commands:  []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+						Commands:  []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 						NodeType:  ast.NodeTask,
 					},
 				},
@@ -170,7 +1727,7 @@ func TestFromAST(t *testing.T) {
 					ast.Task{
 						Name:         ast.Ident{Name: "test", NodeType: ast.NodeIdent},
 						Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
-						Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+						Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 						NodeType:     ast.NodeTask,
 						Dependencies: []ast.Node{ast.String{Text: "**/*.go", NodeType: ast.NodeString}},
 					},
@@ -199,7 +1756,7 @@ func TestFromAST(t *testing.T) {
 					ast.Task{
 						Name:      ast.Ident{Name: "test", NodeType: ast.NodeIdent},
 						Docstring: ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
-						Commands:  []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+						Commands:  []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 						NodeType:  ast.NodeTask,
 						Outputs:   []ast.Node{ast.String{Text: "**/*.go", NodeType: ast.NodeString}},
 					},
@@ -227,7 +1784,7 @@ func TestFromAST(t *testing.T) {
 				Nodes: []ast.Node{
 					ast.Task{
 						Name:     ast.Ident{Name: "test", NodeType: ast.NodeIdent},
-						Commands: []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+						Commands: []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 						NodeType: ast.NodeTask,
 					},
 				},
@@ -253,13 +1810,13 @@ func TestFromAST(t *testing.T) {
 					ast.Task{
 						Name:      ast.Ident{Name: "test", NodeType: ast.NodeIdent},
 						Docstring: ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
-						Commands:  []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+						Commands:  []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 						NodeType:  ast.NodeTask,
 					},
 					ast.Task{
 						Name:      ast.Ident{Name: "test", NodeType: ast.NodeIdent},
 						Docstring: ast.Comment{Text: " A duplicate test task", NodeType: ast.NodeComment},
-						Commands:  []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+						Commands:  []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 						NodeType:  ast.NodeTask,
 					},
 				},
@@ -314,7 +1871,7 @@ func TestFromAST(t *testing.T) {
 			want: &SpokFile{
 				Path:  filepath.Join(testdata, "spokfile"),
 				Dir:   testdata,
-				Vars:  map[string]string{"global1": abs(filepath.Join("path", "parts", "more"))},
+				Vars:  map[string]string{"global1": filepath.Join(testdata, "path", "parts", "more")},
 				Globs: make(map[string][]string),
 				Tasks: make(map[string]task.Task),
 			},
@@ -434,19 +1991,21 @@ func TestFromAST(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := New(tt.tree, testdata, noOpLogger)
+			got, err := New(tt.tree, testdata, noOpLogger, nil)
+			if err == nil {
+				// Globals are evaluated lazily, force them so any builtin errors surface
+				err = got.Resolve()
+			}
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("fromTree() err = %v, wantErr = %v", err, tt.wantErr)
 			}
 
-			if tt.want != nil {
-				if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreUnexported(*tt.want)); diff != "" {
-					t.Errorf("File mismatch (-want +got):\n%s", diff)
-				}
-			} else {
-				if diff := cmp.Diff(tt.want, got); diff != "" {
-					t.Errorf("File mismatch (-want +got):\n%s", diff)
-				}
+			if tt.wantErr {
+				return
+			}
+
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreUnexported(*tt.want)); diff != "" {
+				t.Errorf("File mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
@@ -771,17 +2330,6 @@ func TestRun(t *testing.T) {
 					},
 					Task: "lint",
 				},
-				{
-					CommandResults: shell.Results{
-						{
-							Cmd:    "echo task1",
-							Stdout: "task1\n",
-							Stderr: "",
-							Status: 0,
-						},
-					},
-					Task: "test",
-				},
 			},
 		},
 		{
@@ -894,12 +2442,12 @@ func TestRun(t *testing.T) {
 			// of each test
 			defer os.RemoveAll(".spok")
 			runner := shell.NewIntegratedRunner()
-			got, err := tt.spokfile.Run(iostream.Null(), runner, tt.force, tt.tasks...)
+			got, err := tt.spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{Force: tt.force}, tt.tasks...)
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("Run() err = %v, wantErr = %v", err, tt.wantErr)
 			}
 
-			if diff := cmp.Diff(tt.want, got); diff != "" {
+			if diff := cmp.Diff(tt.want, got, ignoreTimings); diff != "" {
 				t.Errorf("Result mismatch (-want +got):\n%s", diff)
 			}
 		})
@@ -925,7 +2473,7 @@ func TestRunForce(t *testing.T) {
 		}
 
 		runner := shell.NewIntegratedRunner()
-		first, err := spokfile.Run(iostream.Null(), runner, true, "test")
+		first, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{Force: true}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -941,7 +2489,7 @@ func TestRunForce(t *testing.T) {
 
 		// Because force is true, second result should not be skipped either
 		// even though the cache won't have changed
-		second, err := spokfile.Run(iostream.Null(), runner, true, "test")
+		second, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{Force: true}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -974,7 +2522,7 @@ func TestRunForce(t *testing.T) {
 		}
 
 		runner := shell.NewIntegratedRunner()
-		first, err := spokfile.Run(iostream.Null(), runner, false, "test")
+		first, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -989,7 +2537,7 @@ func TestRunForce(t *testing.T) {
 		}
 
 		// Because force is now false, the first result should run and the second should be skipped
-		second, err := spokfile.Run(iostream.Null(), runner, false, "test")
+		second, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -1024,7 +2572,7 @@ func TestRunDoesNotCacheFailure(t *testing.T) {
 		}
 
 		runner := shell.NewIntegratedRunner()
-		first, err := spokfile.Run(iostream.Null(), runner, false, "test")
+		first, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -1040,7 +2588,7 @@ func TestRunDoesNotCacheFailure(t *testing.T) {
 
 		// Because the result was successful, it should have been cached
 		// force is false here so it should not be run again
-		second, err := spokfile.Run(iostream.Null(), runner, false, "test")
+		second, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -1073,7 +2621,7 @@ func TestRunDoesNotCacheFailure(t *testing.T) {
 		}
 
 		runner := shell.NewIntegratedRunner()
-		first, err := spokfile.Run(iostream.Null(), runner, false, "test")
+		first, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -1089,7 +2637,7 @@ func TestRunDoesNotCacheFailure(t *testing.T) {
 
 		// Because the result was unsuccessful, it should not have been cached
 		// and should be run again
-		second, err := spokfile.Run(iostream.Null(), runner, false, "test")
+		second, err := spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
 		if err != nil {
 			t.Fatalf("Run() returned an error: %v", err)
 		}
@@ -1105,6 +2653,171 @@ func TestRunDoesNotCacheFailure(t *testing.T) {
 	})
 }
 
+func TestRunOverridesInvalidateCache(t *testing.T) {
+	// A cache will get built on run, so we must clean it up at the end
+	defer os.RemoveAll(".spok")
+
+	newSpokfile := func(version string) *SpokFile {
+		return &SpokFile{
+			logger:    noOpLogger,
+			overrides: map[string]string{"VERSION": version},
+			Tasks: map[string]task.Task{
+				"test": {
+					Name:             "test",
+					Commands:         []string{"echo hello"},
+					FileDependencies: []string{"file_test.go"}, // Needs a file dependency so cache is updated
+				},
+			},
+		}
+	}
+
+	runner := shell.NewIntegratedRunner()
+	if _, err := newSpokfile("1.0.0").Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test"); err != nil {
+		t.Fatalf("Run() returned an error: %v", err)
+	}
+
+	// Same override, nothing has changed so should be skipped
+	same, err := newSpokfile("1.0.0").Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
+	if err != nil {
+		t.Fatalf("Run() returned an error: %v", err)
+	}
+
+	if len(same) != 1 || !same[0].Skipped {
+		t.Fatalf("Task with unchanged overrides should have been skipped: %#v", same)
+	}
+
+	// Different override, should run again
+	changed, err := newSpokfile("2.0.0").Run(context.Background(), iostream.Null(), runner, RunOptions{}, "test")
+	if err != nil {
+		t.Fatalf("Run() returned an error: %v", err)
+	}
+
+	if len(changed) != 1 || changed[0].Skipped {
+		t.Fatalf("Task with changed overrides should not have been skipped: %#v", changed)
+	}
+}
+
+func TestRunErrorKinds(t *testing.T) {
+	t.Parallel()
+	src := `# Build the project
+task build() {
+	echo "building"
+}
+
+@private
+task _helper() {}
+
+@tag("ci")
+task lint() {}
+`
+	tests := []struct {
+		kind  error
+		setup func(t *testing.T, dir string)
+		name  string
+		tag   string
+		tasks []string
+	}{
+		{
+			name:  "missing task",
+			tasks: []string{"bild"},
+			kind:  ErrNoTask,
+		},
+		{
+			name:  "private task",
+			tasks: []string{"_helper"},
+			kind:  ErrNoTask,
+		},
+		{
+			name: "missing tag",
+			tag:  "cd",
+			kind: ErrNoTask,
+		},
+		{
+			name:  "cache",
+			tasks: []string{"build"},
+			kind:  ErrCache,
+			setup: func(t *testing.T, dir string) {
+				t.Helper()
+				// A file where the cache directory should be
+				if err := os.WriteFile(filepath.Join(dir, cache.Dir), nil, 0o644); err != nil {
+					t.Fatalf("could not create file in place of the cache: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			if tt.setup != nil {
+				tt.setup(t, dir)
+			}
+
+			spokfile := newTestSpokfile(t, src, dir, nil)
+
+			var err error
+			if tt.tag != "" {
+				_, err = spokfile.Tagged(tt.tag)
+			} else {
+				_, err = spokfile.Run(context.Background(), iostream.Null(), shell.NewIntegratedRunner(), RunOptions{}, tt.tasks...)
+			}
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+			if !errors.Is(err, tt.kind) {
+				t.Errorf("Wrong kind of error: %v is not %v", err, tt.kind)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+	src := `@alias("b")
+task build() {
+	echo "building"
+}
+
+@private
+task _helper() {}
+`
+	spokfile := newTestSpokfile(t, src, t.TempDir(), nil)
+
+	tests := []struct {
+		name string
+		task string
+		err  string
+	}{
+		{name: "task", task: "build"},
+		{name: "alias", task: "b"},
+		{name: "missing", task: "bild", err: `spokfile has no task "bild". Did you mean "build"?`},
+		{name: "private", task: "_helper", err: `task "_helper" is private, it can only be run as a dependency of another task`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := spokfile.Check(tt.task)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Check returned an error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+			if err.Error() != tt.err {
+				t.Errorf("Wrong error\nGot:\t%s\nWant:\t%s", err, tt.err)
+			}
+			if !errors.Is(err, ErrNoTask) {
+				t.Errorf("Wrong kind of error: %v is not %v", err, ErrNoTask)
+			}
+		})
+	}
+}
+
 func TestRunFuzzyMatch(t *testing.T) {
 	tests := []struct {
 		spokfile *SpokFile
@@ -1172,7 +2885,7 @@ func TestRunFuzzyMatch(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			runner := shell.NewIntegratedRunner()
-			_, err := tt.spokfile.Run(iostream.Null(), runner, false, tt.tasks...)
+			_, err := tt.spokfile.Run(context.Background(), iostream.Null(), runner, RunOptions{}, tt.tasks...)
 			if err == nil {
 				t.Fatalf("Run() did not return an error")
 			}
@@ -1258,8 +2971,8 @@ var (
 					},
 				},
 				Outputs: []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go test -race ./...",
 						NodeType: ast.NodeCommand,
 					},
@@ -1282,8 +2995,8 @@ var (
 					},
 				},
 				Outputs: []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go fmt ./...",
 						NodeType: ast.NodeCommand,
 					},
@@ -1301,20 +3014,20 @@ var (
 				},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "line 1",
 						NodeType: ast.NodeCommand,
 					},
-					{
+					ast.Command{
 						Command:  "line 2",
 						NodeType: ast.NodeCommand,
 					},
-					{
+					ast.Command{
 						Command:  "line 3",
 						NodeType: ast.NodeCommand,
 					},
-					{
+					ast.Command{
 						Command:  "line 4",
 						NodeType: ast.NodeCommand,
 					},
@@ -1342,8 +3055,8 @@ var (
 						NodeType: ast.NodeString,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  `go build -ldflags="-X main.version=test -X main.commit=7cb0ec5609efb5fe0"`,
 						NodeType: ast.NodeCommand,
 					},
@@ -1361,8 +3074,8 @@ var (
 				},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "echo {{.GLOBAL}}",
 						NodeType: ast.NodeCommand,
 					},
@@ -1389,8 +3102,8 @@ var (
 						NodeType: ast.NodeString,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "do some stuff here",
 						NodeType: ast.NodeCommand,
 					},
@@ -1461,7 +3174,7 @@ var spokFileWant = &SpokFile{
 			Name:             "show",
 			TaskDependencies: nil,
 			FileDependencies: nil,
-			Commands:         []string{"echo very important stuff here"},
+			Commands:         []string{"echo {{.GLOBAL}}"},
 			NamedOutputs:     nil,
 			FileOutputs:      nil,
 		},
@@ -1488,11 +3201,15 @@ func TestBuildFullSpokfile(t *testing.T) {
 	}
 	t.Parallel()
 
-	got, err := New(fullSpokfileAST, getTestdata(), noOpLogger)
+	got, err := New(fullSpokfileAST, getTestdata(), noOpLogger, nil)
 	if err != nil {
 		t.Fatalf("fromAST returned an error: %v", err)
 	}
 
+	if err := got.Resolve(); err != nil {
+		t.Fatalf("Resolve returned an error: %v", err)
+	}
+
 	if diff := cmp.Diff(spokFileWant, got, cmpopts.IgnoreUnexported(*spokFileWant, *got)); diff != "" {
 		t.Errorf("File mismatch (-want +got):\n%s", diff)
 	}
@@ -1515,13 +3232,3 @@ func mustAbs(root, path string) string {
 	}
 	return abs
 }
-
-// abs returns the absolute path of the given path, panicking
-// if it cannot do so for whatever reason.
-func abs(path string) string {
-	abs, err := filepath.Abs(path)
-	if err != nil {
-		panic(err)
-	}
-	return abs
-}
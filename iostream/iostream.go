@@ -8,8 +8,9 @@ import (
 	"os"
 )
 
-// IOStream is an object containing io.Writers for spok to talk to.
+// IOStream is an object containing the io.Reader and io.Writers for spok to talk to.
 type IOStream struct {
+	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
 }
@@ -17,13 +18,15 @@ type IOStream struct {
 // OS returns an IOStream configured to talk to the OS streams.
 func OS() IOStream {
 	return IOStream{
+		Stdin:  os.Stdin,
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 	}
 }
 
 // Test returns an IOStream configured to talk to temporary buffers
-// that can then be read from to verify output.
+// that can then be read from to verify output. It has no input, set
+// Stdin to provide some.
 func Test() IOStream {
 	return IOStream{
 		Stdout: &bytes.Buffer{},
@@ -31,7 +34,8 @@ func Test() IOStream {
 	}
 }
 
-// Null returns an IOStream configured to discard all output.
+// Null returns an IOStream configured to discard all output, with
+// no input.
 func Null() IOStream {
 	return IOStream{
 		Stdout: io.Discard,
@@ -0,0 +1,166 @@
+package iostream_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.followtheprocess.codes/spok/iostream"
+)
+
+func TestLineWriter(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		want   string
+		writes []string
+	}{
+		{
+			name:   "empty",
+			writes: nil,
+			want:   "",
+		},
+		{
+			name:   "single line",
+			writes: []string{"hello\n"},
+			want:   "[build] hello\n",
+		},
+		{
+			name:   "many lines in one write",
+			writes: []string{"hello\nthere\n"},
+			want:   "[build] hello\n[build] there\n",
+		},
+		{
+			name:   "line split across writes",
+			writes: []string{"hel", "lo\nthe", "re\n"},
+			want:   "[build] hello\n[build] there\n",
+		},
+		{
+			name:   "unfinished line is flushed",
+			writes: []string{"hello\nthere"},
+			want:   "[build] hello\n[build] there\n",
+		},
+		{
+			name:   "blank lines",
+			writes: []string{"\n\n"},
+			want:   "[build] \n[build] \n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			buf := &bytes.Buffer{}
+			writer := iostream.NewLineWriter(buf, "[build] ")
+			for _, write := range tt.writes {
+				n, err := io.WriteString(writer, write)
+				if err != nil {
+					t.Fatalf("Write returned an error: %v", err)
+				}
+				if n != len(write) {
+					t.Errorf("Write returned %d, wanted %d", n, len(write))
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatalf("Flush returned an error: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, buf.String()); diff != "" {
+				t.Errorf("Output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestForTask(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		wantStdout string
+		wantStderr string
+		wantBefore string // What's on stdout before the task has finished
+		output     iostream.Output
+	}{
+		{
+			name:       "raw",
+			output:     iostream.Raw,
+			wantBefore: "out 1\nout 2",
+			wantStdout: "out 1\nout 2",
+			wantStderr: "err 1\n",
+		},
+		{
+			name:       "prefixed",
+			output:     iostream.Prefixed,
+			wantBefore: "[build] out 1\n",
+			wantStdout: "[build] out 1\n[build] out 2\n",
+			wantStderr: "[build] err 1\n",
+		},
+		{
+			name:       "grouped",
+			output:     iostream.Grouped,
+			wantBefore: "",
+			wantStdout: "out 1\nout 2",
+			wantStderr: "err 1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stream := iostream.Test()
+			taskStream, flush := stream.ForTask("build", tt.output)
+
+			fmt.Fprint(taskStream.Stdout, "out 1\n")
+			fmt.Fprint(taskStream.Stderr, "err 1\n")
+			fmt.Fprint(taskStream.Stdout, "out 2")
+
+			stdout, ok := stream.Stdout.(*bytes.Buffer)
+			if !ok {
+				t.Fatalf("Test stream stdout was not a *bytes.Buffer")
+			}
+			stderr, ok := stream.Stderr.(*bytes.Buffer)
+			if !ok {
+				t.Fatalf("Test stream stderr was not a *bytes.Buffer")
+			}
+
+			if diff := cmp.Diff(tt.wantBefore, stdout.String()); diff != "" {
+				t.Errorf("Stdout before flush mismatch (-want +got):\n%s", diff)
+			}
+
+			if err := flush(); err != nil {
+				t.Fatalf("flush returned an error: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.wantStdout, stdout.String()); diff != "" {
+				t.Errorf("Stdout mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantStderr, stderr.String()); diff != "" {
+				t.Errorf("Stderr mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseOutput(t *testing.T) {
+	t.Parallel()
+	for _, name := range []string{"raw", "prefixed", "grouped"} {
+		output, err := iostream.ParseOutput(name)
+		if err != nil {
+			t.Fatalf("ParseOutput(%q) returned an error: %v", name, err)
+		}
+		if output.String() != name {
+			t.Errorf("ParseOutput(%q).String() = %q", name, output.String())
+		}
+	}
+
+	_, err := iostream.ParseOutput("fancy")
+	if err == nil {
+		t.Fatal("ParseOutput did not return an error for an invalid output")
+	}
+	want := `invalid output "fancy", expected one of grouped, prefixed, raw`
+	if err.Error() != want {
+		t.Errorf("Wrong error\nGot:\t%s\nWant:\t%s", err, want)
+	}
+}
@@ -0,0 +1,151 @@
+package iostream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.followtheprocess.codes/hue"
+	"golang.org/x/exp/maps"
+)
+
+// Output is how the output of each task in a run is written, see ForTask.
+type Output int
+
+const (
+	Raw      Output = iota // Written straight through as it happens
+	Prefixed               // Each line is prefixed with the task's name e.g. "[build] ok"
+	Grouped                // Held back and written all at once when the task finishes
+)
+
+// outputs maps the names of the Outputs to them.
+var outputs = map[string]Output{
+	"raw":      Raw,
+	"prefixed": Prefixed,
+	"grouped":  Grouped,
+}
+
+// labelStyles are the colours task labels are shown in for Prefixed output,
+// a task's label is always the same colour.
+var labelStyles = []hue.Style{
+	hue.Cyan,
+	hue.Green,
+	hue.Yellow,
+	hue.Blue,
+	hue.Magenta,
+	hue.BrightCyan,
+	hue.BrightGreen,
+	hue.BrightYellow,
+	hue.BrightBlue,
+	hue.BrightMagenta,
+}
+
+// ParseOutput returns the Output called name, one of "raw", "prefixed" or "grouped".
+func ParseOutput(name string) (Output, error) {
+	output, ok := outputs[name]
+	if !ok {
+		names := maps.Keys(outputs)
+		slices.Sort(names)
+		return Raw, fmt.Errorf("invalid output %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return output, nil
+}
+
+// String implements fmt.Stringer for an Output.
+func (o Output) String() string {
+	for name, output := range outputs {
+		if output == o {
+			return name
+		}
+	}
+	return fmt.Sprintf("Output(%d)", int(o))
+}
+
+// ForTask returns the stream the task called name should use to write it's output to s
+// in the given Output mode, along with a function to call once the task has finished
+// that writes anything held back. Stdin is always passed straight through.
+func (s IOStream) ForTask(name string, output Output) (IOStream, func() error) {
+	switch output {
+	case Prefixed:
+		style := labelStyles[labelIndex(name)]
+		prefix := style.Sprintf("[%s]", name) + " "
+		stdout := NewLineWriter(s.Stdout, prefix)
+		stderr := NewLineWriter(s.Stderr, prefix)
+		stream := IOStream{Stdin: s.Stdin, Stdout: stdout, Stderr: stderr}
+		return stream, func() error {
+			return errors.Join(stdout.Flush(), stderr.Flush())
+		}
+	case Grouped:
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		stream := IOStream{Stdin: s.Stdin, Stdout: stdout, Stderr: stderr}
+		return stream, func() error {
+			_, outErr := stdout.WriteTo(s.Stdout)
+			_, errErr := stderr.WriteTo(s.Stderr)
+			return errors.Join(outErr, errErr)
+		}
+	default:
+		return s, func() error { return nil }
+	}
+}
+
+// labelIndex returns the index into labelStyles of the colour for the task called name.
+func labelIndex(name string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(name)) //nolint: errcheck // Writing to a hash never fails
+	return int(hash.Sum32() % uint32(len(labelStyles)))
+}
+
+// LineWriter is an io.Writer that writes whole lines to another io.Writer, each
+// one starting with a prefix. Partial lines are held back until they're finished
+// or the LineWriter is flushed.
+type LineWriter struct {
+	w      io.Writer    // Where lines are written to
+	prefix string       // Written before every line
+	buf    bytes.Buffer // The unfinished line so far
+	mu     sync.Mutex   // Protects buf, so stdout and stderr may share a LineWriter
+}
+
+// NewLineWriter returns a LineWriter that writes lines to w with the given prefix.
+func NewLineWriter(w io.Writer, prefix string) *LineWriter {
+	return &LineWriter{w: w, prefix: prefix}
+}
+
+// Write implements io.Writer for a LineWriter, writing any lines that are now
+// finished to the underlying writer.
+func (l *LineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf.Write(p)
+	for {
+		i := bytes.IndexByte(l.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := l.buf.Next(i + 1)
+		if _, err := io.WriteString(l.w, l.prefix+string(line)); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any unfinished line to the underlying writer, ending it with a newline.
+func (l *LineWriter) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buf.Len() == 0 {
+		return nil
+	}
+	line := l.buf.String()
+	l.buf.Reset()
+	_, err := io.WriteString(l.w, l.prefix+line+"\n")
+	return err
+}
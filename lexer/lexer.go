@@ -53,6 +53,7 @@ type Lexer struct {
 	line      int              // Current line in the input
 	startLine int              // The line on which the current token started
 	width     int              // Width of the last rune read from input
+	depth     int              // Number of open braces, 1 in a task body and more inside conditional blocks
 }
 
 // rest returns the string from the current lexer position to the end of the input.
@@ -84,6 +85,20 @@ func (l *Lexer) atEOL() bool {
 	return l.peek() == '\n' || strings.HasPrefix(l.rest(), "\r\n")
 }
 
+// atCondition returns whether or not the lexer is sat on an 'if' keyword
+// introducing a condition.
+func (l *Lexer) atCondition() bool {
+	return strings.HasPrefix(l.rest(), token.IF.String()+" ")
+}
+
+// atBlockStart returns whether or not the current line in a task body opens
+// a conditional block e.g. 'if os == "linux" {', as opposed to being a shell
+// command that happens to start with 'if'.
+func (l *Lexer) atBlockStart() bool {
+	line, _, _ := strings.Cut(l.rest(), "\n")
+	return l.atCondition() && strings.HasSuffix(strings.TrimSpace(line), token.LBRACE.String())
+}
+
 // atEOF returns whether or not the lexer is currently at the end of a file.
 func (l *Lexer) atEOF() bool {
 	return l.pos >= len(l.input)
@@ -214,6 +229,7 @@ func (l *Lexer) run() {
 // Whitespace: ignored
 // Comments: preceded with a '#'
 // Global variables
+// Task attributes: preceded with a '@'
 // Task definitions
 // EOF
 // Anything else is an error.
@@ -225,6 +241,8 @@ func lexStart(l *Lexer) lexFn {
 		return lexHash
 	case strings.HasPrefix(l.rest(), token.TASK.String()):
 		return lexTaskKeyword
+	case strings.HasPrefix(l.rest(), token.AT.String()):
+		return lexAttribute
 	case isValidIdent(l.peek()):
 		return lexIdent
 	case l.atEOF():
@@ -282,6 +300,9 @@ func lexRightParen(l *Lexer) lexFn {
 	case strings.HasPrefix(l.rest(), token.OUTPUT.String()):
 		// Task output declaration
 		return lexOutputOperator
+	case l.atCondition():
+		// Conditional task e.g. task open() if os == "darwin" {
+		return lexIf
 	case l.atEOL(), l.atEOF(), isValidIdent(r):
 		// Just lexed a global variable function call and we're either
 		// at EOL, EOF, or there's another row of global variable declarations below
@@ -289,6 +310,15 @@ func lexRightParen(l *Lexer) lexFn {
 	case r == '#':
 		// If a global function call precedes a commented task
 		return lexHash
+	case r == '@':
+		// Another attribute after one with arguments e.g. @dir("web") @private
+		return lexAttribute
+	case r == ')':
+		// End of a nested builtin call e.g. join(ROOT, exec("pwd"))
+		return lexRightParen
+	case r == ',':
+		// More arguments after a nested builtin call
+		return lexComma
 	case r == '"', r == '(':
 		// This is when someone forgets a '->' when declaring task outputs
 		return l.error(syntaxError{
@@ -302,6 +332,33 @@ func lexRightParen(l *Lexer) lexFn {
 	}
 }
 
+// lexAttribute scans a task attribute e.g. @private or @timeout("5m"), any
+// arguments are lexed in the same way as a builtin function call.
+func lexAttribute(l *Lexer) lexFn {
+	l.absorb(token.AT)
+	l.emit(token.AT)
+
+	if !isValidIdent(l.peek()) {
+		return l.error(syntaxError{
+			message: "Attribute missing name, expected e.g. '@private'",
+			context: l.getLine(),
+			line:    l.line,
+			pos:     l.pos,
+		})
+	}
+	for isValidIdent(l.peek()) {
+		l.next()
+	}
+	l.emit(token.IDENT)
+
+	if l.peek() == '(' {
+		return lexLeftParen
+	}
+
+	l.skipWhitespace()
+	return lexStart
+}
+
 // lexOutputOperator scans a task output operator.
 func lexOutputOperator(l *Lexer) lexFn {
 	l.absorb(token.OUTPUT)
@@ -346,6 +403,7 @@ func lexOutputOperator(l *Lexer) lexFn {
 func lexLeftBrace(l *Lexer) lexFn {
 	l.absorb(token.LBRACE)
 	l.emit(token.LBRACE)
+	l.depth = 1
 	l.skipWhitespace()
 	return lexTaskBody
 }
@@ -354,9 +412,123 @@ func lexLeftBrace(l *Lexer) lexFn {
 func lexRightBrace(l *Lexer) lexFn {
 	l.absorb(token.RBRACE)
 	l.emit(token.RBRACE)
+	l.depth = 0
 	return lexStart
 }
 
+// lexIf scans an 'if' keyword introducing a condition.
+func lexIf(l *Lexer) lexFn {
+	l.absorb(token.IF)
+	l.emit(token.IF)
+	return lexCondition
+}
+
+// lexCondition scans the expression in a condition, up to and including the
+// opening brace of the block it guards.
+func lexCondition(l *Lexer) lexFn {
+	l.skipWhitespace()
+
+	for _, op := range [...]token.Type{token.EQ, token.NEQ, token.AND, token.OR} {
+		if strings.HasPrefix(l.rest(), op.String()) {
+			l.absorb(op)
+			l.emit(op)
+			return lexCondition
+		}
+	}
+
+	switch r := l.next(); {
+	case r == '"':
+		return lexConditionString
+	case isValidIdent(r):
+		for isValidIdent(l.peek()) {
+			l.next()
+		}
+		l.emit(token.IDENT)
+		return lexCondition
+	case r == '{':
+		l.backup()
+		if l.depth == 0 {
+			// Condition on the task itself, what follows is the task body
+			return lexLeftBrace
+		}
+		return lexBlockStart
+	default:
+		l.backup()
+		return l.error(syntaxError{
+			message: fmt.Sprintf("Unexpected token '%s' in condition, expected a string, variable, operator or '{'", string(r)),
+			context: l.getLine(),
+			line:    l.line,
+			pos:     l.pos,
+		})
+	}
+}
+
+// lexConditionString scans a quoted string used in a condition, the opening
+// quote has already been consumed.
+func lexConditionString(l *Lexer) lexFn {
+	for {
+		if l.atEOF() || l.atEOL() {
+			return l.error(syntaxError{
+				message: fmt.Sprintf("String literal missing closing quote: %s", l.all()),
+				context: l.getLine(),
+				line:    l.line,
+				pos:     l.pos,
+			})
+		}
+		if l.next() == '"' {
+			break
+		}
+	}
+	l.emit(token.STRING)
+	return lexCondition
+}
+
+// lexBlockStart scans the opening brace of a conditional block inside a task body.
+func lexBlockStart(l *Lexer) lexFn {
+	l.absorb(token.LBRACE)
+	l.emit(token.LBRACE)
+	l.depth++
+	l.skipWhitespace()
+	return lexTaskBody
+}
+
+// lexBlockEnd scans the closing brace of a conditional block inside a task body,
+// along with any else that follows it.
+func lexBlockEnd(l *Lexer) lexFn {
+	l.absorb(token.RBRACE)
+	l.emit(token.RBRACE)
+	l.depth--
+
+	// Only skip whitespace on this line, an else must be on the same line as the '}'
+	for r := l.peek(); r == ' ' || r == '\t'; r = l.peek() {
+		l.next()
+	}
+	l.discard()
+
+	if !strings.HasPrefix(l.rest(), token.ELSE.String()+" ") && !strings.HasPrefix(l.rest(), token.ELSE.String()+"{") {
+		l.skipWhitespace()
+		return lexTaskBody
+	}
+
+	l.absorb(token.ELSE)
+	l.emit(token.ELSE)
+	l.skipWhitespace()
+
+	switch {
+	case l.atCondition():
+		return lexIf
+	case l.peek() == '{':
+		return lexBlockStart
+	default:
+		return l.error(syntaxError{
+			message: "Expected '{' or 'if' after 'else'",
+			context: l.getLine(),
+			line:    l.line,
+			pos:     l.pos,
+		})
+	}
+}
+
 // lexTaskBody scans the body of a task declaration.
 func lexTaskBody(l *Lexer) lexFn {
 	if l.atEOF() {
@@ -369,18 +541,47 @@ func lexTaskBody(l *Lexer) lexFn {
 	}
 	l.skipWhitespace()
 
+	if l.atBlockStart() {
+		return lexIf
+	}
+
 	switch r := l.next(); {
 	case r == '}':
 		l.backup()
+		if l.depth > 1 {
+			return lexBlockEnd
+		}
 		return lexRightBrace
 	case unicode.IsLetter(r):
 		// Assumes command starts with a letter, pretty safe for 99.9% of commands
 		return lexTaskCommands
+	case isCommandModifier(r):
+		l.backup()
+		return lexCommandModifiers
 	default:
 		return unexpectedToken
 	}
 }
 
+// lexCommandModifiers scans the modifiers at the start of a command e.g. the '@' in
+// '@echo hello', these change how spok runs the command and aren't part of it.
+func lexCommandModifiers(l *Lexer) lexFn {
+	for {
+		switch l.next() {
+		case '@':
+			l.emit(token.AT)
+		case '-':
+			l.emit(token.MINUS)
+		case ' ', '\t':
+			// Allowed between the modifiers and the command e.g. '- rm build'
+			l.discard()
+		default:
+			l.backup()
+			return lexTaskCommands
+		}
+	}
+}
+
 // lexTaskCommands scans line(s) of commands in a task body.
 func lexTaskCommands(l *Lexer) lexFn {
 	// A command can end in a newline or not similar to a line in a go function
@@ -397,6 +598,12 @@ func lexTaskCommands(l *Lexer) lexFn {
 			l.backup()
 			l.emit(token.COMMAND)
 			l.skipWhitespace()
+			if l.atBlockStart() {
+				return lexIf
+			}
+			if isCommandModifier(l.peek()) {
+				return lexCommandModifiers
+			}
 		case strings.HasPrefix(l.rest(), token.LINTERP.String()):
 			// We've hit an opening interpolation, ignore this here it just becomes
 			// part of the command text
@@ -416,6 +623,9 @@ func lexTaskCommands(l *Lexer) lexFn {
 				l.emit(token.COMMAND)
 			}
 			l.skipWhitespace()
+			if l.depth > 1 {
+				return lexBlockEnd
+			}
 			return lexRightBrace
 		case l.atEOF(), r == '#':
 			l.error(syntaxError{
@@ -493,6 +703,18 @@ func lexIdent(l *Lexer) lexFn {
 	case l.peek() == '{':
 		// Just lexed an ident used in a task output
 		return lexLeftBrace
+	case l.atCondition():
+		// Just lexed an ident used in the output of a conditional task
+		return lexIf
+	default:
+		return lexAfterIdentError
+	}
+}
+
+// lexAfterIdentError emits the most helpful error it can for something
+// unexpected immediately following an identifier.
+func lexAfterIdentError(l *Lexer) lexFn {
+	switch {
 	case unicode.IsPunct(l.peek()):
 		// This is normally a filepath-like string like "file.go" but without the opening quote
 		// or it's a missing comma in a series of args
@@ -524,6 +746,11 @@ func lexArgs(l *Lexer) lexFn {
 	// Arguments can only be strings (filenames or globs) or idents
 	l.skipWhitespace()
 
+	if l.atCondition() {
+		// The string was the output of a conditional task
+		return lexIf
+	}
+
 	switch r := l.next(); {
 	case r == ')':
 		// No task dependency
@@ -588,7 +815,7 @@ func lexDeclare(l *Lexer) lexFn {
 		return lexString
 	case isValidIdent(r):
 		// We have something unquoted, i.e. another ident
-		return lexIdent
+		return lexDeclaredIdent
 	default:
 		// Anything else is disallowed
 		l.backup()
@@ -596,6 +823,36 @@ func lexDeclare(l *Lexer) lexFn {
 	}
 }
 
+// lexDeclaredIdent scans an identifier on the RHS of a declaration, either
+// the name of a builtin function or a reference to another variable.
+func lexDeclaredIdent(l *Lexer) lexFn {
+	for {
+		r := l.next()
+		if !isValidIdent(r) {
+			l.backup()
+			break
+		}
+	}
+	l.emit(token.IDENT)
+
+	// Only skip whitespace on this line, a variable reference is allowed
+	// to be followed by another declaration on the next one
+	for r := l.peek(); r == ' ' || r == '\t'; r = l.peek() {
+		l.next()
+	}
+	l.discard()
+
+	switch {
+	case l.peek() == '(':
+		// A builtin function call
+		return lexLeftParen
+	case l.atEOL(), l.atEOF():
+		return lexStart
+	default:
+		return lexAfterIdentError
+	}
+}
+
 // lexString scans a quoted string, the opening quote is already known to exist,
 // the emitted string token will always contain the quotes i.e. the token value
 // in go-ish syntax will be `"hello"`, not simply "hello".
@@ -628,7 +885,12 @@ func lexString(l *Lexer) lexFn {
 
 // isValidIdent reports whether a rune is valid in an identifier.
 func isValidIdent(r rune) bool {
-	return unicode.IsLetter(r) || r == '_'
+	return token.IsIdentRune(r)
+}
+
+// isCommandModifier reports whether r is one of the modifiers a command may start with.
+func isCommandModifier(r rune) bool {
+	return r == '@' || r == '-'
 }
 
 // isASCII reports whether or not the rune is a valid ASCII character.
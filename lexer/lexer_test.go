@@ -31,6 +31,14 @@ var (
 	tLBrace  = newToken(token.LBRACE, "{")
 	tRBrace  = newToken(token.RBRACE, "}")
 	tOutput  = newToken(token.OUTPUT, "->")
+	tIf      = newToken(token.IF, "if")
+	tElse    = newToken(token.ELSE, "else")
+	tEq      = newToken(token.EQ, "==")
+	tNeq     = newToken(token.NEQ, "!=")
+	tAnd     = newToken(token.AND, "&&")
+	tOr      = newToken(token.OR, "||")
+	tAt      = newToken(token.AT, "@")
+	tMinus   = newToken(token.MINUS, "-")
 )
 
 var lexTests = []lexTest{
@@ -138,6 +146,19 @@ var lexTests = []lexTest{
 		input:  `TEST := VAR`,
 		tokens: []token.Token{newToken(token.IDENT, "TEST"), tDeclare, newToken(token.IDENT, "VAR"), tEOF},
 	},
+	{
+		name:  "global variable ident followed by another line",
+		input: "TEST := VAR\nOTHER := TEST\n",
+		tokens: []token.Token{
+			newToken(token.IDENT, "TEST"),
+			tDeclare,
+			newToken(token.IDENT, "VAR"),
+			newToken(token.IDENT, "OTHER"),
+			tDeclare,
+			newToken(token.IDENT, "TEST"),
+			tEOF,
+		},
+	},
 	{
 		name:  "global variable bad RHS",
 		input: `TEST := *`,
@@ -212,6 +233,44 @@ var lexTests = []lexTest{
 			tEOF,
 		},
 	},
+	{
+		name:  "global variable nested function RHS",
+		input: `BIN := join(ROOT, exec("pwd"), "bin")`,
+		tokens: []token.Token{
+			newToken(token.IDENT, "BIN"),
+			tDeclare,
+			newToken(token.IDENT, "join"),
+			tLParen,
+			newToken(token.IDENT, "ROOT"),
+			tComma,
+			newToken(token.IDENT, "exec"),
+			tLParen,
+			newToken(token.STRING, `"pwd"`),
+			tRParen,
+			tComma,
+			newToken(token.STRING, `"bin"`),
+			tRParen,
+			tEOF,
+		},
+	},
+	{
+		name:  "global variable nested function RHS last argument",
+		input: `BIN := join(ROOT, exec("pwd"))`,
+		tokens: []token.Token{
+			newToken(token.IDENT, "BIN"),
+			tDeclare,
+			newToken(token.IDENT, "join"),
+			tLParen,
+			newToken(token.IDENT, "ROOT"),
+			tComma,
+			newToken(token.IDENT, "exec"),
+			tLParen,
+			newToken(token.STRING, `"pwd"`),
+			tRParen,
+			tRParen,
+			tEOF,
+		},
+	},
 	{
 		name:  "global variable join RHS no commas",
 		input: `TEST := join(ROOT "docs" "build")`,
@@ -955,6 +1014,278 @@ var lexTests = []lexTest{
 			tEOF,
 		},
 	},
+	{
+		name:  "conditional task",
+		input: `task open() if os == "darwin" { open index.html }`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "open"),
+			tLParen,
+			tRParen,
+			tIf,
+			newToken(token.IDENT, "os"),
+			tEq,
+			newToken(token.STRING, `"darwin"`),
+			tLBrace,
+			newToken(token.COMMAND, "open index.html"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name:  "conditional task with output",
+		input: `task build("main.go") -> "bin" if os != "windows" && arch == "arm64" || CI { go build }`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "build"),
+			tLParen,
+			newToken(token.STRING, `"main.go"`),
+			tRParen,
+			tOutput,
+			newToken(token.STRING, `"bin"`),
+			tIf,
+			newToken(token.IDENT, "os"),
+			tNeq,
+			newToken(token.STRING, `"windows"`),
+			tAnd,
+			newToken(token.IDENT, "arch"),
+			tEq,
+			newToken(token.STRING, `"arm64"`),
+			tOr,
+			newToken(token.IDENT, "CI"),
+			tLBrace,
+			newToken(token.COMMAND, "go build"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name:  "conditional task with ident output",
+		input: `task build() -> BIN if CI { go build }`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "build"),
+			tLParen,
+			tRParen,
+			tOutput,
+			newToken(token.IDENT, "BIN"),
+			tIf,
+			newToken(token.IDENT, "CI"),
+			tLBrace,
+			newToken(token.COMMAND, "go build"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name:  "conditional task bad condition",
+		input: `task open() if os = "darwin" { open index.html }`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "open"),
+			tLParen,
+			tRParen,
+			tIf,
+			newToken(token.IDENT, "os"),
+			newToken(token.ERROR, "SyntaxError: Unexpected token '=' in condition, expected a string, variable, operator or '{' (Line 1). \n\n1 |\ttask open() if os = \"darwin\" { open index.html }"),
+		},
+	},
+	{
+		name: "conditional commands",
+		input: `task open() {
+			echo "opening"
+			if os == "darwin" {
+				open index.html
+			} else if os == "windows" {
+				start index.html
+			} else {
+				xdg-open index.html
+			}
+			echo "done"
+		}`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "open"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			newToken(token.COMMAND, `echo "opening"`),
+			tIf,
+			newToken(token.IDENT, "os"),
+			tEq,
+			newToken(token.STRING, `"darwin"`),
+			tLBrace,
+			newToken(token.COMMAND, "open index.html"),
+			tRBrace,
+			tElse,
+			tIf,
+			newToken(token.IDENT, "os"),
+			tEq,
+			newToken(token.STRING, `"windows"`),
+			tLBrace,
+			newToken(token.COMMAND, "start index.html"),
+			tRBrace,
+			tElse,
+			tLBrace,
+			newToken(token.COMMAND, "xdg-open index.html"),
+			tRBrace,
+			newToken(token.COMMAND, `echo "done"`),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name: "conditional commands first in body",
+		input: `task open() {
+			if CI {
+				echo "ci"
+			}
+		}`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "open"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			tIf,
+			newToken(token.IDENT, "CI"),
+			tLBrace,
+			newToken(token.COMMAND, `echo "ci"`),
+			tRBrace,
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name: "shell if is a command",
+		input: `task check() {
+			if [ -f go.mod ]; then echo "go"; fi
+		}`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "check"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			newToken(token.COMMAND, `if [ -f go.mod ]; then echo "go"; fi`),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name:  "task attributes",
+		input: `@timeout("5m") @dir("web") @private task build() { go build }`,
+		tokens: []token.Token{
+			tAt,
+			newToken(token.IDENT, "timeout"),
+			tLParen,
+			newToken(token.STRING, `"5m"`),
+			tRParen,
+			tAt,
+			newToken(token.IDENT, "dir"),
+			tLParen,
+			newToken(token.STRING, `"web"`),
+			tRParen,
+			tAt,
+			newToken(token.IDENT, "private"),
+			tTask,
+			newToken(token.IDENT, "build"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			newToken(token.COMMAND, "go build"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name: "task attributes on their own line with docstring",
+		input: `# Build the web app
+@env("NODE_ENV", "production") @private
+task build() { npm run build }`,
+		tokens: []token.Token{
+			tHash,
+			newToken(token.COMMENT, " Build the web app"),
+			tAt,
+			newToken(token.IDENT, "env"),
+			tLParen,
+			newToken(token.STRING, `"NODE_ENV"`),
+			tComma,
+			newToken(token.STRING, `"production"`),
+			tRParen,
+			tAt,
+			newToken(token.IDENT, "private"),
+			tTask,
+			newToken(token.IDENT, "build"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			newToken(token.COMMAND, "npm run build"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name: "command modifiers",
+		input: `task clean() {
+			@echo "cleaning"
+			-rm build
+			@- rm dist
+		}`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "clean"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			tAt,
+			newToken(token.COMMAND, `echo "cleaning"`),
+			tMinus,
+			newToken(token.COMMAND, "rm build"),
+			tAt,
+			tMinus,
+			newToken(token.COMMAND, "rm dist"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name:  "command modifiers single line",
+		input: `task clean() { -rm build }`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "clean"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			tMinus,
+			newToken(token.COMMAND, "rm build"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name:  "command modifier in the middle is shell text",
+		input: `task list() { ls -la }`,
+		tokens: []token.Token{
+			tTask,
+			newToken(token.IDENT, "list"),
+			tLParen,
+			tRParen,
+			tLBrace,
+			newToken(token.COMMAND, "ls -la"),
+			tRBrace,
+			tEOF,
+		},
+	},
+	{
+		name:  "task attribute missing name",
+		input: `@ task build() { go build }`,
+		tokens: []token.Token{
+			tAt,
+			newToken(token.ERROR, "SyntaxError: Attribute missing name, expected e.g. '@private' (Line 1). \n\n1 |\t@ task build() { go build }"),
+		},
+	},
 }
 
 // collect gathers the emitted tokens into a slice for comparison.
@@ -47,20 +47,34 @@ func (p *Parser) Parse() (ast.Tree, error) {
 
 		case next.Is(token.HASH):
 			comment := p.parseComment()
-			switch {
-			case p.next().Is(token.TASK):
+			switch next := p.next(); {
+			case next.Is(token.TASK):
 				// The comment was a tasks' docstring
 				task, err := p.parseTask(comment)
 				if err != nil {
 					return tree, err
 				}
 				tree.Append(task)
+			case next.Is(token.AT):
+				// The comment was the docstring of a task with attributes
+				task, err := p.parseAttributedTask(comment)
+				if err != nil {
+					return tree, err
+				}
+				tree.Append(task)
 			default:
 				// Just a normal comment
 				p.backup()
 				tree.Append(comment)
 			}
 
+		case next.Is(token.AT):
+			task, err := p.parseAttributedTask(ast.Comment{NodeType: ast.NodeComment})
+			if err != nil {
+				return tree, err
+			}
+			tree.Append(task)
+
 		case next.Is(token.IDENT):
 			assign, err := p.parseAssign(next)
 			if err != nil {
@@ -80,7 +94,7 @@ func (p *Parser) Parse() (ast.Tree, error) {
 			// Illegal top level token that slipped through the lexer somehow
 			// unlikely but let's catch it anyway
 			return tree, illegalToken{
-				expected:    []token.Type{token.HASH, token.IDENT, token.TASK},
+				expected:    []token.Type{token.HASH, token.IDENT, token.AT, token.TASK},
 				encountered: next,
 				line:        p.getLine(next),
 			}
@@ -154,7 +168,8 @@ func (p *Parser) parseString(s token.Token) ast.String {
 	}
 }
 
-// parseFunction parses an ident token into a function ast node.
+// parseFunction parses an ident token into a function ast node, arguments
+// may themselves be function calls e.g. join(ROOT, exec("pwd")).
 func (p *Parser) parseFunction(ident token.Token) (ast.Function, error) {
 	args := []ast.Node{}
 
@@ -168,7 +183,19 @@ func (p *Parser) parseFunction(ident token.Token) (ast.Function, error) {
 		case next.Is(token.STRING):
 			args = append(args, p.parseString(next))
 		case next.Is(token.IDENT):
-			args = append(args, p.parseIdent(next))
+			if !p.next().Is(token.LPAREN) {
+				// Just a variable
+				p.backup()
+				args = append(args, p.parseIdent(next))
+				break
+			}
+			// A nested function call
+			p.backup()
+			fn, err := p.parseFunction(next)
+			if err != nil {
+				return ast.Function{}, err
+			}
+			args = append(args, fn)
 		case next.Is(token.COMMA):
 			// Absorb a comma
 		case next.Is(token.ERROR):
@@ -258,6 +285,18 @@ func (p *Parser) parseTask(doc ast.Comment) (ast.Task, error) {
 		return ast.Task{}, err
 	}
 
+	var condition ast.Node
+	if p.next().Is(token.IF) {
+		cond, err := p.parseCondition()
+		if err != nil {
+			return ast.Task{}, err
+		}
+		condition = cond
+	} else {
+		// Not a conditional task, undo our call to p.next()
+		p.backup()
+	}
+
 	// If next is not '{', we have a problem
 	err = p.expect(token.LBRACE)
 	if err != nil {
@@ -270,6 +309,7 @@ func (p *Parser) parseTask(doc ast.Comment) (ast.Task, error) {
 	}
 
 	task := ast.Task{
+		Condition:    condition,
 		Name:         name,
 		Docstring:    doc,
 		Dependencies: dependencies,
@@ -281,6 +321,71 @@ func (p *Parser) parseTask(doc ast.Comment) (ast.Task, error) {
 	return task, nil
 }
 
+// parseAttributedTask parses a task preceded by a list of attributes, the '@'
+// of the first attribute has already been consumed.
+func (p *Parser) parseAttributedTask(doc ast.Comment) (ast.Task, error) {
+	attributes, err := p.parseAttributes()
+	if err != nil {
+		return ast.Task{}, err
+	}
+
+	// Attributes may only be attached to a task
+	if err := p.expect(token.TASK); err != nil {
+		return ast.Task{}, err
+	}
+
+	task, err := p.parseTask(doc)
+	if err != nil {
+		return ast.Task{}, err
+	}
+	task.Attributes = attributes
+
+	return task, nil
+}
+
+// parseAttributes parses a list of attributes up to, but not including, the
+// next thing that isn't one. The '@' of the first attribute has already been consumed.
+func (p *Parser) parseAttributes() ([]ast.Attribute, error) {
+	var attributes []ast.Attribute
+	for {
+		name := p.next()
+		switch {
+		case name.Is(token.ERROR):
+			return nil, errors.New(name.Value)
+		case !name.Is(token.IDENT):
+			return nil, illegalToken{
+				expected:    []token.Type{token.IDENT},
+				encountered: name,
+				line:        p.getLine(name),
+			}
+		}
+
+		attribute := ast.Attribute{
+			Name:      p.parseIdent(name),
+			Arguments: []ast.Node{},
+			NodeType:  ast.NodeAttribute,
+		}
+
+		if p.next().Is(token.LPAREN) {
+			// Arguments are parsed exactly like those to a builtin function
+			p.backup()
+			fn, err := p.parseFunction(name)
+			if err != nil {
+				return nil, err
+			}
+			attribute.Arguments = fn.Arguments
+		} else {
+			p.backup()
+		}
+		attributes = append(attributes, attribute)
+
+		if !p.next().Is(token.AT) {
+			p.backup()
+			return attributes, nil
+		}
+	}
+}
+
 // parseTaskDependencies parses any declared dependencies in a task and returns
 // the []ast.Node containing them.
 func (p *Parser) parseTaskDependencies() ([]ast.Node, error) {
@@ -359,9 +464,10 @@ func (p *Parser) parseTaskOutputs() ([]ast.Node, error) {
 	return outputs, nil
 }
 
-// parseTaskCommands parses any number of command tokens in a task body and returns them.
-func (p *Parser) parseTaskCommands() ([]ast.Command, error) {
-	commands := []ast.Command{}
+// parseTaskCommands parses any number of command tokens and conditional blocks
+// in a task body and returns them, consuming the closing brace.
+func (p *Parser) parseTaskCommands() ([]ast.Node, error) {
+	commands := []ast.Node{}
 	for {
 		next := p.next()
 		if next.Is(token.ERROR) {
@@ -373,11 +479,160 @@ func (p *Parser) parseTaskCommands() ([]ast.Command, error) {
 		if next.Is(token.COMMAND) {
 			commands = append(commands, p.parseCommand(next))
 		}
+		if next.Is(token.AT) || next.Is(token.MINUS) {
+			command, err := p.parseModifiedCommand(next)
+			if err != nil {
+				return commands, err
+			}
+			commands = append(commands, command)
+		}
+		if next.Is(token.IF) {
+			conditional, err := p.parseConditional()
+			if err != nil {
+				return commands, err
+			}
+			commands = append(commands, conditional)
+		}
 	}
 
 	return commands, nil
 }
 
+// parseConditional parses a conditional block of commands in a task body along with
+// any else or else if blocks that follow it, the 'if' has already been consumed.
+func (p *Parser) parseConditional() (ast.Conditional, error) {
+	condition, err := p.parseCondition()
+	if err != nil {
+		return ast.Conditional{}, err
+	}
+
+	if err := p.expect(token.LBRACE); err != nil {
+		return ast.Conditional{}, err
+	}
+
+	then, err := p.parseTaskCommands()
+	if err != nil {
+		return ast.Conditional{}, err
+	}
+
+	conditional := ast.Conditional{
+		Condition: condition,
+		Then:      then,
+		NodeType:  ast.NodeConditional,
+	}
+
+	if !p.next().Is(token.ELSE) {
+		p.backup()
+		return conditional, nil
+	}
+
+	switch next := p.next(); {
+	case next.Is(token.IF):
+		elseIf, err := p.parseConditional()
+		if err != nil {
+			return ast.Conditional{}, err
+		}
+		conditional.Else = []ast.Node{elseIf}
+	case next.Is(token.LBRACE):
+		otherwise, err := p.parseTaskCommands()
+		if err != nil {
+			return ast.Conditional{}, err
+		}
+		conditional.Else = otherwise
+	case next.Is(token.ERROR):
+		return ast.Conditional{}, errors.New(next.Value)
+	default:
+		return ast.Conditional{}, illegalToken{
+			expected:    []token.Type{token.IF, token.LBRACE},
+			encountered: next,
+			line:        p.getLine(next),
+		}
+	}
+
+	return conditional, nil
+}
+
+// parseCondition parses a boolean expression following an 'if', the 'if' has
+// already been consumed and the opening brace of the block it guards is left
+// for the caller.
+//
+// && binds tighter than || so 'a || b && c' is parsed as 'a || (b && c)'.
+func (p *Parser) parseCondition() (ast.Condition, error) {
+	return p.parseBinary(token.OR, func() (ast.Condition, error) {
+		return p.parseBinary(token.AND, p.parseComparison)
+	})
+}
+
+// parseBinary parses one or more operands joined by op, each operand
+// parsed by the operand function.
+func (p *Parser) parseBinary(op token.Type, operand func() (ast.Condition, error)) (ast.Condition, error) {
+	left, err := operand()
+	if err != nil {
+		return ast.Condition{}, err
+	}
+
+	for p.next().Is(op) {
+		right, err := operand()
+		if err != nil {
+			return ast.Condition{}, err
+		}
+		left = ast.Condition{
+			Left:     left,
+			Right:    right,
+			Operator: op.String(),
+			NodeType: ast.NodeCondition,
+		}
+	}
+	p.backup()
+
+	return left, nil
+}
+
+// parseComparison parses either a single operand or two operands compared
+// with == or !=.
+func (p *Parser) parseComparison() (ast.Condition, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return ast.Condition{}, err
+	}
+
+	op := p.next()
+	if !op.Is(token.EQ) && !op.Is(token.NEQ) {
+		p.backup()
+		return ast.Condition{Left: left, NodeType: ast.NodeCondition}, nil
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return ast.Condition{}, err
+	}
+
+	return ast.Condition{
+		Left:     left,
+		Right:    right,
+		Operator: op.Value,
+		NodeType: ast.NodeCondition,
+	}, nil
+}
+
+// parseOperand parses a single string or ident in a condition.
+func (p *Parser) parseOperand() (ast.Node, error) {
+	switch next := p.next(); {
+	case next.Is(token.STRING):
+		return p.parseString(next), nil
+	case next.Is(token.IDENT):
+		return p.parseIdent(next), nil
+	case next.Is(token.ERROR):
+		return nil, errors.New(next.Value)
+	default:
+		return nil, illegalToken{
+			expected:    []token.Type{token.STRING, token.IDENT},
+			encountered: next,
+			line:        p.getLine(next),
+		}
+	}
+}
+
 // parseCommand parses task commands into ast command nodes.
 func (p *Parser) parseCommand(command token.Token) ast.Command {
 	return ast.Command{
@@ -386,6 +641,33 @@ func (p *Parser) parseCommand(command token.Token) ast.Command {
 	}
 }
 
+// parseModifiedCommand parses a task command that starts with modifiers e.g. @echo hello,
+// modifier is the first of them, which has already been consumed.
+func (p *Parser) parseModifiedCommand(modifier token.Token) (ast.Command, error) {
+	var silent, ignoreError bool
+	for next := modifier; ; next = p.next() {
+		switch {
+		case next.Is(token.ERROR):
+			return ast.Command{}, errors.New(next.Value)
+		case next.Is(token.AT):
+			silent = true
+		case next.Is(token.MINUS):
+			ignoreError = true
+		case next.Is(token.COMMAND) && next.Value != "":
+			command := p.parseCommand(next)
+			command.Silent = silent
+			command.IgnoreError = ignoreError
+			return command, nil
+		default:
+			return ast.Command{}, illegalToken{
+				expected:    []token.Type{token.AT, token.MINUS, token.COMMAND},
+				encountered: next,
+				line:        p.getLine(next),
+			}
+		}
+	}
+}
+
 // getLine returns the line of the input on which the given token appears
 // primarily used to provide context for parser errors given back to the user.
 func (p *Parser) getLine(token token.Token) string {
@@ -50,6 +50,13 @@ var (
 	tLBrace  = newToken(token.LBRACE, "{")
 	tRBrace  = newToken(token.RBRACE, "}")
 	tOutput  = newToken(token.OUTPUT, "->")
+	tIf      = newToken(token.IF, "if")
+	tElse    = newToken(token.ELSE, "else")
+	tEq      = newToken(token.EQ, "==")
+	tAnd     = newToken(token.AND, "&&")
+	tOr      = newToken(token.OR, "||")
+	tAt      = newToken(token.AT, "@")
+	tMinus   = newToken(token.MINUS, "-")
 	tEOF     = newToken(token.EOF, "")
 )
 
@@ -189,6 +196,54 @@ func TestParseFunction(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "nested",
+			stream: []token.Token{
+				newToken(token.IDENT, "join"),
+				tLParen,
+				newToken(token.IDENT, "ROOT"),
+				tComma,
+				newToken(token.IDENT, "exec"),
+				tLParen,
+				newToken(token.STRING, `"pwd"`),
+				tRParen,
+				tComma,
+				newToken(token.STRING, `"bin"`),
+				tRParen,
+				tEOF,
+			},
+			want: ast.Function{
+				Name: ast.Ident{
+					Name:     "join",
+					NodeType: ast.NodeIdent,
+				},
+				Arguments: []ast.Node{
+					ast.Ident{
+						Name:     "ROOT",
+						NodeType: ast.NodeIdent,
+					},
+					ast.Function{
+						Name: ast.Ident{
+							Name:     "exec",
+							NodeType: ast.NodeIdent,
+						},
+						Arguments: []ast.Node{
+							ast.String{
+								Text:     "pwd",
+								NodeType: ast.NodeString,
+							},
+						},
+						NodeType: ast.NodeFunction,
+					},
+					ast.String{
+						Text:     "bin",
+						NodeType: ast.NodeString,
+					},
+				},
+				NodeType: ast.NodeFunction,
+			},
+			wantErr: false,
+		},
 		{
 			name: "missing LParen",
 			stream: []token.Token{
@@ -412,8 +467,8 @@ func TestParseTask(t *testing.T) {
 				Docstring:    ast.Comment{NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go test ./...",
 						NodeType: ast.NodeCommand,
 					},
@@ -421,6 +476,60 @@ func TestParseTask(t *testing.T) {
 				NodeType: ast.NodeTask,
 			},
 		},
+		{
+			name: "command modifiers",
+			stream: []token.Token{
+				tTask,
+				newToken(token.IDENT, "clean"),
+				tLParen,
+				tRParen,
+				tLBrace,
+				tAt,
+				newToken(token.COMMAND, "echo cleaning"),
+				tAt,
+				tMinus,
+				newToken(token.COMMAND, "rm build"),
+				tRBrace,
+				tEOF,
+			},
+			want: ast.Task{
+				Name: ast.Ident{
+					Name:     "clean",
+					NodeType: ast.NodeIdent,
+				},
+				Docstring:    ast.Comment{NodeType: ast.NodeComment},
+				Dependencies: []ast.Node{},
+				Outputs:      []ast.Node{},
+				Commands: []ast.Node{
+					ast.Command{
+						Command:  "echo cleaning",
+						NodeType: ast.NodeCommand,
+						Silent:   true,
+					},
+					ast.Command{
+						Command:     "rm build",
+						NodeType:    ast.NodeCommand,
+						Silent:      true,
+						IgnoreError: true,
+					},
+				},
+				NodeType: ast.NodeTask,
+			},
+		},
+		{
+			name: "command modifier without a command",
+			stream: []token.Token{
+				tTask,
+				newToken(token.IDENT, "clean"),
+				tLParen,
+				tRParen,
+				tLBrace,
+				tMinus,
+				tRBrace,
+				tEOF,
+			},
+			wantErr: true,
+		},
 		{
 			name: "basic with docstring",
 			stream: []token.Token{
@@ -446,8 +555,8 @@ func TestParseTask(t *testing.T) {
 				},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go test ./...",
 						NodeType: ast.NodeCommand,
 					},
@@ -481,8 +590,8 @@ func TestParseTask(t *testing.T) {
 					},
 				},
 				Outputs: []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -516,8 +625,8 @@ func TestParseTask(t *testing.T) {
 					},
 				},
 				Outputs: []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -557,8 +666,8 @@ func TestParseTask(t *testing.T) {
 					},
 				},
 				Outputs: []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -598,8 +707,8 @@ func TestParseTask(t *testing.T) {
 					},
 				},
 				Outputs: []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -639,8 +748,8 @@ func TestParseTask(t *testing.T) {
 					},
 				},
 				Outputs: []ast.Node{},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -681,8 +790,8 @@ func TestParseTask(t *testing.T) {
 						NodeType: ast.NodeString,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -723,8 +832,8 @@ func TestParseTask(t *testing.T) {
 						NodeType: ast.NodeIdent,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -779,8 +888,8 @@ func TestParseTask(t *testing.T) {
 						NodeType: ast.NodeString,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -835,8 +944,8 @@ func TestParseTask(t *testing.T) {
 						NodeType: ast.NodeIdent,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -885,8 +994,8 @@ func TestParseTask(t *testing.T) {
 						NodeType: ast.NodeIdent,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go build",
 						NodeType: ast.NodeCommand,
 					},
@@ -948,16 +1057,16 @@ func TestParseTask(t *testing.T) {
 						NodeType: ast.NodeIdent,
 					},
 				},
-				Commands: []ast.Command{
-					{
+				Commands: []ast.Node{
+					ast.Command{
 						Command:  "go fmt ./...",
 						NodeType: ast.NodeCommand,
 					},
-					{
+					ast.Command{
 						Command:  "go test -race ./...",
 						NodeType: ast.NodeCommand,
 					},
-					{
+					ast.Command{
 						Command:  `go build -ldflags="-X go.followtheprocess.codes/spok/cli/cmd.version=dev"`,
 						NodeType: ast.NodeCommand,
 					},
@@ -1083,6 +1192,146 @@ func TestParseTask(t *testing.T) {
 			want:    ast.Task{},
 			wantErr: true,
 		},
+		{
+			name: "conditional task",
+			stream: []token.Token{
+				tTask,
+				newToken(token.IDENT, "open"),
+				tLParen,
+				tRParen,
+				tIf,
+				newToken(token.IDENT, "os"),
+				tEq,
+				newToken(token.STRING, `"darwin"`),
+				tOr,
+				newToken(token.IDENT, "CI"),
+				tAnd,
+				newToken(token.IDENT, "MAC"),
+				tLBrace,
+				newToken(token.COMMAND, "open index.html"),
+				tRBrace,
+				tEOF,
+			},
+			want: ast.Task{
+				Condition: ast.Condition{
+					Left: ast.Condition{
+						Left:     ast.Ident{Name: "os", NodeType: ast.NodeIdent},
+						Right:    ast.String{Text: "darwin", NodeType: ast.NodeString},
+						Operator: "==",
+						NodeType: ast.NodeCondition,
+					},
+					Right: ast.Condition{
+						Left: ast.Condition{
+							Left:     ast.Ident{Name: "CI", NodeType: ast.NodeIdent},
+							NodeType: ast.NodeCondition,
+						},
+						Right: ast.Condition{
+							Left:     ast.Ident{Name: "MAC", NodeType: ast.NodeIdent},
+							NodeType: ast.NodeCondition,
+						},
+						Operator: "&&",
+						NodeType: ast.NodeCondition,
+					},
+					Operator: "||",
+					NodeType: ast.NodeCondition,
+				},
+				Name:         ast.Ident{Name: "open", NodeType: ast.NodeIdent},
+				Docstring:    ast.Comment{NodeType: ast.NodeComment},
+				Dependencies: []ast.Node{},
+				Outputs:      []ast.Node{},
+				Commands: []ast.Node{
+					ast.Command{Command: "open index.html", NodeType: ast.NodeCommand},
+				},
+				NodeType: ast.NodeTask,
+			},
+		},
+		{
+			name: "conditional commands",
+			stream: []token.Token{
+				tTask,
+				newToken(token.IDENT, "open"),
+				tLParen,
+				tRParen,
+				tLBrace,
+				tIf,
+				newToken(token.IDENT, "os"),
+				tEq,
+				newToken(token.STRING, `"darwin"`),
+				tLBrace,
+				newToken(token.COMMAND, "open index.html"),
+				tRBrace,
+				tElse,
+				tIf,
+				newToken(token.IDENT, "os"),
+				tEq,
+				newToken(token.STRING, `"windows"`),
+				tLBrace,
+				newToken(token.COMMAND, "start index.html"),
+				tRBrace,
+				tElse,
+				tLBrace,
+				newToken(token.COMMAND, "xdg-open index.html"),
+				tRBrace,
+				newToken(token.COMMAND, "echo done"),
+				tRBrace,
+				tEOF,
+			},
+			want: ast.Task{
+				Name:         ast.Ident{Name: "open", NodeType: ast.NodeIdent},
+				Docstring:    ast.Comment{NodeType: ast.NodeComment},
+				Dependencies: []ast.Node{},
+				Outputs:      []ast.Node{},
+				Commands: []ast.Node{
+					ast.Conditional{
+						Condition: ast.Condition{
+							Left:     ast.Ident{Name: "os", NodeType: ast.NodeIdent},
+							Right:    ast.String{Text: "darwin", NodeType: ast.NodeString},
+							Operator: "==",
+							NodeType: ast.NodeCondition,
+						},
+						Then: []ast.Node{
+							ast.Command{Command: "open index.html", NodeType: ast.NodeCommand},
+						},
+						Else: []ast.Node{
+							ast.Conditional{
+								Condition: ast.Condition{
+									Left:     ast.Ident{Name: "os", NodeType: ast.NodeIdent},
+									Right:    ast.String{Text: "windows", NodeType: ast.NodeString},
+									Operator: "==",
+									NodeType: ast.NodeCondition,
+								},
+								Then: []ast.Node{
+									ast.Command{Command: "start index.html", NodeType: ast.NodeCommand},
+								},
+								Else: []ast.Node{
+									ast.Command{Command: "xdg-open index.html", NodeType: ast.NodeCommand},
+								},
+								NodeType: ast.NodeConditional,
+							},
+						},
+						NodeType: ast.NodeConditional,
+					},
+					ast.Command{Command: "echo done", NodeType: ast.NodeCommand},
+				},
+				NodeType: ast.NodeTask,
+			},
+		},
+		{
+			name: "conditional task missing condition",
+			stream: []token.Token{
+				tTask,
+				newToken(token.IDENT, "open"),
+				tLParen,
+				tRParen,
+				tIf,
+				tLBrace,
+				newToken(token.COMMAND, "open index.html"),
+				tRBrace,
+				tEOF,
+			},
+			want:    ast.Task{},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -1272,7 +1521,7 @@ func TestParserErrorHandling(t *testing.T) {
 		{
 			name:    "parser unexpected top level token",
 			stream:  []token.Token{newToken(token.STRING, `"Unexpected"`)},
-			message: "Illegal Token: \"Unexpected\" (Line 0). Expected one of ['#', 'IDENT', 'task']\n\n0 |\t",
+			message: "Illegal Token: \"Unexpected\" (Line 0). Expected one of ['#', 'IDENT', '@', 'task']\n\n0 |\t",
 		},
 	}
 
@@ -1297,6 +1546,135 @@ func TestParserErrorHandling(t *testing.T) {
 
 // TestParseFullSpokfile tests the parser against a stream of tokens
 // indicative of a fully populated, syntactically valid spokfile.
+func TestParseAttributes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		stream  []token.Token
+		want    ast.Tree
+		wantErr bool
+	}{
+		{
+			name: "attributes",
+			stream: []token.Token{
+				tAt,
+				newToken(token.IDENT, "timeout"),
+				tLParen,
+				newToken(token.STRING, `"5m"`),
+				tRParen,
+				tAt,
+				newToken(token.IDENT, "private"),
+				tTask,
+				newToken(token.IDENT, "build"),
+				tLParen,
+				tRParen,
+				tLBrace,
+				newToken(token.COMMAND, "go build"),
+				tRBrace,
+				tEOF,
+			},
+			want: ast.Tree{
+				Nodes: []ast.Node{
+					ast.Task{
+						Name:      ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+						Docstring: ast.Comment{NodeType: ast.NodeComment},
+						Attributes: []ast.Attribute{
+							{
+								Name:      ast.Ident{Name: "timeout", NodeType: ast.NodeIdent},
+								Arguments: []ast.Node{ast.String{Text: "5m", NodeType: ast.NodeString}},
+								NodeType:  ast.NodeAttribute,
+							},
+							{
+								Name:      ast.Ident{Name: "private", NodeType: ast.NodeIdent},
+								Arguments: []ast.Node{},
+								NodeType:  ast.NodeAttribute,
+							},
+						},
+						Dependencies: []ast.Node{},
+						Outputs:      []ast.Node{},
+						Commands:     []ast.Node{ast.Command{Command: "go build", NodeType: ast.NodeCommand}},
+						NodeType:     ast.NodeTask,
+					},
+				},
+			},
+		},
+		{
+			name: "attributes with docstring",
+			stream: []token.Token{
+				tHash,
+				newToken(token.COMMENT, " Build it"),
+				tAt,
+				newToken(token.IDENT, "env"),
+				tLParen,
+				newToken(token.STRING, `"GOOS"`),
+				tComma,
+				newToken(token.STRING, `"js"`),
+				tRParen,
+				tTask,
+				newToken(token.IDENT, "build"),
+				tLParen,
+				tRParen,
+				tLBrace,
+				tRBrace,
+				tEOF,
+			},
+			want: ast.Tree{
+				Nodes: []ast.Node{
+					ast.Task{
+						Name:      ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+						Docstring: ast.Comment{Text: " Build it", NodeType: ast.NodeComment},
+						Attributes: []ast.Attribute{
+							{
+								Name: ast.Ident{Name: "env", NodeType: ast.NodeIdent},
+								Arguments: []ast.Node{
+									ast.String{Text: "GOOS", NodeType: ast.NodeString},
+									ast.String{Text: "js", NodeType: ast.NodeString},
+								},
+								NodeType: ast.NodeAttribute,
+							},
+						},
+						Dependencies: []ast.Node{},
+						Outputs:      []ast.Node{},
+						Commands:     []ast.Node{},
+						NodeType:     ast.NodeTask,
+					},
+				},
+			},
+		},
+		{
+			name: "attribute not on a task",
+			stream: []token.Token{
+				tAt,
+				newToken(token.IDENT, "private"),
+				newToken(token.IDENT, "VERSION"),
+				tDeclare,
+				newToken(token.STRING, `"1.0.0"`),
+				tEOF,
+			},
+			want:    ast.Tree{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Parser{
+				lexer:     &testLexer{stream: tt.stream},
+				buffer:    [3]token.Token{},
+				peekCount: 0,
+			}
+			tree, err := p.Parse()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() err = %v, wanted %v", err, tt.wantErr)
+			}
+
+			if diff := cmp.Diff(tt.want, tree); diff != "" {
+				t.Errorf("AST mismatch (-want +tree):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestParseFullSpokfile(t *testing.T) {
 	t.Parallel()
 	p := &Parser{
@@ -1592,8 +1970,8 @@ var fullSpokfileAST = ast.Tree{
 				},
 			},
 			Outputs: []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "go test -race ./...",
 					NodeType: ast.NodeCommand,
 				},
@@ -1616,8 +1994,8 @@ var fullSpokfileAST = ast.Tree{
 				},
 			},
 			Outputs: []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "go fmt ./...",
 					NodeType: ast.NodeCommand,
 				},
@@ -1635,20 +2013,20 @@ var fullSpokfileAST = ast.Tree{
 			},
 			Dependencies: []ast.Node{},
 			Outputs:      []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "line 1",
 					NodeType: ast.NodeCommand,
 				},
-				{
+				ast.Command{
 					Command:  "line 2",
 					NodeType: ast.NodeCommand,
 				},
-				{
+				ast.Command{
 					Command:  "line 3",
 					NodeType: ast.NodeCommand,
 				},
-				{
+				ast.Command{
 					Command:  "line 4",
 					NodeType: ast.NodeCommand,
 				},
@@ -1676,8 +2054,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeString,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  `go build -ldflags="-X main.version=test -X main.commit=7cb0ec5609efb5fe0"`,
 					NodeType: ast.NodeCommand,
 				},
@@ -1695,8 +2073,8 @@ var fullSpokfileAST = ast.Tree{
 			},
 			Dependencies: []ast.Node{},
 			Outputs:      []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "echo {{.GLOBAL}}",
 					NodeType: ast.NodeCommand,
 				},
@@ -1723,8 +2101,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeString,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "do some stuff here",
 					NodeType: ast.NodeCommand,
 				},
@@ -1739,8 +2117,8 @@ var fullSpokfileAST = ast.Tree{
 			Docstring:    ast.Comment{},
 			Dependencies: []ast.Node{},
 			Outputs:      []ast.Node{},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  "some more stuff",
 					NodeType: ast.NodeCommand,
 				},
@@ -1763,8 +2141,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeIdent,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  `echo "making docs"`,
 					NodeType: ast.NodeCommand,
 				},
@@ -1791,8 +2169,8 @@ var fullSpokfileAST = ast.Tree{
 					NodeType: ast.NodeIdent,
 				},
 			},
-			Commands: []ast.Command{
-				{
+			Commands: []ast.Node{
+				ast.Command{
 					Command:  `echo "doing things"`,
 					NodeType: ast.NodeCommand,
 				},
@@ -0,0 +1,477 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+// CoreutilsVar is the environment variable that turns off the integrated shell's
+// built in core utilities when set to "false", so the platform's own are used instead.
+const CoreutilsVar = "SPOK_COREUTILS"
+
+// coreutil is a go implementation of a core utility e.g. "rm", called with the interpreter's
+// current state and the arguments after the utility's name.
+type coreutil func(hc interp.HandlerContext, args []string) error
+
+// coreutils are the commands the integrated shell implements itself, so the
+// same spokfile works on any platform without these installed.
+var coreutils = map[string]coreutil{
+	"cat":   cat,
+	"cp":    cp,
+	"mkdir": mkdir,
+	"mv":    mv,
+	"rm":    rm,
+	"touch": touch,
+}
+
+// errUnsupported is returned by parseFlags for a flag the go coreutil doesn't implement, in
+// which case the call is passed on to the platform's own utility.
+var errUnsupported = errors.New("unsupported option")
+
+// coreutilsHandler is an interp exec handler middleware that runs the coreutils in go, passing
+// any other command on to next, as well as any call using a flag they don't support.
+// "open" is passed on as whatever opens things on this platform.
+func coreutilsHandler(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(ctx context.Context, args []string) error {
+		hc := interp.HandlerCtx(ctx)
+		if hc.Env.Get(CoreutilsVar).String() == "false" {
+			return next(ctx, args)
+		}
+
+		if args[0] == "open" {
+			return next(ctx, opener(args[1:]))
+		}
+
+		util, ok := coreutils[args[0]]
+		if !ok {
+			return next(ctx, args)
+		}
+
+		err := util(hc, args[1:])
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errUnsupported) {
+			return next(ctx, args)
+		}
+
+		// Like the real thing, report every problem and exit 1
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+		for _, err := range errs {
+			fmt.Fprintf(hc.Stderr, "%s: %v\n", args[0], err)
+		}
+		return interp.NewExitStatus(1)
+	}
+}
+
+// opener returns the command that opens the files or URLs in args with their default
+// application on this platform.
+func opener(args []string) []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return append([]string{"open"}, args...)
+	case "windows":
+		return append([]string{"rundll32", "url.dll,FileProtocolHandler"}, args...)
+	default:
+		return append([]string{"xdg-open"}, args...)
+	}
+}
+
+// parseFlags splits args into the single letter flags set e.g. "-rf" and the operands
+// after them, the only flags allowed are the letters in allowed, anything else (including
+// any "--long" flag) returns errUnsupported.
+func parseFlags(args []string, allowed string) (map[rune]bool, []string, error) {
+	flags := make(map[rune]bool)
+	for i, arg := range args {
+		if arg == "--" {
+			return flags, args[i+1:], nil
+		}
+		if arg == "-" || !strings.HasPrefix(arg, "-") {
+			return flags, args[i:], nil
+		}
+		for _, char := range arg[1:] {
+			if !strings.ContainsRune(allowed, char) {
+				return nil, nil, errUnsupported
+			}
+			flags[char] = true
+		}
+	}
+	return flags, nil, nil
+}
+
+// resolve returns the path to operand, which is relative to the interpreter's directory.
+func resolve(hc interp.HandlerContext, operand string) string {
+	if filepath.IsAbs(operand) {
+		return operand
+	}
+	return filepath.Join(hc.Dir, operand)
+}
+
+// reason returns the underlying reason for a filesystem error, without the operation and
+// absolute path it was wrapped with, so messages can show paths as the user wrote them.
+func reason(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return linkErr.Err
+	}
+	return err
+}
+
+// cat writes the contents of each file to stdout in turn, reading stdin
+// for "-" or if there are no files.
+func cat(hc interp.HandlerContext, args []string) error {
+	_, operands, err := parseFlags(args, "")
+	if err != nil {
+		return err
+	}
+	if len(operands) == 0 {
+		operands = []string{"-"}
+	}
+
+	var errs []error
+	for _, operand := range operands {
+		if operand == "-" {
+			if _, err := io.Copy(hc.Stdout, hc.Stdin); err != nil {
+				errs = append(errs, fmt.Errorf("-: %w", err))
+			}
+			continue
+		}
+
+		file, err := os.Open(resolve(hc, operand))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", operand, reason(err)))
+			continue
+		}
+		_, err = io.Copy(hc.Stdout, file)
+		file.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", operand, reason(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// cp copies a file to another, or any number of files into a directory,
+// directories are only copied with -r or -R.
+func cp(hc interp.HandlerContext, args []string) error {
+	flags, operands, err := parseFlags(args, "rRf")
+	if err != nil {
+		return err
+	}
+	recursive := flags['r'] || flags['R']
+
+	sources, dest, err := sourcesAndDest(hc, operands)
+	if err != nil {
+		return err
+	}
+
+	last := operands[len(operands)-1]
+
+	var errs []error
+	for _, source := range sources {
+		target := dest(source)
+		info, err := os.Stat(resolve(hc, source))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot stat %s: %w", source, reason(err)))
+			continue
+		}
+
+		// Copying a file onto itself would truncate it before reading it
+		if existing, err := os.Stat(target); err == nil && os.SameFile(info, existing) {
+			name := last
+			if target != resolve(hc, last) {
+				name = filepath.Join(last, filepath.Base(source))
+			}
+			errs = append(errs, fmt.Errorf("'%s' and '%s' are the same file", source, name))
+			continue
+		}
+
+		switch {
+		case !info.IsDir():
+			err = copyFile(resolve(hc, source), target, info.Mode())
+		case !recursive:
+			err = errors.New("-r not specified")
+		case within(resolve(hc, source), target):
+			err = errors.New("cannot copy a directory into itself")
+		default:
+			err = copyDir(resolve(hc, source), target)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot copy %s: %w", source, reason(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// copyFile copies the file at src to dst, giving it the permissions from mode.
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// within reports whether path is dir or somewhere inside it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// copyDir copies the directory src and everything in it to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode())
+		}
+	})
+}
+
+// mkdir creates each directory, and any missing parents with -p.
+func mkdir(hc interp.HandlerContext, args []string) error {
+	flags, operands, err := parseFlags(args, "p")
+	if err != nil {
+		return err
+	}
+	if len(operands) == 0 {
+		return errors.New("missing operand")
+	}
+
+	var errs []error
+	for _, operand := range operands {
+		if flags['p'] {
+			err = os.MkdirAll(resolve(hc, operand), 0o755)
+		} else {
+			err = os.Mkdir(resolve(hc, operand), 0o755)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot create directory %s: %w", operand, reason(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// mv moves a file or directory to another path, or any number of them into a directory.
+func mv(hc interp.HandlerContext, args []string) error {
+	// -f is accepted for compatibility, mv never asks anyway
+	_, operands, err := parseFlags(args, "f")
+	if err != nil {
+		return err
+	}
+
+	sources, dest, err := sourcesAndDest(hc, operands)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, source := range sources {
+		if err := move(resolve(hc, source), dest(source)); err != nil {
+			errs = append(errs, fmt.Errorf("cannot move %s: %w", source, reason(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// move renames src to dst, or if they're on different filesystems (which rename can't
+// cross) copies src to dst and then removes src.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		err = copyDir(src, dst)
+	case info.Mode()&fs.ModeSymlink != 0:
+		var link string
+		if link, err = os.Readlink(src); err == nil {
+			err = os.Symlink(link, dst)
+		}
+	default:
+		err = copyFile(src, dst, info.Mode())
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// sourcesAndDest splits the operands to cp or mv into the sources and a function returning
+// the path each source should end up at, which is inside the last operand if it's a directory.
+func sourcesAndDest(hc interp.HandlerContext, operands []string) ([]string, func(source string) string, error) {
+	if len(operands) < 2 {
+		return nil, nil, errors.New("missing file operand")
+	}
+
+	sources := operands[:len(operands)-1]
+	last := operands[len(operands)-1]
+	target := resolve(hc, last)
+
+	info, err := os.Stat(target)
+	isDir := err == nil && info.IsDir()
+	if len(sources) > 1 && !isDir {
+		return nil, nil, fmt.Errorf("target %s is not a directory", last)
+	}
+
+	dest := func(source string) string {
+		if isDir {
+			return filepath.Join(target, filepath.Base(source))
+		}
+		return target
+	}
+
+	return sources, dest, nil
+}
+
+// rm removes each file, directories are only removed with -r or -R and with -f
+// files that don't exist are ignored.
+func rm(hc interp.HandlerContext, args []string) error {
+	flags, operands, err := parseFlags(args, "rRf")
+	if err != nil {
+		return err
+	}
+	recursive := flags['r'] || flags['R']
+	force := flags['f']
+
+	if len(operands) == 0 && !force {
+		return errors.New("missing operand")
+	}
+
+	var errs []error
+	for _, operand := range operands {
+		target := resolve(hc, operand)
+		if base := filepath.Base(operand); base == "." || base == ".." {
+			errs = append(errs, fmt.Errorf("refusing to remove '.' or '..': skipping %s", operand))
+			continue
+		}
+		if filepath.Dir(target) == target {
+			errs = append(errs, fmt.Errorf("refusing to remove root directory %s", operand))
+			continue
+		}
+
+		info, err := os.Lstat(target)
+		if err != nil {
+			if force && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("cannot remove %s: %w", operand, reason(err)))
+			continue
+		}
+
+		if info.IsDir() && !recursive {
+			errs = append(errs, fmt.Errorf("cannot remove %s: is a directory", operand))
+			continue
+		}
+
+		if recursive {
+			err = os.RemoveAll(target)
+		} else {
+			err = os.Remove(target)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot remove %s: %w", operand, reason(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// touch updates the modification time of each file, creating any that
+// don't exist unless -c is given.
+func touch(hc interp.HandlerContext, args []string) error {
+	flags, operands, err := parseFlags(args, "c")
+	if err != nil {
+		return err
+	}
+	if len(operands) == 0 {
+		return errors.New("missing file operand")
+	}
+
+	now := time.Now()
+	var errs []error
+	for _, operand := range operands {
+		target := resolve(hc, operand)
+		_, err := os.Stat(target)
+		switch {
+		case err == nil:
+			err = os.Chtimes(target, now, now)
+		case errors.Is(err, fs.ErrNotExist) && flags['c']:
+			continue
+		case errors.Is(err, fs.ErrNotExist):
+			var file *os.File
+			file, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0o666)
+			if err == nil {
+				err = file.Close()
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot touch %s: %w", operand, reason(err)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,107 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"golang.org/x/exp/maps"
+)
+
+// Integrated is the name of spok's own built in shell, as accepted by NewRunner.
+const Integrated = "integrated"
+
+// shellFlags maps the external shells spok knows how to use to the flag
+// that tells each one to run a command string.
+var shellFlags = map[string]string{
+	"bash":       "-c",
+	"dash":       "-c",
+	"sh":         "-c",
+	"zsh":        "-c",
+	"pwsh":       "-Command",
+	"powershell": "-Command",
+	"cmd":        "/C",
+}
+
+// NewRunner returns the Runner for the shell called name, which is either Integrated
+// or an external shell e.g. "bash", "sh" or "pwsh", see ExternalRunner.
+func NewRunner(name string) (Runner, error) {
+	if name == Integrated {
+		return NewIntegratedRunner(), nil
+	}
+	return NewExternalRunner(name)
+}
+
+// ExternalRunner implements Runner by handing commands to an external shell
+// e.g. "bash -c <cmd>", for commands that need features the integrated
+// shell doesn't support or need the user's real shell.
+type ExternalRunner struct {
+	shell string // The shell executable, a name to look up on $PATH or a path
+	flag  string // The flag that tells the shell to run a command string
+}
+
+// NewExternalRunner returns a shell runner that runs commands with the external shell
+// 'shell', which may be the name of one on $PATH e.g. "bash" or a path to one e.g.
+// "/usr/local/bin/bash". Only shells spok knows how to pass a command to are allowed.
+func NewExternalRunner(shell string) (ExternalRunner, error) {
+	name := strings.TrimSuffix(filepath.Base(shell), ".exe")
+	flag, ok := shellFlags[name]
+	if !ok {
+		known := maps.Keys(shellFlags)
+		known = append(known, Integrated)
+		slices.Sort(known)
+		return ExternalRunner{}, fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(known, ", "))
+	}
+	return ExternalRunner{shell: shell, flag: flag}, nil
+}
+
+// Run implements Runner for an ExternalRunner, running the command in the external shell.
+//
+// The Result is the same as for an IntegratedRunner: stdout and stderr are collected and
+// optionally printed to the writers in the IOStream, unless the command is Interactive.
+func (e ExternalRunner) Run(ctx context.Context, cmd Command) (Result, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	command := exec.CommandContext(ctx, e.shell, e.flag, cmd.Cmd)
+	command.Dir = cmd.Dir
+	command.Env = append(os.Environ(), cmd.Env...)
+	command.Stdin = cmd.Stream.Stdin
+	command.Stdout, command.Stderr = cmd.writers(stdout, stderr)
+	command.WaitDelay = timeout
+
+	result := Result{Cmd: cmd.Cmd}
+	if err := command.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			// Couldn't run the shell at all e.g. it's not installed
+			return Result{}, fmt.Errorf("could not run command %q in task %q with %s: %w", cmd.Cmd, cmd.Task, e.shell, err)
+		}
+		result.Status = exitStatus(exitErr)
+	}
+
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	return result, nil
+}
+
+// exitStatus returns the exit status of a command that failed. If it was killed by a signal
+// that's 128 plus the signal number, the same as a shell reports, as the process has no exit code.
+func exitStatus(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	if code := err.ExitCode(); code >= 0 {
+		return code
+	}
+	// It failed but we can't tell how, still a failure
+	return 1
+}
@@ -29,21 +29,47 @@ const timeout = 15 * time.Second
 // Runner is an interface representing something capable of running shell commands
 // and returning Results.
 type Runner interface {
-	// Run runs the shell command belonging to task with environment variables set.
-	Run(cmd string, stream iostream.IOStream, task string, env []string) (Result, error)
+	// Run runs a shell command, stopping it early if ctx is cancelled.
+	Run(ctx context.Context, cmd Command) (Result, error)
+}
+
+// Command is a shell command to run and the environment to run it in.
+type Command struct {
+	Stream      iostream.IOStream // Where the command reads stdin from and writes stdout and stderr to, as well as being captured
+	Cmd         string            // The shell command
+	Task        string            // Name of the task the command belongs to
+	Dir         string            // Directory to run the command in, empty means the current directory
+	Env         []string          // Extra environment variables in KEY=VALUE form
+	Interactive bool              // Attach the command straight to the Stream, so e.g. TUIs work, without capturing it's output
+}
+
+// writers returns the writers the command's stdout and stderr should go to, these
+// write to the Stream as well as capturing in stdout and stderr, unless the command
+// is Interactive in which case they're just the Stream.
+func (c Command) writers(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if c.Interactive {
+		return c.Stream.Stdout, c.Stream.Stderr
+	}
+	return io.MultiWriter(stdout, c.Stream.Stdout), io.MultiWriter(stderr, c.Stream.Stderr)
 }
 
 // Result holds the result of running a shell command.
+//
+// The timings are set by the task running the command, not the Runner.
 type Result struct {
-	Cmd    string `json:"cmd"`    // The command that was run
-	Stdout string `json:"stdout"` // The stdout of the command
-	Stderr string `json:"stderr"` // The stderr of the command
-	Status int    `json:"status"` // The exit status of the command
+	Start    time.Time     `json:"start,omitzero"`       // When the command started
+	End      time.Time     `json:"end,omitzero"`         // When the command finished
+	Cmd      string        `json:"cmd"`                  // The command that was run
+	Stdout   string        `json:"stdout"`               // The stdout of the command
+	Stderr   string        `json:"stderr"`               // The stderr of the command
+	Status   int           `json:"status"`               // The exit status of the command
+	Duration time.Duration `json:"duration_ns,omitzero"` // How long the command took, in nanoseconds
+	Ignored  bool          `json:"ignored,omitempty"`    // Whether a failure doesn't count, from the '-' command modifier
 }
 
-// Ok returns whether the result was successful or not.
+// Ok returns whether the result was successful or not, an Ignored failure is ok.
 func (r Result) Ok() bool {
-	return r.Status == 0
+	return r.Status == 0 || r.Ignored
 }
 
 // Results is a collection of shell results.
@@ -76,26 +102,36 @@ func NewIntegratedRunner() IntegratedRunner {
 // Run implements Runner for an IntegratedRunner, using a 100% go implementation of a shell interpreter.
 //
 // Command stdout and stderr will be collected into the returned Result and optionally also printed to
-// the writers in the IOStream, this allows output to be captured or discarded easily.
-func (i IntegratedRunner) Run(cmd string, stream iostream.IOStream, task string, env []string) (Result, error) {
-	prog, err := i.parser.Parse(strings.NewReader(cmd), "")
+// the writers in the IOStream, this allows output to be captured or discarded easily. Input is read
+// from the IOStream's Stdin, if it's nil the command gets no input.
+//
+// Interactive commands are instead given the IOStream's writers directly, so nothing is captured.
+//
+// Common core utilities like rm, cp and mkdir are implemented in go so they work the same on
+// every platform, unless CoreutilsVar is set to "false" in the command's environment.
+func (i IntegratedRunner) Run(ctx context.Context, cmd Command) (Result, error) {
+	prog, err := i.parser.Parse(strings.NewReader(cmd.Cmd), "")
 	if err != nil {
-		return Result{}, fmt.Errorf("command %q in task %q not valid shell syntax: %w", cmd, task, err)
+		return Result{}, fmt.Errorf("command %q in task %q not valid shell syntax: %w", cmd.Cmd, cmd.Task, err)
 	}
 
-	// os.Environ() is added to env so that if nothing is passed, the
-	// process environment is used, but if we do pass env vars these
-	// are added as well as all the normal process env vars
-	env = append(env, os.Environ()...)
+	// The command's env is added on top of os.Environ() so that if nothing is passed,
+	// the process environment is used, but if we do pass env vars these are
+	// added to it, taking precedence over any of the same name
+	env := append(os.Environ(), cmd.Env...)
 
 	var result Result
-	result.Cmd = cmd
+	result.Cmd = cmd.Cmd
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
 
-	// Multi write to the stream as well as capture in above buffer
-	stdoutMultiWriter := io.MultiWriter(stdout, stream.Stdout)
-	stderrMultiWriter := io.MultiWriter(stderr, stream.Stderr)
+	stdoutWriter, stderrWriter := cmd.writers(stdout, stderr)
+
+	// The interpreter (and the coreutils) expect something to read from
+	stdin := cmd.Stream.Stdin
+	if stdin == nil {
+		stdin = strings.NewReader("")
+	}
 
 	execHandler := func(interp.ExecHandlerFunc) interp.ExecHandlerFunc {
 		return interp.DefaultExecHandler(timeout)
@@ -104,16 +140,16 @@ func (i IntegratedRunner) Run(cmd string, stream iostream.IOStream, task string,
 	runner, err := interp.New(
 		interp.Params("-e"),
 		interp.Env(expand.ListEnviron(env...)),
-		interp.ExecHandlers(execHandler),
+		interp.ExecHandlers(coreutilsHandler, execHandler),
 		interp.OpenHandler(interp.DefaultOpenHandler()),
-		interp.StdIO(nil, stdoutMultiWriter, stderrMultiWriter),
-		interp.Dir(""),
+		interp.StdIO(stdin, stdoutWriter, stderrWriter),
+		interp.Dir(cmd.Dir),
 	)
 	if err != nil {
 		return Result{}, err
 	}
 
-	err = runner.Run(context.Background(), prog)
+	err = runner.Run(ctx, prog)
 	if err != nil {
 		var status interp.ExitStatus
 		if !errors.As(err, &status) {
@@ -1,6 +1,13 @@
 package shell_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -106,9 +113,11 @@ func TestResultsOk(t *testing.T) {
 
 func TestRun(t *testing.T) {
 	t.Parallel()
+	dir := t.TempDir()
 	tests := []struct {
 		name    string
 		cmd     string
+		dir     string
 		env     []string
 		want    shell.Result
 		wantErr bool
@@ -180,6 +189,30 @@ func TestRun(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "environment overrides process environment",
+			cmd:  "echo $HOME",
+			env:  []string{"HOME=/spok"},
+			want: shell.Result{
+				Stdout: "/spok\n",
+				Stderr: "",
+				Status: 0,
+				Cmd:    "echo $HOME",
+			},
+			wantErr: false,
+		},
+		{
+			name: "directory",
+			cmd:  "pwd",
+			dir:  dir,
+			want: shell.Result{
+				Stdout: dir + "\n",
+				Stderr: "",
+				Status: 0,
+				Cmd:    "pwd",
+			},
+			wantErr: false,
+		},
 		{
 			name: "bad syntax",
 			cmd:  "(*^$$",
@@ -195,7 +228,13 @@ func TestRun(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			runner := shell.NewIntegratedRunner()
-			got, err := runner.Run(tt.cmd, iostream.Null(), tt.name, tt.env)
+			got, err := runner.Run(context.Background(), shell.Command{
+				Stream: iostream.Null(),
+				Cmd:    tt.cmd,
+				Task:   tt.name,
+				Dir:    tt.dir,
+				Env:    tt.env,
+			})
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("Run() err = %v, wantErr = %v", err, tt.wantErr)
 			}
@@ -206,3 +245,536 @@ func TestRun(t *testing.T) {
 		})
 	}
 }
+
+func TestRunStream(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		cmd         string
+		stdin       string
+		wantStream  string // What should be written to the stream's stdout
+		want        shell.Result
+		interactive bool
+	}{
+		{
+			name:       "stdin",
+			cmd:        "read name; echo hello $name",
+			stdin:      "spok\n",
+			wantStream: "hello spok\n",
+			want: shell.Result{
+				Cmd:    "read name; echo hello $name",
+				Stdout: "hello spok\n",
+			},
+		},
+		{
+			name:        "interactive",
+			cmd:         "read name; echo hello $name",
+			stdin:       "spok\n",
+			interactive: true,
+			wantStream:  "hello spok\n",
+			want: shell.Result{
+				Cmd: "read name; echo hello $name",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stream := iostream.Test()
+			stream.Stdin = strings.NewReader(tt.stdin)
+
+			runner := shell.NewIntegratedRunner()
+			got, err := runner.Run(context.Background(), shell.Command{
+				Stream:      stream,
+				Cmd:         tt.cmd,
+				Task:        tt.name,
+				Interactive: tt.interactive,
+			})
+			if err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Result mismatch (-want +got):\n%s", diff)
+			}
+
+			stdout, ok := stream.Stdout.(*bytes.Buffer)
+			if !ok {
+				t.Fatalf("Test stream stdout was not a *bytes.Buffer")
+			}
+			if diff := cmp.Diff(tt.wantStream, stdout.String()); diff != "" {
+				t.Errorf("Stream mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExternalRunner(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	tests := []struct {
+		name        string
+		cmd         string
+		dir         string
+		stdin       string
+		wantStream  string // What should be written to the stream's stdout
+		env         []string
+		want        shell.Result
+		interactive bool
+	}{
+		{
+			name:       "simple",
+			cmd:        "echo hello",
+			wantStream: "hello\n",
+			want: shell.Result{
+				Cmd:    "echo hello",
+				Stdout: "hello\n",
+			},
+		},
+		{
+			name:       "bash features",
+			cmd:        "[[ 1 == 1 ]] && echo yes",
+			wantStream: "yes\n",
+			want: shell.Result{
+				Cmd:    "[[ 1 == 1 ]] && echo yes",
+				Stdout: "yes\n",
+			},
+		},
+		{
+			name: "failure",
+			cmd:  "echo oops >&2; exit 3",
+			want: shell.Result{
+				Cmd:    "echo oops >&2; exit 3",
+				Stderr: "oops\n",
+				Status: 3,
+			},
+		},
+		{
+			name: "killed by a signal",
+			cmd:  "kill -TERM $$",
+			want: shell.Result{
+				Cmd:    "kill -TERM $$",
+				Status: 143,
+			},
+		},
+		{
+			name:       "env",
+			cmd:        "echo $SPOK_TEST_VAR",
+			env:        []string{"SPOK_TEST_VAR=hello"},
+			wantStream: "hello\n",
+			want: shell.Result{
+				Cmd:    "echo $SPOK_TEST_VAR",
+				Stdout: "hello\n",
+			},
+		},
+		{
+			name:       "dir",
+			cmd:        "pwd",
+			dir:        dir,
+			wantStream: dir + "\n",
+			want: shell.Result{
+				Cmd:    "pwd",
+				Stdout: dir + "\n",
+			},
+		},
+		{
+			name:       "stdin",
+			cmd:        "read name; echo hello $name",
+			stdin:      "spok\n",
+			wantStream: "hello spok\n",
+			want: shell.Result{
+				Cmd:    "read name; echo hello $name",
+				Stdout: "hello spok\n",
+			},
+		},
+		{
+			name:        "interactive",
+			cmd:         "read name; echo hello $name",
+			stdin:       "spok\n",
+			interactive: true,
+			wantStream:  "hello spok\n",
+			want: shell.Result{
+				Cmd: "read name; echo hello $name",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stream := iostream.Test()
+			stream.Stdin = strings.NewReader(tt.stdin)
+
+			runner, err := shell.NewExternalRunner("bash")
+			if err != nil {
+				t.Fatalf("NewExternalRunner returned an error: %v", err)
+			}
+
+			got, err := runner.Run(context.Background(), shell.Command{
+				Stream:      stream,
+				Cmd:         tt.cmd,
+				Task:        tt.name,
+				Dir:         tt.dir,
+				Env:         tt.env,
+				Interactive: tt.interactive,
+			})
+			if err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Result mismatch (-want +got):\n%s", diff)
+			}
+
+			stdout, ok := stream.Stdout.(*bytes.Buffer)
+			if !ok {
+				t.Fatalf("Test stream stdout was not a *bytes.Buffer")
+			}
+			if diff := cmp.Diff(tt.wantStream, stdout.String()); diff != "" {
+				t.Errorf("Stream mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewRunner(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		shell   string
+		wantErr string
+	}{
+		{name: "integrated", shell: "integrated"},
+		{name: "bash", shell: "bash"},
+		{name: "path", shell: "/usr/local/bin/zsh"},
+		{name: "windows", shell: "pwsh.exe"},
+		{
+			name:    "unsupported",
+			shell:   "fish",
+			wantErr: `unsupported shell "fish", expected one of bash, cmd, dash, integrated, powershell, pwsh, sh, zsh`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := shell.NewRunner(tt.shell)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewRunner returned an unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("NewRunner(%q) did not return an error", tt.shell)
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("Wrong error\nGot:\t%s\nWant:\t%s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCoreutils(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		files  map[string]string // Files to create before running, a trailing slash means a directory
+		want   map[string]string // The files there should be afterwards, in the same form
+		name   string
+		cmd    string
+		stdout string
+		stderr string
+		env    []string
+		status int
+	}{
+		{
+			name:  "mkdir",
+			cmd:   "mkdir build && mkdir -p dist/bin dist/lib",
+			files: map[string]string{},
+			want:  map[string]string{"build/": "", "dist/": "", "dist/bin/": "", "dist/lib/": ""},
+		},
+		{
+			name:   "mkdir missing parent",
+			cmd:    "mkdir dist/bin",
+			files:  map[string]string{},
+			want:   map[string]string{},
+			stderr: "mkdir: cannot create directory dist/bin: no such file or directory\n",
+			status: 1,
+		},
+		{
+			name:  "touch",
+			cmd:   "touch new old && touch -c missing",
+			files: map[string]string{"old": "stuff"},
+			want:  map[string]string{"new": "", "old": "stuff"},
+		},
+		{
+			name:   "cat",
+			cmd:    "cat a b",
+			files:  map[string]string{"a": "hello\n", "b": "there\n"},
+			want:   map[string]string{"a": "hello\n", "b": "there\n"},
+			stdout: "hello\nthere\n",
+		},
+		{
+			name:   "cat stdin",
+			cmd:    "echo piped | cat",
+			files:  map[string]string{},
+			want:   map[string]string{},
+			stdout: "piped\n",
+		},
+		{
+			name:   "cat missing",
+			cmd:    "cat missing a",
+			files:  map[string]string{"a": "hello\n"},
+			want:   map[string]string{"a": "hello\n"},
+			stdout: "hello\n",
+			stderr: "cat: missing: no such file or directory\n",
+			status: 1,
+		},
+		{
+			name:  "cp file",
+			cmd:   "cp a b",
+			files: map[string]string{"a": "hello"},
+			want:  map[string]string{"a": "hello", "b": "hello"},
+		},
+		{
+			name:  "cp into dir",
+			cmd:   "cp a b dir",
+			files: map[string]string{"a": "hello", "b": "there", "dir/": ""},
+			want:  map[string]string{"a": "hello", "b": "there", "dir/": "", "dir/a": "hello", "dir/b": "there"},
+		},
+		{
+			name:  "cp recursive",
+			cmd:   "cp -r src dst",
+			files: map[string]string{"src/": "", "src/a": "hello", "src/sub/": "", "src/sub/b": "there"},
+			want: map[string]string{
+				"src/":      "",
+				"src/a":     "hello",
+				"src/sub/":  "",
+				"src/sub/b": "there",
+				"dst/":      "",
+				"dst/a":     "hello",
+				"dst/sub/":  "",
+				"dst/sub/b": "there",
+			},
+		},
+		{
+			name:   "cp dir without recursive",
+			cmd:    "cp src dst",
+			files:  map[string]string{"src/": ""},
+			want:   map[string]string{"src/": ""},
+			stderr: "cp: cannot copy src: -r not specified\n",
+			status: 1,
+		},
+		{
+			name:   "cp into itself",
+			cmd:    "cp -r src src/sub",
+			files:  map[string]string{"src/": "", "src/sub/": ""},
+			want:   map[string]string{"src/": "", "src/sub/": ""},
+			stderr: "cp: cannot copy src: cannot copy a directory into itself\n",
+			status: 1,
+		},
+		{
+			name:   "cp onto itself",
+			cmd:    "cp a a",
+			files:  map[string]string{"a": "hello"},
+			want:   map[string]string{"a": "hello"},
+			stderr: "cp: 'a' and 'a' are the same file\n",
+			status: 1,
+		},
+		{
+			name:   "cp onto itself through dir",
+			cmd:    "cp dir/a dir",
+			files:  map[string]string{"dir/": "", "dir/a": "hello"},
+			want:   map[string]string{"dir/": "", "dir/a": "hello"},
+			stderr: "cp: 'dir/a' and 'dir/a' are the same file\n",
+			status: 1,
+		},
+		{
+			name:   "cp many to file",
+			cmd:    "cp a b c",
+			files:  map[string]string{"a": "", "b": ""},
+			want:   map[string]string{"a": "", "b": ""},
+			stderr: "cp: target c is not a directory\n",
+			status: 1,
+		},
+		{
+			name:  "mv",
+			cmd:   "mv a b && mv c dir",
+			files: map[string]string{"a": "hello", "c": "there", "dir/": ""},
+			want:  map[string]string{"b": "hello", "dir/": "", "dir/c": "there"},
+		},
+		{
+			name:  "rm",
+			cmd:   "rm a && rm -rf dir missing",
+			files: map[string]string{"a": "", "b": "", "dir/": "", "dir/c": ""},
+			want:  map[string]string{"b": ""},
+		},
+		{
+			name:   "rm directory",
+			cmd:    "rm dir",
+			files:  map[string]string{"dir/": ""},
+			want:   map[string]string{"dir/": ""},
+			stderr: "rm: cannot remove dir: is a directory\n",
+			status: 1,
+		},
+		{
+			name:   "rm missing",
+			cmd:    "rm missing a",
+			files:  map[string]string{"a": ""},
+			want:   map[string]string{},
+			stderr: "rm: cannot remove missing: no such file or directory\n",
+			status: 1,
+		},
+		{
+			name:   "rm dot",
+			cmd:    "rm -rf .",
+			files:  map[string]string{"a": ""},
+			want:   map[string]string{"a": ""},
+			stderr: "rm: refusing to remove '.' or '..': skipping .\n",
+			status: 1,
+		},
+		{
+			// Passed on to the real rm, which isn't on the empty $PATH
+			name:   "unsupported flag",
+			cmd:    "rm -rfv a",
+			files:  map[string]string{"a": ""},
+			want:   map[string]string{"a": ""},
+			stderr: "\"rm\": executable file not found in $PATH\n",
+			status: 127,
+		},
+		{
+			name:   "unsupported long flag",
+			cmd:    "cp --recursive src dst",
+			files:  map[string]string{"src/": ""},
+			want:   map[string]string{"src/": ""},
+			stderr: "\"cp\": executable file not found in $PATH\n",
+			status: 127,
+		},
+		{
+			name:   "opt out",
+			cmd:    "mkdir build",
+			env:    []string{shell.CoreutilsVar + "=false"},
+			files:  map[string]string{},
+			want:   map[string]string{},
+			stderr: "\"mkdir\": executable file not found in $PATH\n",
+			status: 127,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			for name, contents := range tt.files {
+				path := filepath.Join(dir, name)
+				err := os.MkdirAll(filepath.Dir(path), 0o755)
+				if err == nil && strings.HasSuffix(name, "/") {
+					err = os.MkdirAll(path, 0o755)
+				} else if err == nil {
+					err = os.WriteFile(path, []byte(contents), 0o644)
+				}
+				if err != nil {
+					t.Fatalf("could not create %s: %v", name, err)
+				}
+			}
+
+			// No $PATH so only the built in coreutils can possibly run
+			env := append([]string{"PATH="}, tt.env...)
+
+			runner := shell.NewIntegratedRunner()
+			got, err := runner.Run(context.Background(), shell.Command{
+				Stream: iostream.Null(),
+				Cmd:    tt.cmd,
+				Task:   tt.name,
+				Dir:    dir,
+				Env:    env,
+			})
+			if err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			want := shell.Result{Cmd: tt.cmd, Stdout: tt.stdout, Stderr: tt.stderr, Status: tt.status}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Result mismatch (-want +got):\n%s", diff)
+			}
+
+			files := make(map[string]string)
+			err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || path == dir {
+					return err
+				}
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+				rel = filepath.ToSlash(rel)
+				if entry.IsDir() {
+					files[rel+"/"] = ""
+					return nil
+				}
+				contents, err := os.ReadFile(path)
+				files[rel] = string(contents)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("could not read back test files: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, files); diff != "" {
+				t.Errorf("Files mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCoreutilsMoveAcrossFilesystems(t *testing.T) {
+	t.Parallel()
+	// /dev/shm is usually a tmpfs, so a different filesystem to the temp dir
+	other, err := os.MkdirTemp("/dev/shm", "spok")
+	if err != nil {
+		t.Skipf("no second filesystem to move to: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(other) })
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "dir", "sub"), 0o755); err != nil {
+		t.Fatalf("could not create dir: %v", err)
+	}
+	for _, name := range []string{"file", filepath.Join("dir", "sub", "nested")} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("could not create %s: %v", name, err)
+		}
+	}
+
+	cmd := "mv file dir " + other
+	got, err := shell.NewIntegratedRunner().Run(context.Background(), shell.Command{
+		Stream: iostream.Null(),
+		Cmd:    cmd,
+		Task:   "move",
+		Dir:    dir,
+		Env:    []string{"PATH="},
+	})
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	if diff := cmp.Diff(shell.Result{Cmd: cmd}, got); diff != "" {
+		t.Errorf("Result mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, name := range []string{"file", filepath.Join("dir", "sub", "nested")} {
+		contents, err := os.ReadFile(filepath.Join(other, name))
+		if err != nil {
+			t.Errorf("%s was not moved: %v", name, err)
+			continue
+		}
+		if string(contents) != name {
+			t.Errorf("Wrong contents for %s: got %q, wanted %q", name, contents, name)
+		}
+	}
+	for _, name := range []string{"file", "dir"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s was left behind after moving it", name)
+		}
+	}
+}
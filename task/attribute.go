@@ -0,0 +1,256 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.followtheprocess.codes/spok/ast"
+	"go.followtheprocess.codes/spok/shell"
+	"go.followtheprocess.codes/spok/token"
+)
+
+// attribute describes one of the attributes a task may be annotated with.
+type attribute struct {
+	apply      func(t *Task, args []string) error // Sets the attribute on the task, args have already been counted
+	params     []string                           // Names of the parameters the attribute takes, all strings
+	optional   int                                // How many of the trailing params may be left out
+	repeatable bool                               // Whether the attribute may be given more than once
+}
+
+// signature returns how the attribute named 'name' is written e.g. @timeout(duration)
+// or @retry(attempts[, backoff]).
+func (a attribute) signature(name string) string {
+	if len(a.params) == 0 {
+		return "@" + name
+	}
+	required := len(a.params) - a.optional
+	params := strings.Join(a.params[:required], ", ")
+	if a.optional != 0 {
+		params += "[, " + strings.Join(a.params[required:], ", ") + "]"
+	}
+	return "@" + name + "(" + params + ")"
+}
+
+// arity returns a description of the number of arguments the attribute takes e.g. "1" or "1 to 2".
+func (a attribute) arity() string {
+	if a.optional == 0 {
+		return strconv.Itoa(len(a.params))
+	}
+	return fmt.Sprintf("%d to %d", len(a.params)-a.optional, len(a.params))
+}
+
+// read-only package scoped map of the attributes spok understands, by name.
+var attributes = map[string]attribute{
+	"timeout": {
+		params: []string{"duration"},
+		apply: func(t *Task, args []string) error {
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid duration %q, expected e.g. \"30s\" or \"5m\"", args[0])
+			}
+			if timeout <= 0 {
+				return fmt.Errorf("timeout must be positive, got %s", timeout)
+			}
+			t.Timeout = timeout
+			return nil
+		},
+	},
+	"dir": {
+		params: []string{"path"},
+		apply: func(t *Task, args []string) error {
+			t.Dir = filepath.Clean(args[0])
+			return nil
+		},
+	},
+	"env": {
+		params:     []string{"name", "value"},
+		repeatable: true,
+		apply: func(t *Task, args []string) error {
+			if t.Env == nil {
+				t.Env = make(map[string]string)
+			}
+			if _, ok := t.Env[args[0]]; ok {
+				return fmt.Errorf("environment variable %q set more than once", args[0])
+			}
+			t.Env[args[0]] = args[1]
+			return nil
+		},
+	},
+	"alias": {
+		params:     []string{"name"},
+		repeatable: true,
+		apply: func(t *Task, args []string) error {
+			alias := args[0]
+			if !token.IsIdent(alias) {
+				return fmt.Errorf("invalid alias %q, aliases must be valid task names", alias)
+			}
+			if alias == t.Name {
+				return fmt.Errorf("alias %q is the task's own name", alias)
+			}
+			if slices.Contains(t.Aliases, alias) {
+				return fmt.Errorf("alias %q given more than once", alias)
+			}
+			t.Aliases = append(t.Aliases, alias)
+			return nil
+		},
+	},
+	"finally": {
+		params:     []string{"task"},
+		repeatable: true,
+		apply: func(t *Task, args []string) error {
+			name := args[0]
+			if !token.IsIdent(name) {
+				return fmt.Errorf("invalid task name %q", name)
+			}
+			if name == t.Name {
+				return errors.New("a task can't be it's own finally task")
+			}
+			if slices.Contains(t.Finally, name) {
+				return fmt.Errorf("task %q given more than once", name)
+			}
+			t.Finally = append(t.Finally, name)
+			return nil
+		},
+	},
+	"matrix": {
+		params:     []string{"variable"},
+		repeatable: true,
+		apply: func(t *Task, args []string) error {
+			if slices.Contains(t.Matrix, args[0]) {
+				return fmt.Errorf("variable %q given more than once", args[0])
+			}
+			t.Matrix = append(t.Matrix, args[0])
+			return nil
+		},
+	},
+	"retry": {
+		params:   []string{"attempts", "backoff"},
+		optional: 1,
+		apply: func(t *Task, args []string) error {
+			attempts, err := strconv.Atoi(args[0])
+			if err != nil || attempts < 1 {
+				return fmt.Errorf("invalid number of attempts %q, expected a whole number of at least 1", args[0])
+			}
+			t.Retry.Attempts = attempts
+			if len(args) == 2 {
+				backoff, err := time.ParseDuration(args[1])
+				if err != nil {
+					return fmt.Errorf("invalid backoff %q, expected e.g. \"1s\" or \"500ms\"", args[1])
+				}
+				if backoff < 0 {
+					return fmt.Errorf("backoff must not be negative, got %s", backoff)
+				}
+				t.Retry.Backoff = backoff
+			}
+			return nil
+		},
+	},
+	"retry_on": {
+		params: []string{"statuses"},
+		apply: func(t *Task, args []string) error {
+			statuses := strings.Fields(args[0])
+			if len(statuses) == 0 {
+				return errors.New("no exit statuses given, expected e.g. \"1 2\"")
+			}
+			for _, status := range statuses {
+				code, err := strconv.Atoi(status)
+				if err != nil || code < 1 || code > 255 {
+					return fmt.Errorf("invalid exit status %q, expected a whole number from 1 to 255", status)
+				}
+				t.Retry.Codes = append(t.Retry.Codes, code)
+			}
+			return nil
+		},
+	},
+	"shell": {
+		params: []string{"name"},
+		apply: func(t *Task, args []string) error {
+			if _, err := shell.NewRunner(args[0]); err != nil {
+				return err
+			}
+			t.Shell = args[0]
+			return nil
+		},
+	},
+	"tag": {
+		params:     []string{"name"},
+		repeatable: true,
+		apply: func(t *Task, args []string) error {
+			tag := args[0]
+			if !token.IsIdent(tag) {
+				return fmt.Errorf("invalid tag %q, tags must be valid identifiers", tag)
+			}
+			if slices.Contains(t.Tags, tag) {
+				return fmt.Errorf("tag %q given more than once", tag)
+			}
+			t.Tags = append(t.Tags, tag)
+			return nil
+		},
+	},
+	"interactive": {
+		apply: func(t *Task, _ []string) error {
+			t.Interactive = true
+			return nil
+		},
+	},
+	"private": {
+		apply: func(t *Task, _ []string) error {
+			t.Private = true
+			return nil
+		},
+	},
+}
+
+// applyAttributes validates the attributes on a task declaration and sets the
+// corresponding fields on t.
+func applyAttributes(t *Task, attrs []ast.Attribute) error {
+	seen := make(map[string]bool, len(attrs))
+	for _, attr := range attrs {
+		name := attr.Name.Name
+		def, ok := attributes[name]
+		if !ok {
+			if closest := ClosestMatch(name, attributeNames()); closest != "" {
+				return fmt.Errorf("task %q: unknown attribute @%s. Did you mean @%s?", t.Name, name, closest)
+			}
+			return fmt.Errorf("task %q: unknown attribute @%s", t.Name, name)
+		}
+
+		if seen[name] && !def.repeatable {
+			return fmt.Errorf("task %q: duplicate attribute @%s", t.Name, name)
+		}
+		seen[name] = true
+
+		if len(attr.Arguments) > len(def.params) || len(attr.Arguments) < len(def.params)-def.optional {
+			return fmt.Errorf("task %q: @%s takes %s argument(s), got %d: %s", t.Name, name, def.arity(), len(attr.Arguments), def.signature(name))
+		}
+
+		args := make([]string, 0, len(attr.Arguments))
+		for _, arg := range attr.Arguments {
+			if arg.Type() != ast.NodeString {
+				return fmt.Errorf("task %q: @%s arguments must be strings, got %s: %s", t.Name, name, arg, def.signature(name))
+			}
+			args = append(args, arg.Literal())
+		}
+
+		if err := def.apply(t, args); err != nil {
+			return fmt.Errorf("task %q: @%s: %w", t.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// attributeNames returns the names of all the attributes, sorted.
+func attributeNames() []string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,108 @@
+package task
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"go.followtheprocess.codes/spok/ast"
+	"go.followtheprocess.codes/spok/builtins"
+)
+
+// Lookup returns the value of the global variable 'name', evaluating it if need be.
+type Lookup func(name string) (string, error)
+
+// condition evaluates the conditions guarding tasks and blocks of commands.
+//
+// An ident in a condition is either one of the spokfile's global variables or the
+// name of a builtin that takes no arguments e.g. os, arch or git_branch, globals
+// take precedence so a spokfile is free to declare it's own 'os'.
+type condition struct {
+	lookup Lookup   // Looks up the value of a global variable
+	dir    string   // The spokfile's directory, builtins are called from here
+	vars   []string // Names of the global variables
+}
+
+// eval reports whether the condition node is true.
+func (c condition) eval(node ast.Node) (bool, error) {
+	cond, ok := node.(ast.Condition)
+	if !ok {
+		return false, fmt.Errorf("AST node has %s type but expected an ast.Condition: %s", node.Type(), node)
+	}
+
+	switch cond.Operator {
+	case "":
+		val, err := c.value(cond.Left)
+		if err != nil {
+			return false, err
+		}
+		return truthy(val), nil
+
+	case "==", "!=":
+		left, err := c.value(cond.Left)
+		if err != nil {
+			return false, err
+		}
+		right, err := c.value(cond.Right)
+		if err != nil {
+			return false, err
+		}
+		return (left == right) == (cond.Operator == "=="), nil
+
+	case "&&", "||":
+		left, err := c.eval(cond.Left)
+		if err != nil {
+			return false, err
+		}
+		// Short circuit so variables on the right are only evaluated if needed
+		if left == (cond.Operator == "||") {
+			return left, nil
+		}
+		return c.eval(cond.Right)
+
+	default:
+		return false, fmt.Errorf("unknown operator in condition %q: %s", cond, cond.Operator)
+	}
+}
+
+// value returns the value of an operand in a condition.
+func (c condition) value(node ast.Node) (string, error) {
+	switch node.Type() {
+	case ast.NodeString:
+		return node.Literal(), nil
+
+	case ast.NodeIdent:
+		name := node.Literal()
+		if slices.Contains(c.vars, name) {
+			return c.lookup(name)
+		}
+		if fn, ok := builtins.Lookup(name); ok && len(fn.Params) == 0 {
+			return fn.Call(builtins.Context{Dir: c.dir})
+		}
+		return "", undefinedError(name, slices.Concat(c.vars, niladicBuiltins()))
+
+	default:
+		return "", fmt.Errorf("unexpected node in condition %s: %s", node.Type(), node)
+	}
+}
+
+// truthy reports whether a value used on it's own in a condition counts as true,
+// anything that parses as a bool is that bool, otherwise it's true if it's not empty.
+func truthy(value string) bool {
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	return value != ""
+}
+
+// niladicBuiltins returns the names of the builtins that take no arguments, and so
+// may be used by name in a condition.
+func niladicBuiltins() []string {
+	var names []string
+	for _, fn := range builtins.All() {
+		if len(fn.Params) == 0 {
+			names = append(names, fn.Name)
+		}
+	}
+	return names
+}
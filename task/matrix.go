@@ -0,0 +1,104 @@
+package task
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Instances expands a matrix task into one task per combination of the values of
+// it's Matrix variables, lookup is used to get the value of each variable, which is
+// treated as a whitespace separated list e.g. "linux darwin windows", see splitList.
+//
+// Each instance is named after the task and the values it was expanded with e.g.
+// build[linux] or build[linux,amd64], and has those values in it's Vars so they're
+// used in place of the global in it's command templates and environment. Aliases
+// and Tags stay with the task being expanded, not the instances.
+func (t Task) Instances(lookup Lookup) ([]Task, error) {
+	if len(t.Matrix) == 0 {
+		return nil, nil
+	}
+
+	// Start with a single empty combination and fan out over each variable in turn
+	combinations := [][]string{nil}
+	for _, name := range t.Matrix {
+		value, err := lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("task %q: @matrix: %w", t.Name, err)
+		}
+		values, err := splitList(value)
+		if err != nil {
+			return nil, fmt.Errorf("task %q: @matrix: variable %q: %w", t.Name, name, err)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("task %q: @matrix: variable %q has no values", t.Name, name)
+		}
+
+		next := make([][]string, 0, len(combinations)*len(values))
+		for _, combination := range combinations {
+			for _, value := range values {
+				extended := make([]string, len(combination), len(combination)+1)
+				copy(extended, combination)
+				next = append(next, append(extended, value))
+			}
+		}
+		combinations = next
+	}
+
+	instances := make([]Task, 0, len(combinations))
+	for _, combination := range combinations {
+		instance := t
+		instance.Name = t.Name + "[" + strings.Join(combination, ",") + "]"
+		instance.Matrix = nil
+		instance.Aliases = nil
+		instance.Tags = nil
+		instance.Vars = make(map[string]string, len(combination))
+		for i, name := range t.Matrix {
+			instance.Vars[name] = combination[i]
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// splitList splits the value of a list variable into it's elements, which are separated
+// by whitespace. An element may be quoted with single or double quotes to include whitespace
+// e.g. "'my dir' other" is the two elements "my dir" and "other", there's no escaping so
+// an element can't contain the quote it's quoted with.
+func splitList(value string) ([]string, error) {
+	var (
+		elements []string
+		current  strings.Builder
+		quote    rune // The quote we're currently inside, 0 if not quoted
+		started  bool // Whether there's an element in progress, it may be an empty quoted one
+	)
+	for _, r := range value {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			current.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			started = true
+		case unicode.IsSpace(r):
+			if started {
+				elements = append(elements, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, value)
+	}
+	if started {
+		elements = append(elements, current.String())
+	}
+	return elements, nil
+}
@@ -0,0 +1,39 @@
+package task
+
+import (
+	"slices"
+	"time"
+)
+
+// Retry is a task's retry policy, see @retry and @retry_on.
+type Retry struct {
+	Codes    []int         // The exit statuses worth retrying, any failure is retried if empty
+	Attempts int           // The most times the task's commands are run, 0 or 1 means they're never retried
+	Backoff  time.Duration // How long to wait before the first retry, doubling for each one after that
+}
+
+// retries reports whether a failed attempt that exited with status should be retried,
+// given it was attempt number 'attempt' (counting from 1).
+func (r Retry) retries(attempt, status int) bool {
+	if attempt >= r.Attempts {
+		return false
+	}
+	return len(r.Codes) == 0 || slices.Contains(r.Codes, status)
+}
+
+// MaxBackoff is the longest a task ever waits between retries, however many
+// times the backoff has doubled.
+const MaxBackoff = 10 * time.Minute
+
+// Delay returns how long to wait before trying again after attempt number
+// 'attempt' (counting from 1) failed, at most MaxBackoff.
+func (r Retry) Delay(attempt int) time.Duration {
+	delay := r.Backoff
+	for range attempt - 1 {
+		if delay >= MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	return min(delay, MaxBackoff)
+}
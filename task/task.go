@@ -3,63 +3,242 @@
 package task
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
-	"text/template"
+	"time"
 
+	"github.com/lithammer/fuzzysearch/fuzzy"
 	"go.followtheprocess.codes/hue"
+	"go.followtheprocess.codes/msg"
 	"go.followtheprocess.codes/spok/ast"
+	"go.followtheprocess.codes/spok/builtins"
+	"go.followtheprocess.codes/spok/event"
 	"go.followtheprocess.codes/spok/iostream"
 	"go.followtheprocess.codes/spok/shell"
 )
 
 // Task represents a spok Task.
 type Task struct {
-	Doc              string   // The task docstring
-	Name             string   // Task name
-	TaskDependencies []string // Other tasks or idents this task depends on (by name)
-	FileDependencies []string // Filepaths this task depends on
-	GlobDependencies []string // Filepath dependencies that are specified as glob patterns
-	Commands         []string // Shell commands to run
-	NamedOutputs     []string // Other outputs by ident
-	FileOutputs      []string // Filepaths this task outputs
-	GlobOutputs      []string // Filepaths this task outputs that are specified as glob patterns
+	Env              map[string]string // Extra environment variables set only for this task's commands, see @env
+	Vars             map[string]string // Values of the matrix variables for one instance of a matrix task, these shadow the globals
+	Doc              string            // The task docstring
+	Name             string            // Task name
+	Condition        string            // The condition under which the task applies as written, empty if it always does
+	Dir              string            // Directory the commands run in, relative to the spokfile unless absolute, see @dir
+	Shell            string            // The shell to run the commands with, empty means the spokfile's default, see @shell
+	TaskDependencies []string          // Other tasks or idents this task depends on (by name)
+	FileDependencies []string          // Filepaths this task depends on
+	GlobDependencies []string          // Filepath dependencies that are specified as glob patterns
+	Commands         []string          // Shell commands to run, starting with any modifiers e.g. @echo, templated variables are substituted by Expand
+	NamedOutputs     []string          // Other outputs by ident
+	FileOutputs      []string          // Filepaths this task outputs
+	GlobOutputs      []string          // Filepaths this task outputs that are specified as glob patterns
+	Aliases          []string          // Other names the task may be run by, see @alias
+	Tags             []string          // Groups the task belongs to e.g. ci or lint, see @tag
+	Matrix           []string          // Names of the list variables the task is expanded over, see @matrix
+	Finally          []string          // Tasks to run once everything else is done if this one runs, see @finally
+	Retry            Retry             // When and how often to retry the task's commands if they fail, see @retry
+	Timeout          time.Duration     // How long the task's commands may take in total before they're stopped, 0 means no limit, see @timeout
+	Disabled         bool              // Whether the condition is false here, in which case the task never runs
+	Private          bool              // Whether the task is an internal helper that may only be run as a dependency, see @private
+	Interactive      bool              // Whether the commands are attached straight to the terminal without capturing output, see @interactive
 }
 
 const echoStyle = hue.Bold
 
-// Run runs a task commands in order, echoing each one to out and returning the list of results
-// containing the exit status, stdout and stderr of each command.
+// TimeoutStatus is the exit status recorded for a command stopped by the task's Timeout,
+// the same one coreutils timeout uses.
+const TimeoutStatus = 124
+
+// Run runs a task commands in order, echoing each one to out and returning the result
+// containing the exit status, stdout, stderr and timings of each command. It stops at the first command
+// that fails, so that's always the last one in the result.
+//
+// Commands starting with '@' aren't echoed, and a failure of one starting with '-' is
+// marked Ignored in the result and the task carries on as if it had succeeded.
+//
+// The commands are run in the task's Dir with the task's Env set on top of env. If
+// the task has a Timeout and an attempt at it's commands takes longer than that, the one
+// running is stopped and recorded as failed with status TimeoutStatus. If ctx is cancelled
+// e.g. by Ctrl+C, the one running is stopped and an error returned.
+//
+// If the task has a Retry policy, a failed attempt is retried (after the backoff) until the
+// commands succeed or the policy says to stop, every attempt is then kept in the result's Attempts.
+// An attempt that timed out isn't retried.
+//
+// Each command's start, output and finish are emitted to events, which may be nil.
 //
 // If the task has no commands, this becomes a no-op.
-func (t *Task) Run(runner shell.Runner, stream iostream.IOStream, env []string) (shell.Results, error) {
-	var results shell.Results
-	for _, cmd := range t.Commands {
-		echoStyle.Fprintln(stream.Stdout, cmd)
-		result, err := runner.Run(cmd, stream, t.Name, env)
+func (t *Task) Run(ctx context.Context, runner shell.Runner, stream iostream.IOStream, env []string, events *event.Writer) (Result, error) {
+	env = append(env, t.environ()...)
+	start := time.Now()
+	var attempts []shell.Results
+	for attempt := 1; ; attempt++ {
+		results, timedOut, err := t.attempt(ctx, runner, stream, env, events)
 		if err != nil {
-			return nil, err
+			return Result{}, err
+		}
+		attempts = append(attempts, results)
+		if results.Ok() || timedOut || !t.Retry.retries(attempt, results[len(results)-1].Status) {
+			break
+		}
+
+		delay := t.Retry.Delay(attempt)
+		msg.Fwarn(stream.Stdout, "Task %q failed, retrying in %s (attempt %d of %d)", t.Name, delay, attempt+1, t.Retry.Attempts)
+		select {
+		case <-ctx.Done():
+			return Result{}, fmt.Errorf("task %q interrupted waiting to retry", t.Name)
+		case <-time.After(delay):
+		}
+	}
+
+	end := time.Now()
+	result := Result{
+		Task:           t.Name,
+		CommandResults: attempts[len(attempts)-1],
+		Start:          start,
+		End:            end,
+		Duration:       end.Sub(start),
+	}
+	if len(attempts) > 1 {
+		result.Attempts = attempts
+	}
+	return result, nil
+}
+
+// attempt runs the task's commands once, stopping at the first one that fails. It
+// reports whether the attempt was stopped by the task's Timeout.
+func (t *Task) attempt(ctx context.Context, runner shell.Runner, stream iostream.IOStream, env []string, events *event.Writer) (shell.Results, bool, error) {
+	runCtx := ctx
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	var results shell.Results
+	for _, line := range t.Commands {
+		cmd := parseCommand(line)
+		if !cmd.silent {
+			echoStyle.Fprintln(stream.Stdout, cmd.cmd)
+		}
+
+		// Interactive commands need the stream as is, so there are no output events
+		cmdStream, flush := stream, func() {}
+		if !t.Interactive {
+			cmdStream, flush = events.Tee(t.Name, stream)
+		}
+
+		events.Emit(event.CommandStarted{Task: t.Name, Cmd: cmd.cmd})
+		start := time.Now()
+		result, err := runner.Run(runCtx, shell.Command{
+			Stream:      cmdStream,
+			Cmd:         cmd.cmd,
+			Task:        t.Name,
+			Dir:         t.Dir,
+			Env:         env,
+			Interactive: t.Interactive,
+		})
+		flush()
+		if ctx.Err() != nil {
+			return nil, false, fmt.Errorf("task %q interrupted running %q", t.Name, cmd.cmd)
+		}
+		timedOut := runCtx.Err() != nil
+		if timedOut {
+			// Whatever the runner made of the killed command, it failed because of the timeout
+			result = shell.Result{
+				Cmd:    cmd.cmd,
+				Stdout: result.Stdout,
+				Stderr: result.Stderr + fmt.Sprintf("task %q timed out after %s\n", t.Name, t.Timeout),
+				Status: TimeoutStatus,
+			}
+		} else if err != nil {
+			return nil, false, err
 		}
+		result.Start = start
+		result.End = time.Now()
+		result.Duration = result.End.Sub(start)
+		result.Ignored = cmd.ignoreError && result.Status != 0
 		results = append(results, result)
+		events.Emit(event.CommandFinished{Task: t.Name, Cmd: cmd.cmd, Status: result.Status, Duration: result.Duration})
+		if timedOut {
+			return results, true, nil
+		}
+		if !result.Ok() {
+			break
+		}
 	}
-	return results, nil
+	return results, false, nil
+}
+
+// command is a task command split into the shell command and it's modifiers.
+type command struct {
+	cmd         string // The shell command
+	silent      bool   // Don't echo the command, '@'
+	ignoreError bool   // Carry on if the command fails, '-'
+}
+
+// parseCommand splits a task command into the shell command and the
+// modifiers it starts with, see ast.Command.
+func parseCommand(line string) command {
+	var cmd command
+	for ; line != ""; line = line[1:] {
+		switch line[0] {
+		case '@':
+			cmd.silent = true
+		case '-':
+			cmd.ignoreError = true
+		default:
+			cmd.cmd = line
+			return cmd
+		}
+	}
+	return cmd
+}
+
+// environ returns the task's matrix Vars followed by it's Env in KEY=VALUE form,
+// each sorted by key, so an @env always beats a matrix variable of the same name.
+func (t *Task) environ() []string {
+	vars := make([]string, 0, len(t.Vars))
+	for key, value := range t.Vars {
+		vars = append(vars, key+"="+value)
+	}
+	sort.Strings(vars)
+
+	environ := make([]string, 0, len(t.Env))
+	for key, value := range t.Env {
+		environ = append(environ, key+"="+value)
+	}
+	sort.Strings(environ)
+	return append(vars, environ...)
 }
 
 // Result encodes the overall result of running a task which
 // may involve any number of shell commands.
+//
+// The timings cover every attempt and any backoff between them, they're not
+// set for tasks that were skipped or blocked.
 type Result struct {
-	Task           string        `json:"task"`    // The name of the task
-	CommandResults shell.Results `json:"results"` // The results of running the tasks commands
-	Skipped        bool          `json:"skipped"` // Whether the task was skipped or run
+	Start          time.Time       `json:"start,omitzero"`       // When the task started
+	End            time.Time       `json:"end,omitzero"`         // When the task finished
+	Task           string          `json:"task"`                 // The name of the task
+	BlockedBy      string          `json:"blocked_by,omitempty"` // The failed task that stopped this one running, see --keep-going
+	CommandResults shell.Results   `json:"results"`              // The results of running the tasks commands, the final attempt if retried
+	Attempts       []shell.Results `json:"attempts,omitempty"`   // The results of every attempt, oldest first, only set if the task was retried
+	Duration       time.Duration   `json:"duration_ns,omitzero"` // How long the task took, in nanoseconds
+	Skipped        bool            `json:"skipped"`              // Whether the task was skipped or run
+	Finally        bool            `json:"finally,omitempty"`    // Whether the task was run as a finally task, see @finally
 }
 
 // Ok returns whether or not the task was successful, true if
-// all commands exited with 0, else false.
+// all commands exited with 0, else false. A blocked task is never ok.
 func (r Result) Ok() bool {
-	return r.CommandResults.Ok()
+	return r.BlockedBy == "" && r.CommandResults.Ok()
 }
 
 // Results is a collection of task results.
@@ -84,15 +263,48 @@ func (r Results) JSON() (string, error) {
 	return string(data), nil
 }
 
+// ClosestMatch returns the closest fuzzy match to target from candidates, or an empty
+// string if there isn't one, for "did you mean" suggestions e.g. of task names.
+//
+// Candidates that contain the target's characters in order are preferred, failing that
+// the candidate fewest edits away is, so long as it's within maxEdits e.g. a transposition.
+func ClosestMatch(target string, candidates []string) string {
+	matches := fuzzy.RankFindNormalizedFold(target, candidates)
+	sort.Sort(matches)
+	if len(matches) != 0 {
+		return matches[0].Target
+	}
+
+	closest := ""
+	best := maxEdits + 1
+	for _, candidate := range candidates {
+		if distance := fuzzy.LevenshteinDistance(strings.ToLower(target), strings.ToLower(candidate)); distance < best {
+			closest, best = candidate, distance
+		}
+	}
+	return closest
+}
+
+// maxEdits is the most single character edits a candidate may be from the target
+// for ClosestMatch to suggest it when the target's characters aren't in it in order.
+const maxEdits = 2
+
 // New parses a task AST node into a concrete task,
 // root is the absolute path of the directory to use as the root for
 // glob expansion, typically the path to the spokfile.
-func New(t ast.Task, root string, vars map[string]string) (Task, error) {
+//
+// vars are the names of the spokfile's global variables, every variable
+// a command references must be one of these. lookup is used to get the value
+// of any variable used in the conditions on the task or it's commands, which
+// are evaluated here so that only the commands that apply are kept.
+//
+// The task's commands are otherwise kept exactly as written, global variables
+// are only substituted in by Expand once the task is about to run.
+func New(t ast.Task, root string, vars []string, lookup Lookup) (Task, error) {
 	var (
 		fileDeps     []string
 		globDeps     []string
 		taskDeps     []string
-		commands     []string
 		fileOutputs  []string
 		globOutputs  []string
 		namedOutputs []string
@@ -117,12 +329,24 @@ func New(t ast.Task, root string, vars map[string]string) (Task, error) {
 		}
 	}
 
-	for _, cmd := range t.Commands {
-		expanded, err := expandVars(cmd.Command, vars)
+	cond := condition{lookup: lookup, vars: vars, dir: root}
+
+	var (
+		conditionText string
+		disabled      bool
+	)
+	if t.Condition != nil {
+		conditionText = t.Condition.String()
+		applies, err := cond.eval(t.Condition)
 		if err != nil {
-			return Task{}, err
+			return Task{}, fmt.Errorf("task %q condition %q: %w", t.Name.Name, conditionText, err)
 		}
-		commands = append(commands, expanded)
+		disabled = !applies
+	}
+
+	commands, err := bodyCommands(t.Name.Name, t.Commands, vars, cond)
+	if err != nil {
+		return Task{}, err
 	}
 
 	for _, out := range t.Outputs {
@@ -154,22 +378,123 @@ func New(t ast.Task, root string, vars map[string]string) (Task, error) {
 		NamedOutputs:     namedOutputs,
 		FileOutputs:      fileOutputs,
 		GlobOutputs:      globOutputs,
+		Condition:        conditionText,
+		Disabled:         disabled,
+	}
+
+	if err := applyAttributes(&task, t.Attributes); err != nil {
+		return Task{}, err
+	}
+
+	// By convention, a task named with a leading underscore is private too
+	if strings.HasPrefix(task.Name, "_") {
+		task.Private = true
 	}
+
+	for _, name := range task.Matrix {
+		if !slices.Contains(vars, name) {
+			return Task{}, fmt.Errorf("task %q: @matrix: %w", task.Name, undefinedError(name, vars))
+		}
+	}
+
+	if len(task.Retry.Codes) != 0 && task.Retry.Attempts == 0 {
+		return Task{}, fmt.Errorf("task %q: @retry_on has no effect without @retry", task.Name)
+	}
+
 	return task, nil
 }
 
-// expandVars performs a find and replace on any templated variables in
-// a command, using the provided variables map.
-func expandVars(command string, vars map[string]string) (string, error) {
-	tmp := template.New("tmp")
-	parsed, err := tmp.Parse(command)
-	if err != nil {
-		return "", err
+// bodyCommands checks every command in a task body, returning those that apply
+// i.e. the ones in the branch of each conditional block whose condition is true.
+//
+// Commands in every branch are checked, not just those that apply, so that a
+// typo doesn't go unnoticed until the spokfile is used on another platform.
+func bodyCommands(task string, body []ast.Node, vars []string, cond condition) ([]string, error) {
+	var commands []string
+	for _, node := range body {
+		switch node := node.(type) {
+		case ast.Command:
+			if err := checkCommand(node.Command, vars); err != nil {
+				return nil, fmt.Errorf("task %q command %q: %w", task, node.Command, err)
+			}
+			commands = append(commands, node.String())
+
+		case ast.Conditional:
+			applies, err := cond.eval(node.Condition)
+			if err != nil {
+				return nil, fmt.Errorf("task %q condition %q: %w", task, node.Condition, err)
+			}
+			then, err := bodyCommands(task, node.Then, vars, cond)
+			if err != nil {
+				return nil, err
+			}
+			otherwise, err := bodyCommands(task, node.Else, vars, cond)
+			if err != nil {
+				return nil, err
+			}
+			if applies {
+				commands = append(commands, then...)
+			} else {
+				commands = append(commands, otherwise...)
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected node in task %q body %s: %s", task, node.Type(), node)
+		}
 	}
-	out := &bytes.Buffer{}
-	if err := parsed.Execute(out, vars); err != nil {
-		return "", err
+	return commands, nil
+}
+
+// Context holds everything available to a task's command templates.
+type Context struct {
+	Vars  map[string]string // The spokfile's global variables, referenced as e.g. {{ .VERSION }}
+	Dir   string            // The directory the spokfile is in, {{ .spokfile.dir }}
+	Path  string            // The absolute path to the spokfile, {{ .spokfile.path }}
+	Files []string          // The task's file dependencies with globs expanded, {{ .task.deps }}
+	Env   []string          // Extra environment variables for builtins in KEY=VALUE form e.g. the spokfile's .env
+}
+
+// Files is a list of filepaths that renders space separated in a template,
+// so it may be passed straight to a shell command or ranged over.
+type Files []string
+
+// String implements fmt.Stringer for Files.
+func (f Files) String() string {
+	return strings.Join(f, " ")
+}
+
+// Expand returns a copy of the task with its command templates executed
+// against ctx, the spok builtins are available as template functions.
+func (t Task) Expand(ctx Context) (Task, error) {
+	if len(t.Commands) == 0 {
+		return t, nil
+	}
+
+	data := make(map[string]any, len(ctx.Vars))
+	for name, value := range ctx.Vars {
+		data[name] = value
+	}
+	for name, value := range t.Vars {
+		data[name] = value
+	}
+	data["task"] = map[string]any{
+		"name": t.Name,
+		"deps": Files(ctx.Files),
+	}
+	data["spokfile"] = map[string]string{
+		"dir":  ctx.Dir,
+		"path": ctx.Path,
 	}
 
-	return out.String(), nil
+	funcs := builtins.FuncMap(builtins.Context{Dir: ctx.Dir, Env: ctx.Env})
+	commands := make([]string, 0, len(t.Commands))
+	for _, cmd := range t.Commands {
+		expanded, err := expandVars(cmd, data, funcs)
+		if err != nil {
+			return Task{}, fmt.Errorf("task %q: %w", t.Name, err)
+		}
+		commands = append(commands, expanded)
+	}
+	t.Commands = commands
+	return t, nil
 }
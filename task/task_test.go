@@ -1,25 +1,34 @@
 package task_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"go.followtheprocess.codes/spok/ast"
 	"go.followtheprocess.codes/spok/iostream"
 	"go.followtheprocess.codes/spok/shell"
 	"go.followtheprocess.codes/spok/task"
 )
 
+// ignoreTimings ignores the timings in command results, which are different every run.
+var ignoreTimings = cmpopts.IgnoreFields(shell.Result{}, "Start", "End", "Duration")
+
 func TestNewTask(t *testing.T) {
 	t.Parallel()
 	testdata := mustGetTestData()
 	tests := []struct {
 		name    string
 		want    task.Task
-		vars    map[string]string
+		err     string
+		vars    []string
 		in      ast.Task
 		wantErr bool
 	}{
@@ -37,33 +46,11 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
 		},
-		{
-			name: "simple with vars",
-			want: task.Task{
-				Doc:              "A simple test task with global variables",
-				Name:             "simple",
-				TaskDependencies: nil,
-				FileDependencies: nil,
-				Commands:         []string{"go test hello"},
-			},
-			in: ast.Task{
-				Name:         ast.Ident{Name: "simple", NodeType: ast.NodeIdent},
-				Docstring:    ast.Comment{Text: " A simple test task with global variables", NodeType: ast.NodeComment},
-				Dependencies: []ast.Node{},
-				Outputs:      []ast.Node{},
-				Commands:     []ast.Command{{Command: "go test {{.GLOBAL}}", NodeType: ast.NodeCommand}},
-				NodeType:     ast.NodeTask,
-			},
-			vars: map[string]string{
-				"GLOBAL": "hello",
-			},
-			wantErr: false,
-		},
 		{
 			name: "task with a file dependency",
 			want: task.Task{
@@ -78,7 +65,7 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{ast.String{Text: "file.go", NodeType: ast.NodeString}},
 				Outputs:      []ast.Node{},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
@@ -97,7 +84,7 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{ast.Ident{Name: "fmt", NodeType: ast.NodeIdent}},
 				Outputs:      []ast.Node{},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
@@ -122,7 +109,7 @@ func TestNewTask(t *testing.T) {
 					ast.String{Text: "file2.go", NodeType: ast.NodeString},
 				},
 				Outputs:  []ast.Node{},
-				Commands: []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands: []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType: ast.NodeTask,
 			},
 			wantErr: false,
@@ -144,7 +131,7 @@ func TestNewTask(t *testing.T) {
 					ast.Ident{Name: "lint", NodeType: ast.NodeIdent},
 				},
 				Outputs:  []ast.Node{},
-				Commands: []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands: []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType: ast.NodeTask,
 			},
 			wantErr: false,
@@ -164,7 +151,7 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{ast.String{Text: "**/*.txt", NodeType: ast.NodeString}},
 				Outputs:      []ast.Node{},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
@@ -184,7 +171,7 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{ast.String{Text: "*.txt", NodeType: ast.NodeString}},
 				Outputs:      []ast.Node{},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
@@ -205,7 +192,7 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{ast.String{Text: "file.go", NodeType: ast.NodeString}},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
@@ -227,7 +214,7 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{ast.String{Text: "**/*.txt", NodeType: ast.NodeString}},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
@@ -254,7 +241,7 @@ func TestNewTask(t *testing.T) {
 					ast.String{Text: "file1.go", NodeType: ast.NodeString},
 					ast.String{Text: "file2.go", NodeType: ast.NodeString},
 				},
-				Commands: []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands: []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType: ast.NodeTask,
 			},
 			wantErr: false,
@@ -275,7 +262,7 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " A simple test task", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{},
 				Outputs:      []ast.Node{ast.Ident{Name: "OUT", NodeType: ast.NodeIdent}},
-				Commands:     []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
@@ -299,7 +286,7 @@ func TestNewTask(t *testing.T) {
 					ast.Ident{Name: "OUT", NodeType: ast.NodeIdent},
 					ast.Ident{Name: "OTHER", NodeType: ast.NodeIdent},
 				},
-				Commands: []ast.Command{{Command: "go test ./...", NodeType: ast.NodeCommand}},
+				Commands: []ast.Node{ast.Command{Command: "go test ./...", NodeType: ast.NodeCommand}},
 				NodeType: ast.NodeTask,
 			},
 			wantErr: false,
@@ -321,20 +308,808 @@ func TestNewTask(t *testing.T) {
 				Docstring:    ast.Comment{Text: " Very complex things here", NodeType: ast.NodeComment},
 				Dependencies: []ast.Node{ast.String{Text: "**/*.txt", NodeType: ast.NodeString}},
 				Outputs:      []ast.Node{ast.String{Text: "./bin/main", NodeType: ast.NodeString}},
-				Commands:     []ast.Command{{Command: "go build .", NodeType: ast.NodeCommand}},
+				Commands:     []ast.Node{ast.Command{Command: "go build .", NodeType: ast.NodeCommand}},
 				NodeType:     ast.NodeTask,
 			},
 			wantErr: false,
 		},
+		{
+			name: "defined variables",
+			vars: []string{"BIN", "NAME"},
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `go build -o {{ join .BIN .NAME }} {{ .task.name }} {{ .spokfile.dir }}`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			want: task.Task{
+				Name:     "build",
+				Commands: []string{`go build -o {{ join .BIN .NAME }} {{ .task.name }} {{ .spokfile.dir }}`},
+			},
+			wantErr: false,
+		},
+		{
+			name: "undefined variable",
+			vars: []string{"PROJECT_BIN", "VERSION"},
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `rm -rf {{.PROJCT_BIN}}/stuff`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			err:     `task "build" command "rm -rf {{.PROJCT_BIN}}/stuff": undefined variable "PROJCT_BIN". Did you mean "PROJECT_BIN"?`,
+			wantErr: true,
+		},
+		{
+			name: "undefined variable no suggestion",
+			vars: []string{"VERSION"},
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `echo {{.NOPE}}`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			err:     `task "build" command "echo {{.NOPE}}": undefined variable "NOPE"`,
+			wantErr: true,
+		},
+		{
+			name: "undefined variable as builtin argument",
+			vars: []string{"NAME"},
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `echo {{ upper .NAM }}`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			err:     `task "build" command "echo {{ upper .NAM }}": undefined variable "NAM". Did you mean "NAME"?`,
+			wantErr: true,
+		},
+		{
+			name: "fields inside range and with",
+			vars: []string{"PKGS", "VERSION"},
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `echo {{ range .PKGS }}{{ .Name }}@{{ $.VERSION }} {{ end }}{{ with .task }}{{ .name }}{{ end }}`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			want: task.Task{
+				Name:     "build",
+				Commands: []string{`echo {{ range .PKGS }}{{ .Name }}@{{ $.VERSION }} {{ end }}{{ with .task }}{{ .name }}{{ end }}`},
+			},
+			wantErr: false,
+		},
+		{
+			name: "undefined variable through $ inside range",
+			vars: []string{"PKGS", "VERSION"},
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `echo {{ range .PKGS }}{{ $.VERSON }}{{ end }}`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			err:     `task "build" command "echo {{ range .PKGS }}{{ $.VERSON }}{{ end }}": undefined variable "VERSON". Did you mean "VERSION"?`,
+			wantErr: true,
+		},
+		{
+			name: "undefined context field",
+			vars: nil,
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `echo {{ .task.nme }}`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			err:     `task "build" command "echo {{ .task.nme }}": undefined variable "task.nme". Did you mean "task.name"?`,
+			wantErr: true,
+		},
+		{
+			name: "undefined builtin",
+			vars: []string{"NAME"},
+			in: ast.Task{
+				Name:     ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Commands: []ast.Node{ast.Command{Command: `echo {{ shout .NAME }}`, NodeType: ast.NodeCommand}},
+				NodeType: ast.NodeTask,
+			},
+			err:     `task "build" command "echo {{ shout .NAME }}": template: check:1: function "shout" not defined`,
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := task.New(tt.in, testdata, tt.vars) // Initialise root at testdata
+			got, err := task.New(tt.in, testdata, tt.vars, nil) // Initialise root at testdata
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("newTask() err = %v, wanted %v", err, tt.wantErr)
 			}
 
+			if err != nil && err.Error() != tt.err {
+				t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("task.Task mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewConditional(t *testing.T) {
+	t.Parallel()
+	vars := map[string]string{"CI": "true", "MODE": "release", "EMPTY": ""}
+	names := []string{"CI", "EMPTY", "MODE"}
+	lookup := func(name string) (string, error) {
+		return vars[name], nil
+	}
+
+	cond := func(left ast.Node, op string, right ast.Node) ast.Condition {
+		return ast.Condition{Left: left, Operator: op, Right: right, NodeType: ast.NodeCondition}
+	}
+	ident := func(name string) ast.Ident { return ast.Ident{Name: name, NodeType: ast.NodeIdent} }
+	str := func(text string) ast.String { return ast.String{Text: text, NodeType: ast.NodeString} }
+	command := func(text string) ast.Command { return ast.Command{Command: text, NodeType: ast.NodeCommand} }
+
+	tests := []struct {
+		condition ast.Node
+		name      string
+		err       string
+		commands  []ast.Node
+		want      task.Task
+		wantErr   bool
+	}{
+		{
+			name:      "true",
+			condition: cond(ident("os"), "==", str(runtime.GOOS)),
+			commands:  []ast.Node{command("open")},
+			want: task.Task{
+				Name:      "open",
+				Commands:  []string{"open"},
+				Condition: fmt.Sprintf("os == %q", runtime.GOOS),
+			},
+		},
+		{
+			name:      "false",
+			condition: cond(ident("os"), "==", str("plan9")),
+			commands:  []ast.Node{command("open")},
+			want: task.Task{
+				Name:      "open",
+				Commands:  []string{"open"},
+				Condition: `os == "plan9"`,
+				Disabled:  true,
+			},
+		},
+		{
+			name:      "not equal",
+			condition: cond(ident("MODE"), "!=", str("debug")),
+			want: task.Task{
+				Name:      "open",
+				Condition: `MODE != "debug"`,
+			},
+		},
+		{
+			name: "and or",
+			condition: cond(
+				cond(ident("EMPTY"), "", nil),
+				"||",
+				cond(cond(ident("CI"), "", nil), "&&", cond(ident("arch"), "==", str(runtime.GOARCH))),
+			),
+			want: task.Task{
+				Name:      "open",
+				Condition: fmt.Sprintf("EMPTY || CI && arch == %q", runtime.GOARCH),
+			},
+		},
+		{
+			name: "conditional commands",
+			commands: []ast.Node{
+				command("echo start"),
+				ast.Conditional{
+					Condition: cond(ident("MODE"), "==", str("debug")),
+					Then:      []ast.Node{command("echo debug")},
+					Else: []ast.Node{
+						ast.Conditional{
+							Condition: cond(ident("CI"), "", nil),
+							Then:      []ast.Node{command("echo ci"), command("echo {{ .MODE }}")},
+							Else:      []ast.Node{command("echo local")},
+							NodeType:  ast.NodeConditional,
+						},
+					},
+					NodeType: ast.NodeConditional,
+				},
+				command("echo end"),
+			},
+			want: task.Task{
+				Name:     "open",
+				Commands: []string{"echo start", "echo ci", "echo {{ .MODE }}", "echo end"},
+			},
+		},
+		{
+			name:      "undefined variable",
+			condition: cond(ident("MOD"), "==", str("debug")),
+			wantErr:   true,
+			err:       `task "open" condition "MOD == \"debug\"": undefined variable "MOD". Did you mean "MODE"?`,
+		},
+		{
+			name: "undefined variable in branch that does not apply",
+			commands: []ast.Node{
+				ast.Conditional{
+					Condition: cond(ident("CI"), "", nil),
+					Then:      []ast.Node{command("echo ci")},
+					Else:      []ast.Node{command("echo {{ .MOD }}")},
+					NodeType:  ast.NodeConditional,
+				},
+			},
+			wantErr: true,
+			err:     `task "open" command "echo {{ .MOD }}": undefined variable "MOD". Did you mean "MODE"?`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := ast.Task{
+				Condition: tt.condition,
+				Name:      ident("open"),
+				Commands:  tt.commands,
+				NodeType:  ast.NodeTask,
+			}
+			got, err := task.New(in, t.TempDir(), names, lookup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() err = %v, wanted %v", err, tt.wantErr)
+			}
+
+			if err != nil && err.Error() != tt.err {
+				t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("task.Task mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewAttributes(t *testing.T) {
+	t.Parallel()
+	attr := func(name string, args ...string) ast.Attribute {
+		nodes := make([]ast.Node, 0, len(args))
+		for _, arg := range args {
+			nodes = append(nodes, ast.String{Text: arg, NodeType: ast.NodeString})
+		}
+		return ast.Attribute{Name: ast.Ident{Name: name, NodeType: ast.NodeIdent}, Arguments: nodes, NodeType: ast.NodeAttribute}
+	}
+
+	tests := []struct {
+		name    string
+		err     string
+		in      []ast.Attribute
+		want    task.Task
+		wantErr bool
+	}{
+		{
+			name: "none",
+			want: task.Task{Name: "build"},
+		},
+		{
+			name: "all",
+			in: []ast.Attribute{
+				attr("timeout", "5m"),
+				attr("dir", "web/"),
+				attr("env", "NODE_ENV", "production"),
+				attr("env", "CI", "true"),
+				attr("private"),
+			},
+			want: task.Task{
+				Name:    "build",
+				Timeout: 5 * time.Minute,
+				Dir:     "web",
+				Env:     map[string]string{"NODE_ENV": "production", "CI": "true"},
+				Private: true,
+			},
+		},
+		{
+			name:    "unknown",
+			in:      []ast.Attribute{attr("timeot", "5m")},
+			wantErr: true,
+			err:     `task "build": unknown attribute @timeot. Did you mean @timeout?`,
+		},
+		{
+			name:    "unknown no suggestion",
+			in:      []ast.Attribute{attr("cache")},
+			wantErr: true,
+			err:     `task "build": unknown attribute @cache`,
+		},
+		{
+			name:    "duplicate",
+			in:      []ast.Attribute{attr("dir", "web"), attr("dir", "api")},
+			wantErr: true,
+			err:     `task "build": duplicate attribute @dir`,
+		},
+		{
+			name:    "duplicate env",
+			in:      []ast.Attribute{attr("env", "CI", "true"), attr("env", "CI", "false")},
+			wantErr: true,
+			err:     `task "build": @env: environment variable "CI" set more than once`,
+		},
+		{
+			name:    "wrong number of arguments",
+			in:      []ast.Attribute{attr("env", "CI")},
+			wantErr: true,
+			err:     `task "build": @env takes 2 argument(s), got 1: @env(name, value)`,
+		},
+		{
+			name: "non string argument",
+			in: []ast.Attribute{{
+				Name:      ast.Ident{Name: "dir", NodeType: ast.NodeIdent},
+				Arguments: []ast.Node{ast.Ident{Name: "WEB", NodeType: ast.NodeIdent}},
+				NodeType:  ast.NodeAttribute,
+			}},
+			wantErr: true,
+			err:     `task "build": @dir arguments must be strings, got WEB: @dir(path)`,
+		},
+		{
+			name: "aliases",
+			in:   []ast.Attribute{attr("alias", "b"), attr("alias", "compile")},
+			want: task.Task{Name: "build", Aliases: []string{"b", "compile"}},
+		},
+		{
+			name:    "invalid alias",
+			in:      []ast.Attribute{attr("alias", "b-1")},
+			wantErr: true,
+			err:     `task "build": @alias: invalid alias "b-1", aliases must be valid task names`,
+		},
+		{
+			name:    "alias is own name",
+			in:      []ast.Attribute{attr("alias", "build")},
+			wantErr: true,
+			err:     `task "build": @alias: alias "build" is the task's own name`,
+		},
+		{
+			name:    "duplicate alias",
+			in:      []ast.Attribute{attr("alias", "b"), attr("alias", "b")},
+			wantErr: true,
+			err:     `task "build": @alias: alias "b" given more than once`,
+		},
+		{
+			name: "interactive",
+			in:   []ast.Attribute{attr("interactive")},
+			want: task.Task{Name: "build", Interactive: true},
+		},
+		{
+			name: "tags",
+			in:   []ast.Attribute{attr("tag", "ci"), attr("tag", "lint")},
+			want: task.Task{Name: "build", Tags: []string{"ci", "lint"}},
+		},
+		{
+			name:    "duplicate tag",
+			in:      []ast.Attribute{attr("tag", "ci"), attr("tag", "ci")},
+			wantErr: true,
+			err:     `task "build": @tag: tag "ci" given more than once`,
+		},
+		{
+			name: "matrix",
+			in:   []ast.Attribute{attr("matrix", "GOOS"), attr("matrix", "GOARCH")},
+			want: task.Task{Name: "build", Matrix: []string{"GOOS", "GOARCH"}},
+		},
+		{
+			name:    "matrix undefined variable",
+			in:      []ast.Attribute{attr("matrix", "GOO")},
+			wantErr: true,
+			err:     `task "build": @matrix: undefined variable "GOO". Did you mean "GOOS"?`,
+		},
+		{
+			name: "finally",
+			in:   []ast.Attribute{attr("finally", "teardown"), attr("finally", "clean")},
+			want: task.Task{Name: "build", Finally: []string{"teardown", "clean"}},
+		},
+		{
+			name:    "finally itself",
+			in:      []ast.Attribute{attr("finally", "build")},
+			wantErr: true,
+			err:     `task "build": @finally: a task can't be it's own finally task`,
+		},
+		{
+			name: "retry",
+			in:   []ast.Attribute{attr("retry", "3")},
+			want: task.Task{Name: "build", Retry: task.Retry{Attempts: 3}},
+		},
+		{
+			name: "retry with backoff",
+			in:   []ast.Attribute{attr("retry", "3", "2s"), attr("retry_on", "1 130")},
+			want: task.Task{Name: "build", Retry: task.Retry{Attempts: 3, Backoff: 2 * time.Second, Codes: []int{1, 130}}},
+		},
+		{
+			name:    "retry too many arguments",
+			in:      []ast.Attribute{attr("retry", "3", "2s", "1")},
+			wantErr: true,
+			err:     `task "build": @retry takes 1 to 2 argument(s), got 3: @retry(attempts[, backoff])`,
+		},
+		{
+			name:    "retry bad attempts",
+			in:      []ast.Attribute{attr("retry", "0")},
+			wantErr: true,
+			err:     `task "build": @retry: invalid number of attempts "0", expected a whole number of at least 1`,
+		},
+		{
+			name:    "retry_on bad status",
+			in:      []ast.Attribute{attr("retry", "2"), attr("retry_on", "1 256")},
+			wantErr: true,
+			err:     `task "build": @retry_on: invalid exit status "256", expected a whole number from 1 to 255`,
+		},
+		{
+			name:    "retry_on without retry",
+			in:      []ast.Attribute{attr("retry_on", "1")},
+			wantErr: true,
+			err:     `task "build": @retry_on has no effect without @retry`,
+		},
+		{
+			name: "shell",
+			in:   []ast.Attribute{attr("shell", "bash")},
+			want: task.Task{Name: "build", Shell: "bash"},
+		},
+		{
+			name:    "unsupported shell",
+			in:      []ast.Attribute{attr("shell", "fish")},
+			wantErr: true,
+			err:     `task "build": @shell: unsupported shell "fish", expected one of bash, cmd, dash, integrated, powershell, pwsh, sh, zsh`,
+		},
+		{
+			name:    "bad timeout",
+			in:      []ast.Attribute{attr("timeout", "5 minutes")},
+			wantErr: true,
+			err:     `task "build": @timeout: invalid duration "5 minutes", expected e.g. "30s" or "5m"`,
+		},
+		{
+			name:    "negative timeout",
+			in:      []ast.Attribute{attr("timeout", "-1s")},
+			wantErr: true,
+			err:     `task "build": @timeout: timeout must be positive, got -1s`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := ast.Task{
+				Name:       ast.Ident{Name: "build", NodeType: ast.NodeIdent},
+				Attributes: tt.in,
+				NodeType:   ast.NodeTask,
+			}
+			got, err := task.New(in, t.TempDir(), []string{"GOARCH", "GOOS"}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() err = %v, wanted %v", err, tt.wantErr)
+			}
+
+			if err != nil && err.Error() != tt.err {
+				t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("task.Task mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTaskRunTimeout(t *testing.T) {
+	t.Parallel()
+	tsk := task.Task{
+		Name:     "slow",
+		Commands: []string{"echo before", "sleep 10", "echo after"},
+		Timeout:  50 * time.Millisecond,
+		Retry:    task.Retry{Attempts: 3},
+	}
+
+	start := time.Now()
+	got, err := tsk.Run(context.Background(), shell.NewIntegratedRunner(), iostream.Null(), nil, nil)
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	// A timeout is a failure like any other, but it isn't retried
+	want := task.Result{
+		Task: "slow",
+		CommandResults: shell.Results{
+			{Cmd: "echo before", Stdout: "before\n"},
+			{Cmd: "sleep 10", Stderr: "task \"slow\" timed out after 50ms\n", Status: task.TimeoutStatus},
+		},
+	}
+	if diff := cmp.Diff(want, got, ignoreTimings, cmpopts.IgnoreFields(task.Result{}, "Start", "End", "Duration")); diff != "" {
+		t.Errorf("Result mismatch (-want +got):\n%s", diff)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Task was not stopped at it's timeout, took %v", elapsed)
+	}
+}
+
+func TestTaskRunRetry(t *testing.T) {
+	t.Parallel()
+	// Fails the first time it's run in a directory, succeeds after that
+	flaky := "test -f ran || { touch ran; exit 1; }"
+
+	tests := []struct {
+		name     string
+		retry    task.Retry
+		command  string
+		attempts int  // Number of attempts expected in the result, 0 if not retried
+		ok       bool // Whether the final attempt should succeed
+	}{
+		{
+			name:    "no retries",
+			command: flaky,
+		},
+		{
+			name:     "succeeds on retry",
+			retry:    task.Retry{Attempts: 3, Backoff: time.Millisecond},
+			command:  flaky,
+			attempts: 2,
+			ok:       true,
+		},
+		{
+			name:     "never succeeds",
+			retry:    task.Retry{Attempts: 3, Backoff: time.Millisecond},
+			command:  "exit 1",
+			attempts: 3,
+		},
+		{
+			name:    "status not retried",
+			retry:   task.Retry{Attempts: 3, Codes: []int{2}},
+			command: "exit 1",
+		},
+		{
+			name:     "status retried",
+			retry:    task.Retry{Attempts: 2, Codes: []int{2}},
+			command:  "exit 2",
+			attempts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tsk := task.Task{
+				Name:     "flaky",
+				Commands: []string{tt.command},
+				Dir:      t.TempDir(),
+				Retry:    tt.retry,
+			}
+
+			got, err := tsk.Run(context.Background(), shell.NewIntegratedRunner(), iostream.Null(), nil, nil)
+			if err != nil {
+				t.Fatalf("Run returned an error: %v", err)
+			}
+
+			if len(got.Attempts) != tt.attempts {
+				t.Errorf("Wrong number of attempts: got %d, wanted %d", len(got.Attempts), tt.attempts)
+			}
+			if got.Ok() != tt.ok {
+				t.Errorf("Wrong final result: got Ok() = %v, wanted %v", got.Ok(), tt.ok)
+			}
+			if tt.attempts != 0 {
+				if diff := cmp.Diff(got.Attempts[len(got.Attempts)-1], got.CommandResults); diff != "" {
+					t.Errorf("CommandResults should be the final attempt (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{name: "no backoff", backoff: 0, attempt: 5, want: 0},
+		{name: "first retry", backoff: time.Second, attempt: 1, want: time.Second},
+		{name: "doubles", backoff: time.Second, attempt: 4, want: 8 * time.Second},
+		{name: "capped", backoff: time.Minute, attempt: 5, want: task.MaxBackoff},
+		{name: "backoff over the cap", backoff: time.Hour, attempt: 1, want: task.MaxBackoff},
+		{name: "huge attempt", backoff: time.Second, attempt: 1000, want: task.MaxBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			retry := task.Retry{Attempts: tt.attempt + 1, Backoff: tt.backoff}
+			if got := retry.Delay(tt.attempt); got != tt.want {
+				t.Errorf("Wrong delay: got %v, wanted %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstances(t *testing.T) {
+	t.Parallel()
+	vars := map[string]string{
+		"GOOS":   "linux darwin",
+		"GOARCH": " amd64\tarm64\n",
+		"EMPTY":  "  ",
+		"QUOTED": `'hello world' "dir/with space" other`,
+		"EMPTYQ": `'' other`,
+		"OPEN":   `'hello world other`,
+	}
+	lookup := func(name string) (string, error) {
+		val, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %q", name)
+		}
+		return val, nil
+	}
+
+	tests := []struct {
+		name    string
+		err     string
+		in      task.Task
+		want    []task.Task
+		wantErr bool
+	}{
+		{
+			name: "no matrix",
+			in:   task.Task{Name: "build"},
+			want: nil,
+		},
+		{
+			name: "one variable",
+			in: task.Task{
+				Name:     "build",
+				Commands: []string{"go build"},
+				Matrix:   []string{"GOOS"},
+				Aliases:  []string{"b"},
+				Tags:     []string{"ci"},
+			},
+			want: []task.Task{
+				{Name: "build[linux]", Commands: []string{"go build"}, Vars: map[string]string{"GOOS": "linux"}},
+				{Name: "build[darwin]", Commands: []string{"go build"}, Vars: map[string]string{"GOOS": "darwin"}},
+			},
+		},
+		{
+			name: "two variables",
+			in:   task.Task{Name: "build", Matrix: []string{"GOOS", "GOARCH"}},
+			want: []task.Task{
+				{Name: "build[linux,amd64]", Vars: map[string]string{"GOOS": "linux", "GOARCH": "amd64"}},
+				{Name: "build[linux,arm64]", Vars: map[string]string{"GOOS": "linux", "GOARCH": "arm64"}},
+				{Name: "build[darwin,amd64]", Vars: map[string]string{"GOOS": "darwin", "GOARCH": "amd64"}},
+				{Name: "build[darwin,arm64]", Vars: map[string]string{"GOOS": "darwin", "GOARCH": "arm64"}},
+			},
+		},
+		{
+			name: "quoted",
+			in:   task.Task{Name: "greet", Matrix: []string{"QUOTED"}},
+			want: []task.Task{
+				{Name: "greet[hello world]", Vars: map[string]string{"QUOTED": "hello world"}},
+				{Name: "greet[dir/with space]", Vars: map[string]string{"QUOTED": "dir/with space"}},
+				{Name: "greet[other]", Vars: map[string]string{"QUOTED": "other"}},
+			},
+		},
+		{
+			name: "empty quoted",
+			in:   task.Task{Name: "greet", Matrix: []string{"EMPTYQ"}},
+			want: []task.Task{
+				{Name: "greet[]", Vars: map[string]string{"EMPTYQ": ""}},
+				{Name: "greet[other]", Vars: map[string]string{"EMPTYQ": "other"}},
+			},
+		},
+		{
+			name:    "unterminated quote",
+			in:      task.Task{Name: "greet", Matrix: []string{"OPEN"}},
+			wantErr: true,
+			err:     `task "greet": @matrix: variable "OPEN": unterminated ' quote in "'hello world other"`,
+		},
+		{
+			name:    "empty",
+			in:      task.Task{Name: "build", Matrix: []string{"EMPTY"}},
+			wantErr: true,
+			err:     `task "build": @matrix: variable "EMPTY" has no values`,
+		},
+		{
+			name:    "lookup error",
+			in:      task.Task{Name: "build", Matrix: []string{"MISSING"}},
+			wantErr: true,
+			err:     `task "build": @matrix: undefined variable "MISSING"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.in.Instances(lookup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Instances() err = %v, wantErr = %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if err.Error() != tt.err {
+					t.Errorf("Wrong error\nGot: %s\nWant: %s", err.Error(), tt.err)
+				}
+				return
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Instances mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		ctx     task.Context
+		in      task.Task
+		want    task.Task
+		wantErr bool
+	}{
+		{
+			name:    "no commands",
+			in:      task.Task{Name: "empty"},
+			want:    task.Task{Name: "empty"},
+			wantErr: false,
+		},
+		{
+			name:    "no vars",
+			in:      task.Task{Name: "simple", Commands: []string{"go test ./..."}},
+			want:    task.Task{Name: "simple", Commands: []string{"go test ./..."}},
+			wantErr: false,
+		},
+		{
+			name:    "simple with vars",
+			in:      task.Task{Name: "simple", Commands: []string{"go test {{.GLOBAL}}", "echo {{.OTHER}}"}},
+			ctx:     task.Context{Vars: map[string]string{"GLOBAL": "hello", "OTHER": "there"}},
+			want:    task.Task{Name: "simple", Commands: []string{"go test hello", "echo there"}},
+			wantErr: false,
+		},
+		{
+			name:    "builtins",
+			in:      task.Task{Name: "simple", Commands: []string{`echo {{ upper .NAME }}`, `echo {{ replace .NAME "k" "ky" }}`}},
+			ctx:     task.Context{Vars: map[string]string{"NAME": "spok"}},
+			want:    task.Task{Name: "simple", Commands: []string{"echo SPOK", "echo spoky"}},
+			wantErr: false,
+		},
+		{
+			name:    "builtin bad arguments",
+			in:      task.Task{Name: "simple", Commands: []string{`echo {{ upper .NAME "extra" }}`}},
+			ctx:     task.Context{Vars: map[string]string{"NAME": "spok"}},
+			wantErr: true,
+		},
+		{
+			name:    "undefined builtin",
+			in:      task.Task{Name: "simple", Commands: []string{`echo {{ shout .NAME }}`}},
+			ctx:     task.Context{Vars: map[string]string{"NAME": "spok"}},
+			wantErr: true,
+		},
+		{
+			name: "context",
+			in: task.Task{
+				Name: "build",
+				Commands: []string{
+					"echo {{ .task.name }} in {{ .spokfile.dir }}",
+					"cat {{ .spokfile.path }}",
+					"gofmt -l {{ .task.deps }}",
+					"{{ range .task.deps }}echo {{ basename . }};{{ end }}",
+				},
+			},
+			ctx: task.Context{
+				Dir:   "/project",
+				Path:  "/project/spokfile",
+				Files: []string{"/project/main.go", "/project/other.go"},
+			},
+			want: task.Task{
+				Name: "build",
+				Commands: []string{
+					"echo build in /project",
+					"cat /project/spokfile",
+					"gofmt -l /project/main.go /project/other.go",
+					"echo main.go;echo other.go;",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "bad template",
+			in:      task.Task{Name: "simple", Commands: []string{"go test {{.GLOBAL"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.in.Expand(tt.ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expand() err = %v, wanted %v", err, tt.wantErr)
+			}
+
 			if diff := cmp.Diff(tt.want, got); diff != "" {
 				t.Errorf("task.Task mismatch (-want +got):\n%s", diff)
 			}
@@ -403,14 +1178,36 @@ func TestTaskRun(t *testing.T) {
 			task: task.Task{Name: "multiple", Commands: []string{
 				"echo hello",
 				"false",                 // 1 status code here
-				"echo hello stderr >&2", // Should still see these
+				"echo hello stderr >&2", // Should stop before these
 				"true",
 			}},
 			want: shell.Results{
 				{Stdout: "hello\n", Stderr: "", Status: 0, Cmd: "echo hello"},
 				{Stdout: "", Stderr: "", Status: 1, Cmd: "false"},
-				{Stdout: "", Stderr: "hello stderr\n", Status: 0, Cmd: "echo hello stderr >&2"},
-				{Stdout: "", Stderr: "", Status: 0, Cmd: "true"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "ignore error",
+			task: task.Task{Name: "ignore", Commands: []string{
+				"-false",
+				"@-echo hello",
+			}},
+			want: shell.Results{
+				{Stdout: "", Stderr: "", Status: 1, Cmd: "false", Ignored: true},
+				{Stdout: "hello\n", Stderr: "", Status: 0, Cmd: "echo hello"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "environment",
+			task: task.Task{
+				Name:     "environment",
+				Commands: []string{"echo $SPOK_MODE $SPOK_TARGET"},
+				Env:      map[string]string{"SPOK_MODE": "release", "SPOK_TARGET": "wasm"},
+			},
+			want: shell.Results{
+				{Stdout: "release wasm\n", Stderr: "", Status: 0, Cmd: "echo $SPOK_MODE $SPOK_TARGET"},
 			},
 			wantErr: false,
 		},
@@ -427,18 +1224,94 @@ func TestTaskRun(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			runner := shell.NewIntegratedRunner()
-			got, err := tt.task.Run(runner, iostream.Null(), nil)
+			got, err := tt.task.Run(context.Background(), runner, iostream.Null(), nil, nil)
 			if (err != nil) != tt.wantErr {
 				t.Fatalf("Run() err = %v, wantErr = %v", err, tt.wantErr)
 			}
 
-			if diff := cmp.Diff(tt.want, got); diff != "" {
+			if diff := cmp.Diff(tt.want, got.CommandResults, ignoreTimings); diff != "" {
 				t.Errorf("task.Result mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
+func TestTaskRunEcho(t *testing.T) {
+	t.Parallel()
+	tsk := task.Task{Name: "echo", Commands: []string{
+		"echo loud",
+		"@echo quiet",
+	}}
+
+	stream := iostream.Test()
+	if _, err := tsk.Run(context.Background(), shell.NewIntegratedRunner(), stream, nil, nil); err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	stdout, ok := stream.Stdout.(*bytes.Buffer)
+	if !ok {
+		t.Fatalf("Test stream stdout was not a *bytes.Buffer")
+	}
+
+	// Only the command without '@' is echoed
+	want := "echo loud\nloud\nquiet\n"
+	if diff := cmp.Diff(want, stdout.String()); diff != "" {
+		t.Errorf("Output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTaskRunTimings(t *testing.T) {
+	t.Parallel()
+	tsk := task.Task{Name: "sleepy", Commands: []string{
+		"sleep 0.01",
+		"sleep 0.02",
+	}}
+
+	got, err := tsk.Run(context.Background(), shell.NewIntegratedRunner(), iostream.Null(), nil, nil)
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+
+	if got.Duration != got.End.Sub(got.Start) {
+		t.Errorf("task Duration %s is not End - Start (%s)", got.Duration, got.End.Sub(got.Start))
+	}
+
+	var commands time.Duration
+	for _, cmd := range got.CommandResults {
+		if cmd.Duration != cmd.End.Sub(cmd.Start) {
+			t.Errorf("command %q Duration %s is not End - Start (%s)", cmd.Cmd, cmd.Duration, cmd.End.Sub(cmd.Start))
+		}
+		if cmd.Start.Before(got.Start) || cmd.End.After(got.End) {
+			t.Errorf("command %q ran from %s to %s, outside it's task (%s to %s)", cmd.Cmd, cmd.Start, cmd.End, got.Start, got.End)
+		}
+		commands += cmd.Duration
+	}
+
+	if commands < 30*time.Millisecond {
+		t.Errorf("commands took %s in total, should be at least 30ms", commands)
+	}
+	if got.Duration < commands {
+		t.Errorf("task took %s, less than it's commands (%s)", got.Duration, commands)
+	}
+}
+
+func TestClosestMatch(t *testing.T) {
+	t.Parallel()
+	candidates := []string{"build", "test", "lint", "VERSION"}
+	tests := map[string]string{
+		"bild":    "build",
+		"tst":     "test",
+		"VERSOIN": "VERSION",
+		"lnit":    "lint",
+		"deploy":  "",
+	}
+	for target, want := range tests {
+		if got := task.ClosestMatch(target, candidates); got != want {
+			t.Errorf("ClosestMatch(%q) = %q, wanted %q", target, got, want)
+		}
+	}
+}
+
 func TestResultOk(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -464,6 +1337,11 @@ func TestResultOk(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name:   "blocked",
+			result: task.Result{BlockedBy: "lint"},
+			want:   false,
+		},
 		{
 			name: "multiple successes",
 			result: task.Result{
@@ -667,6 +1545,43 @@ func TestResultsJSON(t *testing.T) {
 			},
 			want: `[{"task":"test","results":[{"cmd":"echo hello","stdout":"hello\n","stderr":"","status":0}],"skipped":false}]`,
 		},
+		{
+			name: "retried",
+			results: task.Results{
+				{
+					Task:           "flaky",
+					CommandResults: shell.Results{{Cmd: "true", Status: 0}},
+					Attempts: []shell.Results{
+						{{Cmd: "true", Status: 1}},
+						{{Cmd: "true", Status: 0}},
+					},
+				},
+			},
+			want: `[{"task":"flaky","results":[{"cmd":"true","stdout":"","stderr":"","status":0}],` +
+				`"attempts":[[{"cmd":"true","stdout":"","stderr":"","status":1}],[{"cmd":"true","stdout":"","stderr":"","status":0}]],"skipped":false}]`,
+		},
+		{
+			name: "timed",
+			results: task.Results{
+				{
+					Task:  "build",
+					Start: time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+					End:   time.Date(2026, 1, 2, 15, 4, 6, 500000000, time.UTC),
+					CommandResults: shell.Results{
+						{
+							Cmd:      "go build",
+							Start:    time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+							End:      time.Date(2026, 1, 2, 15, 4, 6, 500000000, time.UTC),
+							Duration: 1500 * time.Millisecond,
+						},
+					},
+					Duration: 1500 * time.Millisecond,
+				},
+			},
+			want: `[{"start":"2026-01-02T15:04:05Z","end":"2026-01-02T15:04:06.5Z","task":"build","results":` +
+				`[{"start":"2026-01-02T15:04:05Z","end":"2026-01-02T15:04:06.5Z","cmd":"go build","stdout":"","stderr":"","status":0,"duration_ns":1500000000}],` +
+				`"duration_ns":1500000000,"skipped":false}]`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -690,12 +1605,12 @@ func BenchmarkNewTask(b *testing.B) {
 		Docstring:    ast.Comment{Text: " Very complex things here", NodeType: ast.NodeComment},
 		Dependencies: []ast.Node{ast.String{Text: "**/*.txt", NodeType: ast.NodeString}},
 		Outputs:      []ast.Node{ast.String{Text: "./bin/main", NodeType: ast.NodeString}},
-		Commands:     []ast.Command{{Command: "go build .", NodeType: ast.NodeCommand}},
+		Commands:     []ast.Node{ast.Command{Command: "go build .", NodeType: ast.NodeCommand}},
 		NodeType:     ast.NodeTask,
 	}
 
 	for b.Loop() {
-		_, err := task.New(input, testdata, make(map[string]string))
+		_, err := task.New(input, testdata, nil, nil)
 		if err != nil {
 			b.Fatalf("newTask returned an error: %v", err)
 		}
@@ -0,0 +1,169 @@
+package task
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"go.followtheprocess.codes/spok/builtins"
+)
+
+// templateContext is the set of values spok makes available to every command template
+// alongside the global variables, and the fields each one has.
+var templateContext = map[string][]string{
+	"task":     {"name", "deps"},
+	"spokfile": {"dir", "path"},
+}
+
+// Refs returns the names of the variables referenced in a template
+// string e.g. "{{.ROOT}}/bin" references ROOT.
+func Refs(text string) ([]string, error) {
+	fields, err := fieldChains(text)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]string, 0, len(fields))
+	for _, field := range fields {
+		refs = append(refs, field[0])
+	}
+	return refs, nil
+}
+
+// checkCommand ensures that every variable a command template references is either
+// one of vars or part of the template context, so that a typo is an error rather than
+// quietly expanding to "<no value>".
+func checkCommand(command string, vars []string) error {
+	if !strings.Contains(command, "{{") {
+		return nil
+	}
+
+	if _, err := template.New("check").Funcs(builtins.FuncMap(builtins.Context{})).Parse(command); err != nil {
+		return err
+	}
+
+	fields, err := fieldChains(command)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		name := field[0]
+		if keys, ok := templateContext[name]; ok {
+			if len(field) > 1 && !slices.Contains(keys, field[1]) {
+				return undefinedError(name+"."+field[1], prefixed(name+".", keys))
+			}
+			continue
+		}
+		if !slices.Contains(vars, name) {
+			return undefinedError(name, vars)
+		}
+	}
+
+	return nil
+}
+
+// undefinedError returns an error for a reference to an undefined variable, suggesting
+// the closest match from candidates if there is one.
+func undefinedError(name string, candidates []string) error {
+	if closest := ClosestMatch(name, candidates); closest != "" {
+		return fmt.Errorf("undefined variable %q. Did you mean %q?", name, closest)
+	}
+	return fmt.Errorf("undefined variable %q", name)
+}
+
+// prefixed returns a copy of names with prefix added to each one.
+func prefixed(prefix string, names []string) []string {
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		result = append(result, prefix+name)
+	}
+	return result
+}
+
+// expandVars executes a command as a template, substituting in any
+// templated variables and calling any builtins from funcs.
+func expandVars(command string, data map[string]any, funcs template.FuncMap) (string, error) {
+	if !strings.Contains(command, "{{") {
+		return command, nil
+	}
+	tmp := template.New("tmp").Funcs(funcs).Option("missingkey=error")
+	parsed, err := tmp.Parse(command)
+	if err != nil {
+		return "", err
+	}
+	out := &bytes.Buffer{}
+	if err := parsed.Execute(out, data); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// fieldChains returns every field referenced in a template string, each as
+// the chain of identifiers e.g. "{{ .task.name }}" gives ["task", "name"].
+//
+// Only fields of the template's data are returned, so inside the body of a range or
+// with, where dot is something else, only those through "$" e.g. "{{ $.VERSION }}" are.
+func fieldChains(text string) ([][]string, error) {
+	tree := parse.New("refs")
+	tree.Mode = parse.SkipFuncCheck
+	if _, err := tree.Parse(text, "", "", make(map[string]*parse.Tree)); err != nil {
+		return nil, err
+	}
+
+	var fields [][]string
+	var walk func(node parse.Node, rooted bool)
+
+	// rooted is whether dot is still the template's data
+	walk = func(node parse.Node, rooted bool) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+			for _, child := range node.Nodes {
+				walk(child, rooted)
+			}
+		case *parse.ActionNode:
+			walk(node.Pipe, rooted)
+		case *parse.PipeNode:
+			if node == nil {
+				return
+			}
+			for _, cmd := range node.Cmds {
+				walk(cmd, rooted)
+			}
+		case *parse.CommandNode:
+			for _, arg := range node.Args {
+				walk(arg, rooted)
+			}
+		case *parse.FieldNode:
+			if rooted {
+				fields = append(fields, node.Ident)
+			}
+		case *parse.VariableNode:
+			if node.Ident[0] == "$" && len(node.Ident) > 1 {
+				fields = append(fields, node.Ident[1:])
+			}
+		case *parse.IfNode:
+			walk(node.Pipe, rooted)
+			walk(node.List, rooted)
+			walk(node.ElseList, rooted)
+		case *parse.RangeNode:
+			// Dot is each element in the body, but is left alone for else
+			walk(node.Pipe, rooted)
+			walk(node.List, false)
+			walk(node.ElseList, rooted)
+		case *parse.WithNode:
+			walk(node.Pipe, rooted)
+			walk(node.List, false)
+			walk(node.ElseList, rooted)
+		}
+	}
+	walk(tree.Root, true)
+
+	return fields, nil
+}
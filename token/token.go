@@ -2,7 +2,10 @@
 // as well as basic operations on those tokens e.g. printing
 package token
 
-import "fmt"
+import (
+	"fmt"
+	"unicode"
+)
 
 // Type is the set of lexical tokens in spok.
 type Type int
@@ -30,6 +33,14 @@ const (
 	DECLARE             // :=
 	LINTERP             // {{
 	RINTERP             // }}
+	IF                  // if
+	ELSE                // else
+	EQ                  // ==
+	NEQ                 // !=
+	AND                 // &&
+	OR                  // ||
+	AT                  // @
+	MINUS               // -
 )
 
 const displayLength = 15
@@ -59,3 +70,23 @@ func (t Token) String() string {
 func (t Token) Is(typ Type) bool {
 	return t.Type == typ
 }
+
+// IsIdent reports whether name is a valid spok identifier e.g. the name of
+// a task, variable or tag.
+func IsIdent(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !IsIdentRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsIdentRune reports whether r is valid in a spok identifier, this is what the
+// lexer uses so that IsIdent accepts exactly the names a spokfile can declare.
+func IsIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
@@ -26,11 +26,19 @@ func _() {
 	_ = x[DECLARE-15]
 	_ = x[LINTERP-16]
 	_ = x[RINTERP-17]
+	_ = x[IF-18]
+	_ = x[ELSE-19]
+	_ = x[EQ-20]
+	_ = x[NEQ-21]
+	_ = x[AND-22]
+	_ = x[OR-23]
+	_ = x[AT-24]
+	_ = x[MINUS-25]
 }
 
-const _Type_name = "EOFERRORCOMMENT#(){}\",taskSTRINGCOMMAND->IDENT:={{}}"
+const _Type_name = "EOFERRORCOMMENT#(){}\",taskSTRINGCOMMAND->IDENT:={{}}ifelse==!=&&||@-"
 
-var _Type_index = [...]uint8{0, 3, 8, 15, 16, 17, 18, 19, 20, 21, 22, 26, 32, 39, 41, 46, 48, 50, 52}
+var _Type_index = [...]uint8{0, 3, 8, 15, 16, 17, 18, 19, 20, 21, 22, 26, 32, 39, 41, 46, 48, 50, 52, 54, 58, 60, 62, 64, 66, 67, 68}
 
 func (i Type) String() string {
 	idx := int(i) - 0
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"testing"
 
+	"go.followtheprocess.codes/spok/parser"
 	"go.followtheprocess.codes/spok/token"
 )
 
@@ -142,3 +143,44 @@ func TestType_String(t *testing.T) {
 		})
 	}
 }
+
+func TestIsIdent(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "VERSION", want: true},
+		{name: "_private", want: true},
+		{name: "snake_case", want: true},
+		{name: "", want: false},
+		{name: "m2", want: false},
+		{name: "go_1_22", want: false},
+		{name: "1st", want: false},
+		{name: "with-dash", want: false},
+		{name: "with space", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := token.IsIdent(tt.name); got != tt.want {
+				t.Errorf("IsIdent(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+
+			if tt.name == "" {
+				// Nothing to declare
+				return
+			}
+
+			// Whatever IsIdent accepts, a spokfile must be able to declare and vice versa
+			_, err := parser.New("task " + tt.name + "() {}\n").Parse()
+			if declared := err == nil; declared != tt.want {
+				t.Errorf("Declaring task %q: got err = %v, want declared = %v", tt.name, err, tt.want)
+			}
+			_, err = parser.New(tt.name + ` := "value"` + "\n").Parse()
+			if declared := err == nil; declared != tt.want {
+				t.Errorf("Declaring variable %q: got err = %v, want declared = %v", tt.name, err, tt.want)
+			}
+		})
+	}
+}